@@ -1,45 +1,94 @@
 package overmount
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
-	"github.com/docker/docker/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
 const emptyDigest = digest.Digest("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
 
+// DigestMismatchError is returned when an unpacked tar does not have the
+// expected digest. Its cause is ErrDigestMismatch.
+type DigestMismatchError struct {
+	Expected digest.Digest
+	Computed digest.Digest
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%v: expected %v, computed %v", ErrDigestMismatch, e.Expected, e.Computed)
+}
+
+// Cause returns ErrDigestMismatch, for errors.Cause.
+func (e *DigestMismatchError) Cause() error {
+	return ErrDigestMismatch
+}
+
 // Asset is the representation of an on-disk asset. Assets usually are a pair
 // of (path, tar) where one direction is applied; f.e., you can copy from the
 // tar to the dir, or the dir to the tar using the Read and Write calls.
 type Asset struct {
-	path    string
-	digest  digest.Digester
-	virtual bool
+	path             string
+	digest           digest.Digester
+	compressedDigest digest.Digester
+	compression      Compression
+	size             *countWriter
+	algorithm        digest.Algorithm
+	idMapping        *IDMapping
+	selinuxLabel     string
+	virtual          bool
+	fs               fileSystem
 }
 
 // NewAsset constructs a new *Asset that operates on path `path`. A digester
 // must be provided. Typically this is a `digest.SHA256.Digester()` but can be
-// any algorithm that opencontainers/go-digest supports.
-func NewAsset(path string, digest digest.Digester, virtual bool) (*Asset, error) {
+// any algorithm that opencontainers/go-digest supports; all digests of the
+// asset are computed with it.
+func NewAsset(path string, digester digest.Digester, virtual bool) (*Asset, error) {
 	a := &Asset{
-		path:    path,
-		digest:  digest,
-		virtual: virtual,
+		path:             path,
+		digest:           digester,
+		compressedDigest: digester,
+		size:             &countWriter{},
+		algorithm:        digester.Digest().Algorithm(),
+		virtual:          virtual,
+		fs:               osFS{},
 	}
 
 	return a, nil
 }
 
-// Digest returns the digest of the last pack or unpack.
+// Digest returns the digest of the last pack or unpack. This is always the
+// digest of the uncompressed tar (the diffID).
 func (a *Asset) Digest() digest.Digest {
 	return a.digest.Digest()
 }
 
+// CompressedDigest returns the digest of the tar as it was read by the last
+// unpack or written by the last pack, compression included. It is the same as
+// Digest if the tar was not compressed.
+func (a *Asset) CompressedDigest() digest.Digest {
+	return a.compressedDigest.Digest()
+}
+
+// Compression returns the compression of the tar read by the last unpack or
+// written by the last pack.
+func (a *Asset) Compression() Compression {
+	return a.compression
+}
+
+// Size returns the size of the uncompressed tar read by the last unpack or
+// written by the last pack.
+func (a *Asset) Size() int64 {
+	return a.size.n
+}
+
 func (a *Asset) checkVirtualSymlink() error {
-	fi, err := os.Lstat(a.path)
+	fi, err := a.fs.Lstat(a.path)
 	if err == nil {
 		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 			return errors.Wrap(ErrInvalidAsset, "cannot read from symlink")
@@ -66,25 +115,29 @@ func (a *Asset) LoadDigest() (digest.Digest, error) {
 			return a.Digest(), err
 		}
 
-		reader, err = os.Open(a.path)
+		reader, err = a.fs.Open(a.path)
 	} else {
 		_, err := os.Lstat(a.path)
 		if os.IsNotExist(err) {
 			return a.Digest(), errors.Wrap(ErrInvalidAsset, "layer directory does not exist")
 		}
 
-		if err := checkDir(a.path, ErrInvalidAsset); err != nil {
+		if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
 			return a.Digest(), err
 		}
 
-		reader, err = archive.Tar(a.path, archive.Uncompressed)
+		if ok, err := a.packTarSplit(io.MultiWriter(a.digest.Hash(), a.compressedDigest.Hash(), a.size)); ok || err != nil {
+			return a.Digest(), err
+		}
+
+		reader, err = a.tarStream(nil)
 	}
 
 	if err != nil {
 		return a.Digest(), err
 	}
 
-	_, err = io.Copy(a.digest.Hash(), reader)
+	_, err = io.Copy(io.MultiWriter(a.digest.Hash(), a.compressedDigest.Hash(), a.size), reader)
 	return a.Digest(), err
 }
 
@@ -94,37 +147,178 @@ func (a *Asset) Path() string {
 }
 
 // Unpack from the io.Reader (must be a tar file!) and unpack to the filesystem.
-// Accepts io.Reader, not *tar.Reader!
+// Accepts io.Reader, not *tar.Reader! The tar may be compressed with any of
+// the algorithms in Compression; this is detected automatically. Virtual
+// assets always store the uncompressed tar. Sparse files in expanded assets
+// keep their holes.
 func (a *Asset) Unpack(reader io.Reader) error {
+	return a.UnpackWithOptions(reader, nil)
+}
+
+// UnpackWithOptions unpacks a tar like Unpack, as controlled by opts. If the
+// tar violates the limits set there, a *LimitError is returned; if it does not
+// have the expected digest, a *DigestMismatchError is. Either way, whatever was
+// unpacked is removed again. As that would leave a partial layer behind in
+// an expanded asset that had contents before, limits and digests are only
+// accepted for empty ones.
+func (a *Asset) UnpackWithOptions(reader io.Reader, opts *UnpackOptions) error {
+	if opts == nil {
+		opts = &UnpackOptions{}
+	}
+
+	if opts.ExpectedDigest != "" && opts.ExpectedDigest.Algorithm() != a.algorithm {
+		return errors.Wrapf(ErrDigestAlgorithm, "expected a %v digest, asset uses %v", opts.ExpectedDigest.Algorithm(), a.algorithm)
+	}
+
+	if (opts.limited() || opts.ExpectedDigest != "") && !a.virtual {
+		empty, err := isEmptyDir(a.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err == nil && !empty {
+			return errors.Wrap(ErrInvalidAsset, "limits and expected digests require an empty asset")
+		}
+	}
+
 	a.resetDigest()
 
-	tee := io.TeeReader(reader, a.digest.Hash())
+	compressed := &countWriter{}
+	raw := io.TeeReader(reader, io.MultiWriter(a.compressedDigest.Hash(), compressed))
+
+	decompressed, compression, err := decompressStream(raw)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidAsset, "cannot read %v stream: %v", compression, err)
+	}
+	defer decompressed.Close()
+
+	a.compression = compression
+
+	if !opts.limited() && opts.ExpectedDigest == "" {
+		return a.unpackStream(decompressed, raw)
+	}
+
+	if opts.limited() {
+		limited, finish := opts.limit(decompressed, compressed)
+		err = a.unpackStream(limited, raw)
+		if limitErr := finish(); limitErr != nil {
+			if _, ok := limitErr.(*LimitError); ok || err == nil {
+				err = limitErr
+			}
+		}
+	} else {
+		err = a.unpackStream(decompressed, raw)
+	}
+
+	if err == nil && opts.ExpectedDigest != "" && a.Digest() != opts.ExpectedDigest {
+		err = &DigestMismatchError{Expected: opts.ExpectedDigest, Computed: a.Digest()}
+	}
+
+	switch err.(type) {
+	case *LimitError, *DigestMismatchError:
+		a.discard()
+	}
+
+	return err
+}
+
+// discard removes what was unpacked into the asset.
+func (a *Asset) discard() {
+	if a.virtual {
+		a.fs.Remove(a.path)
+		a.removeIndex()
+	} else {
+		clearDir(a.path)
+		a.removeTarSplit()
+	}
+}
+
+func (a *Asset) unpackStream(decompressed, raw io.Reader) error {
+	tee := io.TeeReader(decompressed, io.MultiWriter(a.digest.Hash(), a.size))
+
+	if err := a.unpack(tee); err != nil {
+		return err
+	}
+
+	// whatever the unpacker left unread (such as the end-of-archive padding)
+	// must still count towards the digests.
+	if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(ioutil.Discard, raw)
+	return err
+}
+
+func (a *Asset) unpack(tee io.Reader) error {
 
 	if a.virtual {
 		if err := a.checkVirtualSymlink(); err != nil {
 			return err
 		}
 
-		f, err := os.Create(a.path)
+		f, err := a.fs.Create(a.path)
 		if err != nil {
 			return err
 		}
 
 		defer f.Close()
 
-		if _, err := io.Copy(f, tee); err != nil {
+		index, finish := a.recordIndex()
+
+		if _, err := io.Copy(io.MultiWriter(f, index), tee); err != nil {
+			finish()
+			a.removeIndex()
+			return err
+		}
+
+		if err := finish(); err != nil {
 			return err
 		}
 	} else {
-		if err := checkDir(a.path, ErrInvalidAsset); err != nil {
+		if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
 			return err
 		}
 
-		// FIXME there's probably a double-unarchive bug here.
-		err := archive.Unpack(tee, a.path, &archive.TarOptions{NoLchown: os.Geteuid() != 0})
+		// the original tar can only be rebuilt if it is the only thing that
+		// was unpacked here.
+		empty, err := isEmptyDir(a.path)
 		if err != nil {
 			return err
 		}
+
+		if !empty {
+			if err := a.removeTarSplit(); err != nil {
+				return err
+			}
+
+			// FIXME there's probably a double-unarchive bug here.
+			_, err := a.unpackTar(tee)
+			return err
+		}
+
+		its, finish, err := a.recordTarSplit(tee)
+		if err != nil {
+			return err
+		}
+
+		maps, err := a.unpackTar(its)
+		if err != nil {
+			finish()
+			a.removeTarSplit()
+			return err
+		}
+
+		if err := finish(); err != nil {
+			return err
+		}
+
+		if len(maps) > 0 {
+			if err := a.saveSparseMaps(maps); err != nil {
+				a.removeTarSplit()
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -132,15 +326,65 @@ func (a *Asset) Unpack(reader io.Reader) error {
 
 // Pack a tarball from the filesystem. Accepts an io.Writer, not a
 // *tar.Writer!
+//
+// If an expanded asset was populated by a single Unpack, the tar-split
+// metadata recorded then is used to rebuild the original tar byte for byte,
+// so the digest is the same as the one computed by Unpack, sparse files
+// included. That is not possible once files were added, removed or changed in
+// size, permissions or modification time since.
+//
+// Otherwise, expanded assets are packed with all of their extended
+// attributes: file capabilities (security.capability), user.* attributes,
+// POSIX ACLs and SELinux labels all survive an Unpack and Pack, as far as the
+// filesystem and privileges allowed Unpack to set them. Overlay's private
+// trusted.overlay.* attributes, and the user.overlay.* ones of mounts with
+// userxattr, are never packed; dirs they mark as opaque get a .wh..wh..opq
+// entry instead. Files with the metacopy or redirect attributes, whose
+// contents are in lower layers, make Pack fail with ErrInvalidLayer. Files
+// with holes are packed as sparse files, in the PAX 1.0 format of GNU tar.
 func (a *Asset) Pack(writer io.Writer) error {
+	return a.PackWithOptions(writer, nil)
+}
+
+// PackWithOptions packs a tarball from the filesystem, like Pack, as
+// controlled by opts. See PackOptions for more information.
+func (a *Asset) PackWithOptions(writer io.Writer, opts *PackOptions) error {
+	if opts == nil {
+		opts = &PackOptions{}
+	}
+
 	a.resetDigest()
+	a.compression = opts.Compression
+
+	cw, err := compressStream(io.MultiWriter(writer, a.compressedDigest.Hash()), opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := a.pack(io.MultiWriter(cw, a.size), opts); err != nil {
+		cw.Close()
+		return err
+	}
+
+	return cw.Close()
+}
+
+func (a *Asset) pack(writer io.Writer, opts *PackOptions) error {
+	filter, err := newPackFilter(opts)
+	if err != nil {
+		return err
+	}
 
 	if a.virtual {
 		if err := a.checkVirtualSymlink(); err != nil {
 			return err
 		}
 
-		f, err := os.Open(a.path)
+		if filter != nil {
+			return a.packFiltered(io.MultiWriter(writer, a.digest.Hash()), filter)
+		}
+
+		f, err := a.fs.Open(a.path)
 		if err != nil {
 			return err
 		}
@@ -149,14 +393,25 @@ func (a *Asset) Pack(writer io.Writer) error {
 			return err
 		}
 	} else {
-		if err := checkDir(a.path, ErrInvalidAsset); err != nil {
+		if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
 			return err
 		}
 
-		reader, err := archive.TarWithOptions(a.path, &archive.TarOptions{})
+		if opts.Reproducible {
+			return a.packReproducible(io.MultiWriter(writer, a.digest.Hash()), opts)
+		}
+
+		if filter == nil {
+			if ok, err := a.packTarSplit(io.MultiWriter(writer, a.digest.Hash())); ok || err != nil {
+				return err
+			}
+		}
+
+		reader, err := a.tarStream(filter)
 		if err != nil {
 			return err
 		}
+		defer reader.Close()
 
 		if _, err := io.Copy(writer, io.TeeReader(reader, a.digest.Hash())); err != nil {
 			return err
@@ -169,5 +424,18 @@ func (a *Asset) Pack(writer io.Writer) error {
 // resetDigest resets the digester so it can re-calculate e.g. in a scenario
 // where more than one read/write (or swapping between the two) is called.
 func (a *Asset) resetDigest() {
-	a.digest = digest.SHA256.Digester()
+	a.digest = a.algorithm.Digester()
+	a.compressedDigest = a.algorithm.Digester()
+	a.compression = Uncompressed
+	a.size = &countWriter{}
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
 }
@@ -1,9 +1,12 @@
 package overmount
 
 import (
+	"archive/tar"
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/docker/docker/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
@@ -134,3 +137,30 @@ func (m *mountSuite) TestAssetVirtual(c *C) {
 	c.Assert(errors.Cause(asset.Unpack(reader)), Equals, ErrInvalidAsset)
 	c.Assert(errors.Cause(asset.Pack(ioutil.Discard)), Equals, ErrInvalidAsset)
 }
+
+func (m *mountSuite) TestAssetExpectedDigest(c *C) {
+	tarball := makeTar(c, []tarEntry{{name: "file", content: "content", typeflag: tar.TypeReg}}).Bytes()
+	expected := digest.FromBytes(tarball)
+	corrupted := digest.FromString("corrupted")
+
+	_, err := m.Repository.CreateLayerFromAssetWithOptions(bytes.NewReader(tarball), nil, false, &UnpackOptions{ExpectedDigest: corrupted})
+	c.Assert(errors.Cause(err), Equals, ErrDigestMismatch)
+	mismatch, ok := err.(*DigestMismatchError)
+	c.Assert(ok, Equals, true)
+	c.Assert(mismatch.Expected, Equals, corrupted)
+	c.Assert(mismatch.Computed, Equals, expected)
+
+	// neither a layer nor the temp dir are left behind.
+	for _, dir := range []string{layerBase, tmpdirBase} {
+		fis, err := ioutil.ReadDir(filepath.Join(m.Repository.baseDir, dir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(fis, HasLen, 0, Commentf("%v", dir))
+	}
+
+	layer, err := m.Repository.CreateLayerFromAssetWithOptions(bytes.NewReader(tarball), nil, false, &UnpackOptions{ExpectedDigest: expected})
+	c.Assert(err, IsNil)
+	c.Assert(layer.ID(), Equals, expected.Hex())
+}
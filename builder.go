@@ -0,0 +1,435 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Metadata is the metadata of an entry added to a LayerBuilder. Owners are
+// always numeric. A zero ModTime is written as the unix epoch, so layers built
+// from the same calls always have the same digest.
+type Metadata struct {
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	ModTime time.Time
+	Xattrs  map[string]string
+}
+
+// LayerBuilder assembles a layer in code. Entries are written to the tar in
+// sorted order with fixed metadata, so the resulting tar (and the layer ID
+// derived from it) is deterministic. Adding an entry with the same name as an
+// earlier one replaces it.
+type LayerBuilder struct {
+	repository *Repository
+	parent     *Layer
+	entries    map[string]*builderEntry
+	whiteouts  map[string]struct{}
+	opaque     map[string]struct{}
+}
+
+type builderEntry struct {
+	header *tar.Header
+	open   func() (io.ReadCloser, error)
+}
+
+// NewLayerBuilder creates a *LayerBuilder for a layer on top of parent, which
+// may be nil.
+func (r *Repository) NewLayerBuilder(parent *Layer) *LayerBuilder {
+	return &LayerBuilder{
+		repository: r,
+		parent:     parent,
+		entries:    map[string]*builderEntry{},
+		whiteouts:  map[string]struct{}{},
+		opaque:     map[string]struct{}{},
+	}
+}
+
+func builderName(name string) (string, error) {
+	p := path.Clean("/" + name)
+	if p == "/" || strings.HasPrefix(path.Base(p), archive.WhiteoutPrefix) {
+		return "", errors.Wrapf(ErrInvalidAsset, "invalid path %q", name)
+	}
+
+	return p[1:], nil
+}
+
+func (b *LayerBuilder) add(name string, typeflag byte, meta Metadata, open func() (io.ReadCloser, error), size int64) (*tar.Header, error) {
+	p, err := builderName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime := meta.ModTime
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+
+	header := &tar.Header{
+		Name:     p,
+		Typeflag: typeflag,
+		Mode:     int64(meta.Mode.Perm()),
+		Uid:      meta.UID,
+		Gid:      meta.GID,
+		ModTime:  modTime.UTC().Truncate(time.Second),
+		Size:     size,
+		Xattrs:   meta.Xattrs,
+	}
+
+	if meta.Mode&os.ModeSetuid != 0 {
+		header.Mode |= unix.S_ISUID
+	}
+	if meta.Mode&os.ModeSetgid != 0 {
+		header.Mode |= unix.S_ISGID
+	}
+	if meta.Mode&os.ModeSticky != 0 {
+		header.Mode |= unix.S_ISVTX
+	}
+
+	if typeflag == tar.TypeDir {
+		header.Name += "/"
+	}
+
+	if typeflag != tar.TypeDir {
+		for name := range b.entries {
+			if strings.HasPrefix(name, p+"/") {
+				delete(b.entries, name)
+			}
+		}
+	}
+
+	// re-adding something that was deleted: a file simply replaces whatever
+	// was below, but a directory must hide the lower contents.
+	if _, ok := b.whiteouts[p]; ok {
+		delete(b.whiteouts, p)
+		if typeflag == tar.TypeDir {
+			b.opaque[p] = struct{}{}
+		}
+	}
+
+	b.entries[p] = &builderEntry{header: header, open: open}
+	return header, nil
+}
+
+// AddFile adds a regular file with the provided content.
+func (b *LayerBuilder) AddFile(name string, content []byte, meta Metadata) error {
+	_, err := b.add(name, tar.TypeReg, meta, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}, int64(len(content)))
+	return err
+}
+
+// AddDir adds a directory.
+func (b *LayerBuilder) AddDir(name string, meta Metadata) error {
+	_, err := b.add(name, tar.TypeDir, meta, nil, 0)
+	return err
+}
+
+// AddSymlink adds a symbolic link pointing at target.
+func (b *LayerBuilder) AddSymlink(name, target string, meta Metadata) error {
+	header, err := b.add(name, tar.TypeSymlink, meta, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	header.Linkname = target
+	return nil
+}
+
+// AddHardlink adds a hard link to target, which must be a regular file added
+// to this builder by the time the layer is written.
+func (b *LayerBuilder) AddHardlink(name, target string, meta Metadata) error {
+	linkname, err := builderName(target)
+	if err != nil {
+		return err
+	}
+
+	header, err := b.add(name, tar.TypeLink, meta, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	header.Linkname = linkname
+	return nil
+}
+
+// AddCharDevice adds a character device node.
+func (b *LayerBuilder) AddCharDevice(name string, major, minor int64, meta Metadata) error {
+	header, err := b.add(name, tar.TypeChar, meta, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	header.Devmajor, header.Devminor = major, minor
+	return nil
+}
+
+// AddBlockDevice adds a block device node.
+func (b *LayerBuilder) AddBlockDevice(name string, major, minor int64, meta Metadata) error {
+	header, err := b.add(name, tar.TypeBlock, meta, nil, 0)
+	if err != nil {
+		return err
+	}
+
+	header.Devmajor, header.Devminor = major, minor
+	return nil
+}
+
+// AddFifo adds a named pipe.
+func (b *LayerBuilder) AddFifo(name string, meta Metadata) error {
+	_, err := b.add(name, tar.TypeFifo, meta, nil, 0)
+	return err
+}
+
+// Delete removes name (and anything below it) from the lower layers by
+// writing a whiteout. Any entry of the same name added to this builder is
+// dropped.
+func (b *LayerBuilder) Delete(name string) error {
+	p, err := builderName(name)
+	if err != nil {
+		return err
+	}
+
+	for entry := range b.entries {
+		if entry == p || strings.HasPrefix(entry, p+"/") {
+			delete(b.entries, entry)
+		}
+	}
+
+	delete(b.opaque, p)
+	b.whiteouts[p] = struct{}{}
+	return nil
+}
+
+// Opaque hides the contents of the directory name in the lower layers. Only
+// entries added to this builder will be visible below it.
+func (b *LayerBuilder) Opaque(name string) error {
+	p, err := builderName(name)
+	if err != nil {
+		return err
+	}
+
+	b.opaque[p] = struct{}{}
+	return nil
+}
+
+// Pack writes the layer as a tar to writer.
+func (b *LayerBuilder) Pack(writer io.Writer) error {
+	markers := map[string]struct{}{}
+	names := []string{}
+
+	for name, entry := range b.entries {
+		if entry.header.Typeflag == tar.TypeLink {
+			target, ok := b.entries[entry.header.Linkname]
+			if !ok || target.header.Typeflag != tar.TypeReg {
+				return errors.Wrapf(ErrInvalidAsset, "hard link %q points at missing file %q", name, entry.header.Linkname)
+			}
+		}
+		names = append(names, name)
+	}
+
+	for name := range b.whiteouts {
+		marker := path.Join(path.Dir(name), archive.WhiteoutPrefix+path.Base(name))
+		markers[marker] = struct{}{}
+		names = append(names, marker)
+	}
+
+	for name := range b.opaque {
+		marker := path.Join(name, archive.WhiteoutOpaqueDir)
+		markers[marker] = struct{}{}
+		names = append(names, marker)
+	}
+
+	sort.Strings(names)
+
+	tw := tar.NewWriter(writer)
+
+	for _, name := range names {
+		if _, ok := markers[name]; ok {
+			err := tw.WriteHeader(&tar.Header{
+				Name:     name,
+				Mode:     0600,
+				Typeflag: tar.TypeReg,
+				ModTime:  time.Unix(0, 0),
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry := b.entries[name]
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return err
+		}
+
+		if entry.open == nil {
+			continue
+		}
+
+		if err := copyEntry(tw, entry); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func copyEntry(tw *tar.Writer, entry *builderEntry) error {
+	rc, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(tw, rc)
+	if err != nil {
+		return err
+	}
+
+	if n != entry.header.Size {
+		return errors.Wrapf(ErrInvalidAsset, "%q changed size while being written", entry.header.Name)
+	}
+
+	return nil
+}
+
+// Build writes the layer to the repository. The ID is calculated from the
+// digest, as with CreateLayerFromAsset.
+func (b *LayerBuilder) Build() (*Layer, error) {
+	tf, err := b.repository.tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tf.Close()
+		b.repository.fs.Remove(tf.Name())
+	}()
+
+	if err := b.Pack(tf); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	return b.repository.CreateLayerFromAsset(tf, b.parent, true)
+}
+
+// CreateLayerFromFS creates a layer from the contents of fsys. Ownership,
+// device numbers and hard links are carried over when fsys provides
+// *syscall.Stat_t or *tar.Header values from Sys(). Whiteouts in fsys, in
+// either the aufs or overlay format, are carried over as deletions, so the
+// upper directory of a mount can be turned into a layer. Opaque directories
+// are only carried over in the aufs format, as .wh..wh..opq entries: fs.FS
+// gives no access to the overlay.opaque attribute that marks them in upper
+// directories; add those with AddFS and Opaque on a LayerBuilder instead.
+func (r *Repository) CreateLayerFromFS(fsys fs.FS, parent *Layer) (*Layer, error) {
+	b := r.NewLayerBuilder(parent)
+
+	if err := b.AddFS(fsys); err != nil {
+		return nil, err
+	}
+
+	return b.Build()
+}
+
+// AddFS adds the contents of fsys to the builder. See CreateLayerFromFS.
+func (b *LayerBuilder) AddFS(fsys fs.FS) error {
+	inodes := map[[2]uint64]string{}
+
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == "." {
+			return nil
+		}
+
+		base := path.Base(name)
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			return b.Opaque(path.Dir(name))
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			return nil
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			return b.Delete(path.Join(path.Dir(name), strings.TrimPrefix(base, archive.WhiteoutPrefix)))
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if isWhiteoutInfo(fi) {
+			return b.Delete(name)
+		}
+
+		meta := Metadata{Mode: fi.Mode(), ModTime: fi.ModTime()}
+
+		var (
+			major, minor int64
+			inode        [2]uint64
+			nlink        uint64
+		)
+
+		switch sys := fi.Sys().(type) {
+		case *syscall.Stat_t:
+			meta.UID, meta.GID = int(sys.Uid), int(sys.Gid)
+			major, minor = int64(unix.Major(uint64(sys.Rdev))), int64(unix.Minor(uint64(sys.Rdev)))
+			inode = [2]uint64{uint64(sys.Dev), uint64(sys.Ino)}
+			nlink = uint64(sys.Nlink)
+		case *tar.Header:
+			meta.UID, meta.GID = sys.Uid, sys.Gid
+			meta.Xattrs = sys.Xattrs
+			major, minor = sys.Devmajor, sys.Devminor
+		}
+
+		switch {
+		case fi.IsDir():
+			return b.AddDir(name, meta)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := fs.ReadLink(fsys, name)
+			if err != nil {
+				return err
+			}
+			return b.AddSymlink(name, target, meta)
+		case fi.Mode()&fs.ModeCharDevice != 0:
+			return b.AddCharDevice(name, major, minor, meta)
+		case fi.Mode()&fs.ModeDevice != 0:
+			return b.AddBlockDevice(name, major, minor, meta)
+		case fi.Mode()&fs.ModeNamedPipe != 0:
+			return b.AddFifo(name, meta)
+		case fi.Mode().IsRegular():
+			if nlink > 1 {
+				if target, ok := inodes[inode]; ok {
+					return b.AddHardlink(name, target, meta)
+				}
+				inodes[inode] = name
+			}
+
+			_, err := b.add(name, tar.TypeReg, meta, func() (io.ReadCloser, error) {
+				return fsys.Open(name)
+			}, fi.Size())
+			return err
+		}
+
+		// sockets and anything else cannot be represented in a tar.
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestLayerBuilder(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "cache/", typeflag: tar.TypeDir},
+		{name: "cache/old", content: "old", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	build := func() *LayerBuilder {
+		b := m.Repository.NewLayerBuilder(base)
+		meta := Metadata{Mode: 0644, UID: 1000, GID: 1000, ModTime: time.Unix(1500000000, 0)}
+		c.Assert(b.AddDir("etc", Metadata{Mode: 0755}), IsNil)
+		c.Assert(b.AddFile("etc/app.conf", []byte("key=value"), meta), IsNil)
+		c.Assert(b.AddHardlink("etc/app.conf.link", "etc/app.conf", meta), IsNil)
+		c.Assert(b.AddSymlink("etc/current", "app.conf", meta), IsNil)
+		c.Assert(b.AddFifo("etc/pipe", meta), IsNil)
+		c.Assert(b.AddCharDevice("etc/null", 1, 3, Metadata{Mode: 0666}), IsNil)
+		c.Assert(b.AddFile("etc/replaced", []byte("first"), meta), IsNil)
+		c.Assert(b.AddFile("etc/replaced", []byte("second"), meta), IsNil)
+		c.Assert(b.AddFile("etc/gone", []byte("gone"), meta), IsNil)
+		c.Assert(b.Delete("etc/gone"), IsNil)
+		c.Assert(b.Delete("etc/motd"), IsNil)
+		c.Assert(b.AddDir("cache", Metadata{Mode: 0755}), IsNil)
+		c.Assert(b.Opaque("cache"), IsNil)
+		c.Assert(b.AddFile("cache/new", []byte("new"), meta), IsNil)
+		return b
+	}
+
+	layer, err := build().Build()
+	c.Assert(err, IsNil)
+	c.Assert(layer.Parent, Equals, base)
+
+	layer2, err := build().Build()
+	c.Assert(err, IsNil)
+	c.Assert(layer2.ID(), Equals, layer.ID())
+
+	files := readLayer(c, layer)
+	c.Assert(files["etc/app.conf"], Equals, "key=value")
+	c.Assert(files["etc/replaced"], Equals, "second")
+	c.Assert(files["etc/current"], Equals, string(tar.TypeSymlink))
+	c.Assert(files["etc/.wh.motd"], Equals, "")
+	c.Assert(files["etc/.wh.gone"], Equals, "")
+	c.Assert(files["cache/.wh..wh..opq"], Equals, "")
+	c.Assert(files["cache/new"], Equals, "new")
+	_, ok := files["etc/gone"]
+	c.Assert(ok, Equals, false)
+
+	content, err := readImageFile(m.Repository.NewImage(layer), "etc/current")
+	c.Assert(err, IsNil)
+	c.Assert(content, Equals, "key=value")
+
+	b := m.Repository.NewLayerBuilder(nil)
+	c.Assert(errors.Cause(b.AddFile("/", nil, Metadata{})), Equals, ErrInvalidAsset)
+	c.Assert(errors.Cause(b.AddFile(".wh.foo", nil, Metadata{})), Equals, ErrInvalidAsset)
+	c.Assert(b.AddHardlink("link", "missing", Metadata{}), IsNil)
+	_, err = b.Build()
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+}
+
+func (m *mountSuite) TestCreateLayerFromFS(c *C) {
+	dir, err := ioutil.TempDir("", "overmount-fs-test-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	c.Assert(os.MkdirAll(filepath.Join(dir, "etc", "app"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc", "app", "config"), []byte("config"), 0600), IsNil)
+	c.Assert(os.Link(filepath.Join(dir, "etc", "app", "config"), filepath.Join(dir, "etc", "config")), IsNil)
+	c.Assert(os.Symlink("app/config", filepath.Join(dir, "etc", "link")), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "etc", ".wh.motd"), nil, 0600), IsNil)
+
+	layer, err := m.Repository.CreateLayerFromFS(os.DirFS(dir), nil)
+	c.Assert(err, IsNil)
+	layer2, err := m.Repository.CreateLayerFromFS(os.DirFS(dir), nil)
+	c.Assert(err, IsNil)
+	c.Assert(layer2.ID(), Equals, layer.ID())
+
+	files := readLayer(c, layer)
+	c.Assert(files["etc/app/config"], Equals, "config")
+	c.Assert(files["etc/link"], Equals, string(tar.TypeSymlink))
+	c.Assert(files["etc/.wh.motd"], Equals, "")
+
+	content, err := readImageFile(m.Repository.NewImage(layer), "etc/config")
+	c.Assert(err, IsNil)
+	c.Assert(content, Equals, "config")
+}
@@ -0,0 +1,275 @@
+package overmount
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Clone duplicates the layer as a new layer with ID newID and parent parent,
+// which may be nil. The contents, config, history and other metadata are all
+// copied, so the clone can be changed, for example by mounting it as the
+// upper layer of an image, while the original keeps the contents its ID was
+// calculated from.
+//
+// Files are cloned with reflinks where the filesystem supports them, so they
+// share extents until written to; everything else is copied. The clone is not
+// deduplicated (see SetDedupe): its files may be changed in place, which must
+// not change the file store or the layers linked to it.
+func (l *Layer) Clone(newID string, parent *Layer) (retLayer *Layer, retErr error) {
+	if _, err := l.repository.fs.Lstat(filepath.Join(l.repository.baseDir, layerBase, newID)); err == nil {
+		return nil, errors.Wrap(ErrLayerExists, newID)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	clone, err := l.repository.CreateLayer(newID, parent, false)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if retErr != nil {
+			clone.Remove()
+		}
+	}()
+
+	err = l.edit(func() error {
+		if err := l.cloneMetadata(clone); err != nil {
+			return err
+		}
+
+		if l.repository.IsVirtual() {
+			if err := l.asset.checkVirtualSymlink(); err != nil {
+				return err
+			}
+
+			fi, err := l.repository.fs.Lstat(l.Path())
+			if err != nil {
+				if os.IsNotExist(err) {
+					return errors.Wrap(ErrInvalidLayer, "layer has no tar")
+				}
+				return err
+			}
+
+			if l.repository.IsMemory() {
+				return copyContent(l.repository.fs, l.Path(), clone.Path(), fi.Mode())
+			}
+
+			if err := cloneFile(l.Path(), clone.Path()); err != nil {
+				return err
+			}
+
+			return os.Chmod(clone.Path(), fi.Mode())
+		}
+
+		if err := checkDir(l.repository.fs, l.Path(), ErrInvalidLayer); err != nil {
+			return err
+		}
+
+		return cloneTree(l.Path(), clone.Path())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// config steps taken on top of the layer follow the clone instead.
+	if config, err := clone.Config(); err == nil {
+		config.moveSteps(map[string]bool{l.ID(): true}, clone.ID())
+		if err := clone.SaveConfig(config); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return clone, clone.SaveParent()
+}
+
+// cloneMetadata copies everything stored with the layer, except for the
+// contents, the parent and the lockfile, to clone. The tar-split and sparse
+// maps of an expanded layer are left out too: the clone's files may change,
+// and the tar they describe would be packed regardless.
+func (l *Layer) cloneMetadata(clone *Layer) error {
+	infos, err := l.repository.fs.ReadDir(l.layerBase())
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		name := fi.Name()
+		switch name {
+		case filepath.Base(l.Path()), parentPath, lockFilePath:
+			continue
+		case filepath.Base(l.Path()) + tarSplitSuffix, filepath.Base(l.Path()) + sparseSuffix:
+			if !l.repository.IsVirtual() {
+				continue
+			}
+		}
+
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if err := copyContent(l.repository.fs, filepath.Join(l.layerBase(), name), filepath.Join(clone.layerBase(), name), fi.Mode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cloneTree recreates the tree at source under target, which must not exist,
+// keeping hardlinks within the tree. Files hardlinked to the file store get
+// copies of their own.
+func cloneTree(source, target string) error {
+	inodes := map[uint64]string{}
+	dirs := []string{}
+
+	err := filepath.Walk(source, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(target, rel)
+
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return errors.Wrapf(ErrInvalidLayer, "cannot stat %q", p)
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(dest, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, p)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, dest); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			if stat.Nlink > 1 {
+				if first, ok := inodes[stat.Ino]; ok {
+					return os.Link(first, dest)
+				}
+				inodes[stat.Ino] = dest
+			}
+
+			if err := cloneFile(p, dest); err != nil {
+				return err
+			}
+		default:
+			if err := unix.Mknod(dest, stat.Mode, int(stat.Rdev)); err != nil {
+				return errors.Wrapf(ErrInvalidLayer, "cannot create %q: %v", dest, err)
+			}
+		}
+
+		return cloneAttrs(p, dest, fi, stat)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory times are restored last, as creating their entries changed
+	// them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(dirs[i])
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if err := os.Chtimes(filepath.Join(target, rel), fi.ModTime(), fi.ModTime()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cloneAttrs copies the extended attributes, owners, mode and modification
+// time of source, described by fi and stat, to target.
+func cloneAttrs(source, target string, fi os.FileInfo, stat *syscall.Stat_t) error {
+	attrs, err := llistxattr(source)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		value, err := lgetxattr(source, attr)
+		if err != nil {
+			return err
+		}
+
+		if err := unix.Lsetxattr(target, attr, value, 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+			return err
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		times := []unix.Timespec{unix.NsecToTimespec(fi.ModTime().UnixNano()), unix.NsecToTimespec(fi.ModTime().UnixNano())}
+		return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+	}
+
+	// chmod after chown, which clears the setuid and setgid bits.
+	if err := unix.Chmod(target, stat.Mode&07777); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// cloneFile creates target as a reflink of source, or as a copy where the
+// filesystem does not support reflinks.
+func cloneFile(source, target string) error {
+	if ok, err := reflinkNew(source, target); ok || err != nil {
+		return err
+	}
+
+	return copyContent(osFS{}, source, target, 0600)
+}
+
+// copyContent creates target with the contents of source and the given mode.
+func copyContent(fs fileSystem, source, target string, mode os.FileMode) error {
+	src, err := fs.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
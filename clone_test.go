@@ -0,0 +1,119 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestClone(c *C) {
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/issue", linkname: "motd", typeflag: tar.TypeSymlink},
+		{name: "etc/motd.old", linkname: "etc/motd", typeflag: tar.TypeLink},
+	}
+
+	base, err := m.Repository.CreateLayer("base", nil, false)
+	c.Assert(err, IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), base, false)
+	c.Assert(err, IsNil)
+	c.Assert(layer.SaveConfig(&ImageConfig{Cmd: []string{"sh"}}), IsNil)
+	c.Assert(m.Repository.NewImage(layer).AddConfigStep(&LayerHistory{CreatedBy: "CMD sh"}), IsNil)
+
+	clone, err := layer.Clone("work", base)
+	c.Assert(err, IsNil)
+	c.Assert(clone.ID(), Equals, "work")
+	c.Assert(clone.Parent, Equals, base)
+
+	// config steps follow the clone.
+	config, err := clone.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Cmd, DeepEquals, []string{"sh"})
+	c.Assert(config.StepsAfter("work"), HasLen, 1)
+	c.Assert(config.StepsAfter(layer.ID()), HasLen, 0)
+
+	_, err = clone.History()
+	c.Assert(err, IsNil)
+
+	// the parent is read back from disk.
+	repo, err := NewRepository(m.Repository.baseDir, m.Repository.IsVirtual())
+	c.Assert(err, IsNil)
+	reread, err := repo.NewLayer("work", nil)
+	c.Assert(err, IsNil)
+	c.Assert(reread.RestoreParent(), IsNil)
+	c.Assert(reread.Parent.ID(), Equals, "base")
+
+	_, err = layer.Clone("work", nil)
+	c.Assert(errors.Cause(err), Equals, ErrLayerExists)
+
+	if m.Repository.IsVirtual() {
+		// a virtual clone packs to the same tar, byte for byte.
+		original, cloned := new(bytes.Buffer), new(bytes.Buffer)
+		_, err = layer.Pack(original)
+		c.Assert(err, IsNil)
+		dg, err := clone.Pack(cloned)
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, layer.ID())
+		c.Assert(cloned.Bytes(), DeepEquals, original.Bytes())
+		return
+	}
+
+	// an expanded clone is packed from its files, not the original tar.
+	c.Assert(readLayer(c, clone), DeepEquals, readLayer(c, layer))
+
+	fi, err := os.Lstat(filepath.Join(layer.Path(), "etc"))
+	c.Assert(err, IsNil)
+	clonedInfo, err := os.Lstat(filepath.Join(clone.Path(), "etc"))
+	c.Assert(err, IsNil)
+	c.Assert(clonedInfo.ModTime().Equal(fi.ModTime()), Equals, true)
+	c.Assert(clonedInfo.Mode(), Equals, fi.Mode())
+
+	// hardlinks within the layer are kept, but not shared with the original.
+	motd, err := os.Lstat(filepath.Join(clone.Path(), "etc/motd"))
+	c.Assert(err, IsNil)
+	old, err := os.Lstat(filepath.Join(clone.Path(), "etc/motd.old"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(motd, old), Equals, true)
+	c.Assert(m.sameFile(c, layer, clone, "etc/motd"), Equals, false)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(clone.Path(), "etc/motd"), []byte("changed"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(clone.Path(), "etc/hostname"), []byte("work"), 0644), IsNil)
+	c.Assert(readLayer(c, layer)["etc/motd"], Equals, "hello")
+
+	files := readLayer(c, clone)
+	c.Assert(files["etc/motd"], Equals, "changed")
+	c.Assert(files["etc/hostname"], Equals, "work")
+
+	dg, err := clone.LoadDigest()
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Not(Equals), layer.ID())
+
+	dg, err = layer.LoadDigest()
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, layer.ID())
+
+	// files in the store are not shared with clones, which may be changed in
+	// place.
+	m.Repository.SetDedupe(DedupeHardlink)
+	deduped, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries[:2]), nil, false)
+	c.Assert(err, IsNil)
+	dedupedClone, err := deduped.Clone("deduped-work", nil)
+	c.Assert(err, IsNil)
+	c.Assert(m.sameFile(c, deduped, dedupedClone, "etc/motd"), Equals, false)
+
+	f, err := os.OpenFile(filepath.Join(dedupedClone.Path(), "etc/motd"), os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	_, err = f.WriteAt([]byte("J"), 0)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	content, err := ioutil.ReadFile(filepath.Join(deduped.Path(), "etc/motd"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello")
+}
@@ -0,0 +1,238 @@
+package overmount
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// LayerMediaType is the OCI media type of an uncompressed layer tar.
+const LayerMediaType = "application/vnd.oci.image.layer.v1.tar"
+
+// Compression is a compression algorithm applied to a layer tar.
+type Compression int
+
+const (
+	// Uncompressed is a plain tar.
+	Uncompressed Compression = iota
+	// Gzip is a gzip-compressed tar.
+	Gzip
+	// Zstd is a zstd-compressed tar.
+	Zstd
+	// Xz is an xz-compressed tar.
+	Xz
+	// Bzip2 is a bzip2-compressed tar. It can only be unpacked.
+	Bzip2
+)
+
+var compressionMagic = map[Compression][]byte{
+	Gzip:  {0x1f, 0x8b},
+	Zstd:  {0x28, 0xb5, 0x2f, 0xfd},
+	Xz:    {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+	Bzip2: {0x42, 0x5a, 0x68},
+}
+
+// String returns the name of the compression, as used in media types.
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "uncompressed"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Xz:
+		return "xz"
+	case Bzip2:
+		return "bzip2"
+	}
+
+	return "unknown"
+}
+
+// MediaType returns the OCI media type of a layer tar with this compression.
+func (c Compression) MediaType() string {
+	if c == Uncompressed {
+		return LayerMediaType
+	}
+
+	return LayerMediaType + "+" + c.String()
+}
+
+// ParseCompression returns the Compression named name, as returned by String.
+// An empty name is the same as "uncompressed".
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return Uncompressed, nil
+	}
+
+	for _, compression := range []Compression{Uncompressed, Gzip, Zstd, Xz, Bzip2} {
+		if compression.String() == name {
+			return compression, nil
+		}
+	}
+
+	return Uncompressed, errors.Wrapf(ErrInvalidAsset, "unknown compression %q", name)
+}
+
+// DetectCompression returns the compression of a stream from its first few
+// bytes.
+func DetectCompression(header []byte) Compression {
+	for compression, magic := range compressionMagic {
+		if bytes.HasPrefix(header, magic) {
+			return compression
+		}
+	}
+
+	return Uncompressed
+}
+
+// decompressStream detects the compression of reader and returns a reader for
+// the uncompressed stream.
+func decompressStream(reader io.Reader) (io.ReadCloser, Compression, error) {
+	br := bufio.NewReader(reader)
+
+	// a short stream is not an error here; the tar reader will complain.
+	header, _ := br.Peek(6)
+	compression := DetectCompression(header)
+
+	switch compression {
+	case Gzip:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, compression, err
+		}
+		return gz, compression, nil
+	case Zstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, compression, err
+		}
+		return zr.IOReadCloser(), compression, nil
+	case Xz:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, compression, err
+		}
+		return ioutil.NopCloser(xr), compression, nil
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), compression, nil
+	}
+
+	return ioutil.NopCloser(br), compression, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressStream returns a writer that compresses into writer. It must be
+// closed to flush the compressed stream.
+func compressStream(writer io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case Uncompressed:
+		return nopWriteCloser{writer}, nil
+	case Gzip:
+		return gzip.NewWriter(writer), nil
+	case Zstd:
+		return zstd.NewWriter(writer)
+	case Xz:
+		return xz.NewWriter(writer)
+	}
+
+	return nil, errors.Wrapf(ErrInvalidAsset, "cannot compress with %v", compression)
+}
+
+const digestsPath = "digests.json"
+
+// layerDigests is what is stored with a layer about the tar it was unpacked
+// from, so layers loaded from the repository still know it.
+type layerDigests struct {
+	DiffID           digest.Digest `json:"diffID"`
+	CompressedDigest digest.Digest `json:"compressedDigest"`
+	Compression      string        `json:"compression"`
+}
+
+// recordedDigester is a digest.Digester for a digest that was computed
+// before, such as one stored with a layer. Whatever is written to its Hash is
+// discarded.
+type recordedDigester digest.Digest
+
+func (d recordedDigester) Hash() hash.Hash {
+	return digest.Digest(d).Algorithm().Hash()
+}
+
+func (d recordedDigester) Digest() digest.Digest {
+	return digest.Digest(d)
+}
+
+func (l *Layer) digestsPath() string {
+	return filepath.Join(l.layerBase(), digestsPath)
+}
+
+// saveDigests stores the digests and the compression of the tar the layer
+// was just unpacked from.
+func (l *Layer) saveDigests() error {
+	f, err := l.repository.fs.Create(l.digestsPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(layerDigests{
+		DiffID:           l.asset.Digest(),
+		CompressedDigest: l.asset.CompressedDigest(),
+		Compression:      l.asset.Compression().String(),
+	})
+}
+
+// loadDigests restores the digests and the compression stored by
+// saveDigests, if any, into the asset.
+func (l *Layer) loadDigests() error {
+	f, err := l.repository.fs.Open(l.digestsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var digests layerDigests
+	if err := json.NewDecoder(f).Decode(&digests); err != nil {
+		return errors.Wrapf(ErrInvalidLayer, "invalid digests: %v", err)
+	}
+
+	compression, err := ParseCompression(digests.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := digests.DiffID.Validate(); err != nil {
+		return errors.Wrapf(ErrInvalidLayer, "invalid diffID: %v", err)
+	}
+
+	if err := digests.CompressedDigest.Validate(); err != nil {
+		return errors.Wrapf(ErrInvalidLayer, "invalid compressed digest: %v", err)
+	}
+
+	l.asset.digest = recordedDigester(digests.DiffID)
+	l.asset.compressedDigest = recordedDigester(digests.CompressedDigest)
+	l.asset.compression = compression
+
+	return nil
+}
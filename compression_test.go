@@ -0,0 +1,86 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestCompression(c *C) {
+	original := makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+	}).Bytes()
+
+	for _, compression := range []Compression{Uncompressed, Gzip, Zstd, Xz} {
+		compressed := new(bytes.Buffer)
+		cw, err := compressStream(compressed, compression)
+		c.Assert(err, IsNil)
+		_, err = cw.Write(original)
+		c.Assert(err, IsNil)
+		c.Assert(cw.Close(), IsNil)
+
+		c.Assert(DetectCompression(compressed.Bytes()), Equals, compression)
+
+		layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(compressed.Bytes()), nil, true)
+		c.Assert(err, IsNil, Commentf("%v", compression))
+		c.Assert(layer.ID(), Equals, digest.FromBytes(original).Hex(), Commentf("%v", compression))
+		c.Assert(layer.Compression(), Equals, compression)
+		c.Assert(layer.CompressedDigest(), Equals, digest.FromBytes(compressed.Bytes()))
+
+		// the digests are stored with the layer.
+		repo, err := NewRepository(m.Repository.baseDir, m.Repository.IsVirtual())
+		c.Assert(err, IsNil)
+		loaded, err := repo.NewLayer(layer.ID(), nil)
+		c.Assert(err, IsNil)
+		c.Assert(loaded.Digest().Hex(), Equals, layer.ID())
+		c.Assert(loaded.Compression(), Equals, compression)
+		c.Assert(loaded.CompressedDigest(), Equals, digest.FromBytes(compressed.Bytes()))
+
+		c.Assert(readLayer(c, layer)["etc/motd"], Equals, "hello")
+
+		// the stored layer is always uncompressed.
+		packed := new(bytes.Buffer)
+		dg, err := layer.Pack(packed)
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, layer.ID())
+		c.Assert(bytes.Equal(packed.Bytes(), original), Equals, true)
+		c.Assert(layer.CompressedDigest(), Equals, dg)
+
+		packed.Reset()
+		dg, err = layer.PackWithOptions(packed, &PackOptions{Compression: compression})
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, layer.ID())
+		c.Assert(layer.CompressedDigest(), Equals, digest.FromBytes(packed.Bytes()))
+		c.Assert(DetectCompression(packed.Bytes()), Equals, compression)
+
+		reader, detected, err := decompressStream(packed)
+		c.Assert(err, IsNil)
+		c.Assert(detected, Equals, compression)
+		content, err := ioutil.ReadAll(reader)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(content, original), Equals, true)
+
+		c.Assert(layer.Remove(), IsNil)
+	}
+
+	c.Assert(DetectCompression([]byte("BZh91AY&SY")), Equals, Bzip2)
+	layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(original), nil, true)
+	c.Assert(err, IsNil)
+	_, err = layer.PackWithOptions(ioutil.Discard, &PackOptions{Compression: Bzip2})
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+	for _, name := range []string{"", "uncompressed", "gzip", "zstd", "xz", "bzip2"} {
+		compression, err := ParseCompression(name)
+		c.Assert(err, IsNil)
+		if name != "" {
+			c.Assert(compression.String(), Equals, name)
+		}
+	}
+	_, err = ParseCompression("lz4")
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+}
@@ -67,4 +67,7 @@ type ImageConfig struct {
 
 	// StopSignal contains the system call signal that will be sent to the container to exit.
 	StopSignal string `json:"stopsignal,omitempty"`
+
+	// ConfigSteps are the metadata-only steps of the image's history, in order.
+	ConfigSteps []ConfigStep `json:"config_steps,omitempty"`
 }
@@ -0,0 +1,444 @@
+package overmount
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const filesBase = "files"
+
+// DedupeMode controls how identical files in expanded layers share storage.
+type DedupeMode int
+
+const (
+	// DedupeNone stores a full copy of every file in every layer.
+	DedupeNone DedupeMode = iota
+	// DedupeHardlink hardlinks identical regular files to a single copy in
+	// the repository's file store. Files are only considered identical if
+	// their content, permissions, owners, modification time and extended
+	// attributes all match, as hardlinks share all of these.
+	DedupeHardlink
+	// DedupeReflink clones identical regular files from the file store with
+	// FICLONE, so they share extents on disk but remain separate files. Where
+	// the filesystem does not support reflinks, files are hardlinked instead.
+	DedupeReflink
+)
+
+// SetDedupe sets how files unpacked into expanded layers from now on are
+// deduplicated. The default is DedupeNone. It has no effect on virtual
+// repositories. Use Dedupe to process layers that already exist.
+func (r *Repository) SetDedupe(mode DedupeMode) {
+	r.dedupe = mode
+}
+
+// Dedupe deduplicates all existing expanded layers in the repository with
+// the mode set by SetDedupe (or DedupeHardlink, if it is DedupeNone). With
+// DedupeHardlink, files in the store that are no longer used by any layer are
+// removed first. Reflinked files do not count their clones, so with
+// DedupeReflink the store is kept as it is.
+func (r *Repository) Dedupe() error {
+	if r.IsVirtual() {
+		return nil
+	}
+
+	mode := r.dedupe
+	if mode == DedupeNone {
+		mode = DedupeHardlink
+	}
+
+	return r.edit(func() error {
+		if mode == DedupeHardlink {
+			if err := r.pruneFiles(); err != nil {
+				return err
+			}
+		}
+
+		layers, err := ioutil.ReadDir(filepath.Join(r.baseDir, layerBase))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		for _, fi := range layers {
+			root := filepath.Join(r.baseDir, layerBase, fi.Name(), rootFSPath)
+			if _, err := os.Lstat(root); os.IsNotExist(err) {
+				continue
+			}
+
+			if err := r.dedupeTree(root, mode); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// dedupeLayer deduplicates a freshly unpacked layer, if the repository is
+// configured to do so.
+func (r *Repository) dedupeLayer(root string) error {
+	if r.IsVirtual() || r.dedupe == DedupeNone {
+		return nil
+	}
+
+	return r.edit(func() error { return r.dedupeTree(root, r.dedupe) })
+}
+
+func (r *Repository) filesPath() string {
+	return filepath.Join(r.baseDir, filesBase)
+}
+
+// pruneFiles removes the files in the store that nothing links to anymore.
+// Only hardlinks are counted: a file reflinked into layers has a single link,
+// but is still in use.
+func (r *Repository) pruneFiles() error {
+	files, err := ioutil.ReadDir(r.filesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range files {
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat.Nlink == 1 {
+			if err := os.Remove(filepath.Join(r.filesPath(), fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository) dedupeTree(root string, mode DedupeMode) error {
+	if err := os.MkdirAll(r.filesPath(), 0700); err != nil {
+		return err
+	}
+
+	// files are only shared across layers: identical files within a layer
+	// would otherwise be packed as hardlinks to each other.
+	seen := map[digest.Digest]struct{}{}
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !fi.Mode().IsRegular() || fi.Size() == 0 || !ok {
+			return nil
+		}
+
+		// files with other links are either already deduplicated or hardlinked
+		// within the layer; replacing them would break the latter.
+		if stat.Nlink > 1 {
+			stored, err := r.storedFile(p, fi, stat)
+			if err != nil {
+				return err
+			}
+
+			if stored != "" {
+				seen[digest.NewDigestFromHex(digest.SHA256.String(), filepath.Base(stored))] = struct{}{}
+			}
+
+			return nil
+		}
+
+		key, err := fileKey(p, fi, stat)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+
+		stored := filepath.Join(r.filesPath(), key.Hex())
+
+		if _, err := os.Lstat(stored); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+
+			if mode == DedupeReflink {
+				if ok, err := reflinkNew(p, stored); ok || err != nil {
+					return err
+				}
+			}
+
+			return os.Link(p, stored)
+		}
+
+		if mode == DedupeReflink {
+			if ok, err := reflink(stored, p, fi); ok || err != nil {
+				return err
+			}
+		}
+
+		return replaceWithLink(stored, p)
+	})
+}
+
+// fileKey digests everything a hardlink would share: the content and the
+// inode metadata.
+func fileKey(p string, fi os.FileInfo, stat *syscall.Stat_t) (digest.Digest, error) {
+	digester := digest.SHA256.Digester()
+	hash := digester.Hash()
+
+	fmt.Fprintf(hash, "%o %d %d %d\n", fi.Mode(), stat.Uid, stat.Gid, fi.ModTime().UnixNano())
+
+	attrs, err := llistxattr(p)
+	if err != nil {
+		return "", err
+	}
+
+	sort.Strings(attrs)
+
+	for _, attr := range attrs {
+		value, err := lgetxattr(p, attr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%q=%q\n", attr, value)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return digester.Digest(), nil
+}
+
+// replaceWithLink atomically replaces target with a hardlink to source.
+func replaceWithLink(source, target string) error {
+	tmp := target + ".dedupe"
+
+	return keepDirTimes(filepath.Dir(target), func() error {
+		if err := os.Link(source, tmp); err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp, target); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// keepDirTimes runs fn, which replaces entries in dir, and restores the
+// modification time of dir afterwards so the layer's metadata is unchanged.
+func keepDirTimes(dir string, fn func() error) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dir, fi.ModTime(), fi.ModTime())
+}
+
+// reflinkNew creates target as a clone of source. It returns false if the
+// filesystem does not support reflinks.
+func reflinkNew(source, target string) (bool, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	dst.Close()
+	if err != nil {
+		os.Remove(target)
+		return false, reflinkError(err)
+	}
+
+	return true, nil
+}
+
+// reflink replaces the content of target with a clone of source, which has
+// the same content, keeping the metadata of target. It returns false if the
+// filesystem does not support reflinks.
+func reflink(source, target string, fi os.FileInfo) (bool, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		// read-only files cannot be opened for writing by non-root users; they
+		// are simply left alone.
+		if os.IsPermission(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	err = unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	dst.Close()
+	if err != nil {
+		return false, reflinkError(err)
+	}
+
+	return true, os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// reflinkError returns nil for the errors FICLONE returns when reflinks are
+// not possible here, so the caller can fall back to hardlinks.
+func reflinkError(err error) error {
+	switch err {
+	case unix.EOPNOTSUPP, unix.ENOTTY, unix.EXDEV, unix.EINVAL:
+		return nil
+	}
+
+	return errors.Wrap(ErrInvalidAsset, err.Error())
+}
+
+// unshareTree gives every file under root that is hardlinked to the file
+// store its own copy, so that writing to it does not change other layers.
+func (r *Repository) unshareTree(root string) error {
+	if _, err := os.Lstat(r.filesPath()); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !fi.Mode().IsRegular() || !ok {
+			return nil
+		}
+
+		stored, err := r.storedFile(p, fi, stat)
+		if err != nil || stored == "" {
+			return err
+		}
+
+		return copyFile(p, fi, stat)
+	})
+}
+
+// storedFile returns the path of the file in the store that p is hardlinked
+// to, or "" if it is not.
+func (r *Repository) storedFile(p string, fi os.FileInfo, stat *syscall.Stat_t) (string, error) {
+	if stat.Nlink == 1 {
+		return "", nil
+	}
+
+	key, err := fileKey(p, fi, stat)
+	if err != nil {
+		return "", err
+	}
+
+	stored := filepath.Join(r.filesPath(), key.Hex())
+
+	storedInfo, err := os.Lstat(stored)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if !os.SameFile(fi, storedInfo) {
+		return "", nil
+	}
+
+	return stored, nil
+}
+
+// copyFile replaces p with a copy of itself that has its own inode.
+func copyFile(p string, fi os.FileInfo, stat *syscall.Stat_t) (retErr error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := p + ".unshare"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if retErr != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	attrs, err := llistxattr(p)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		value, err := lgetxattr(p, attr)
+		if err != nil {
+			return err
+		}
+
+		if err := unix.Lsetxattr(tmp, attr, value, 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+			return err
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(tmp, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+
+	// chmod after chown, which clears the setuid and setgid bits.
+	if err := os.Chmod(tmp, fi.Mode()); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+
+	return keepDirTimes(filepath.Dir(p), func() error { return os.Rename(tmp, p) })
+}
@@ -0,0 +1,142 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) sameFile(c *C, one, two *Layer, name string) bool {
+	fi1, err := os.Lstat(filepath.Join(one.Path(), name))
+	c.Assert(err, IsNil)
+	fi2, err := os.Lstat(filepath.Join(two.Path(), name))
+	c.Assert(err, IsNil)
+	return os.SameFile(fi1, fi2)
+}
+
+func (m *mountSuite) TestDedupe(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers hold tars")
+		return
+	}
+
+	makeLayer := func(parent *Layer, marker string) *Layer {
+		layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+			{name: "lib/", typeflag: tar.TypeDir},
+			{name: "lib/libc.so", content: "libc", typeflag: tar.TypeReg},
+			{name: "marker", content: marker, typeflag: tar.TypeReg},
+		}), parent, false)
+		c.Assert(err, IsNil)
+		return layer
+	}
+
+	// existing layers are only deduplicated by Dedupe.
+	one := makeLayer(nil, "one")
+	two := makeLayer(one, "two")
+	c.Assert(m.sameFile(c, one, two, "lib/libc.so"), Equals, false)
+
+	c.Assert(m.Repository.Dedupe(), IsNil)
+	c.Assert(m.sameFile(c, one, two, "lib/libc.so"), Equals, true)
+	c.Assert(m.sameFile(c, one, two, "marker"), Equals, false)
+
+	m.Repository.SetDedupe(DedupeHardlink)
+	three := makeLayer(two, "three")
+	c.Assert(m.sameFile(c, one, three, "lib/libc.so"), Equals, true)
+
+	// the digests are unaffected.
+	for _, layer := range []*Layer{one, two, three} {
+		dg, err := layer.LoadDigest()
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, layer.ID())
+	}
+
+	// files with different metadata cannot share an inode.
+	b := m.Repository.NewLayerBuilder(three)
+	c.Assert(b.AddFile("lib/libc.so", []byte("libc"), Metadata{Mode: 0600}), IsNil)
+	private, err := b.Build()
+	c.Assert(err, IsNil)
+	c.Assert(m.sameFile(c, three, private, "lib/libc.so"), Equals, false)
+
+	// the upper layer of a mount gets its own copies.
+	c.Assert(m.Repository.NewImage(three).Mount(), IsNil)
+	c.Assert(m.sameFile(c, two, three, "lib/libc.so"), Equals, false)
+	c.Assert(m.Repository.NewImage(three).Unmount(), IsNil)
+	c.Assert(readLayer(c, three)["lib/libc.so"], Equals, "libc")
+
+	// reflinks fall back to hardlinks where they are not supported; either
+	// way, the contents are the same.
+	m.Repository.SetDedupe(DedupeReflink)
+	four := makeLayer(three, "four")
+	c.Assert(readLayer(c, four)["lib/libc.so"], Equals, "libc")
+	dg, err := four.LoadDigest()
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, four.ID())
+
+	// reflinked files in the store have a single link, like unused ones, so
+	// they are only pruned in hardlink mode.
+	unused := filepath.Join(m.Repository.filesPath(), "unused")
+	c.Assert(ioutil.WriteFile(unused, []byte("unused"), 0600), IsNil)
+	c.Assert(m.Repository.Dedupe(), IsNil)
+	_, err = os.Lstat(unused)
+	c.Assert(err, IsNil)
+
+	m.Repository.SetDedupe(DedupeHardlink)
+	c.Assert(m.Repository.Dedupe(), IsNil)
+	_, err = os.Lstat(unused)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(readLayer(c, four)["lib/libc.so"], Equals, "libc")
+}
+
+func (m *mountSuite) TestDedupeDuplicates(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers hold tars")
+		return
+	}
+
+	entries := []tarEntry{
+		{name: "lib/", typeflag: tar.TypeDir},
+		{name: "lib/a", content: "same", typeflag: tar.TypeReg},
+		{name: "lib/b", content: "same", typeflag: tar.TypeReg},
+	}
+
+	one, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+
+	m.Repository.SetDedupe(DedupeHardlink)
+	two, err := m.Repository.CreateLayerFromAsset(makeTar(c, append(entries, tarEntry{name: "marker", content: "two", typeflag: tar.TypeReg})), one, false)
+	c.Assert(err, IsNil)
+	c.Assert(m.Repository.Dedupe(), IsNil)
+
+	// files are shared across layers, but not within one.
+	c.Assert(m.sameFile(c, one, two, "lib/a"), Equals, true)
+	c.Assert(m.sameFile(c, one, two, "lib/b"), Equals, false)
+
+	for _, layer := range []*Layer{one, two} {
+		fa, err := os.Lstat(filepath.Join(layer.Path(), "lib/a"))
+		c.Assert(err, IsNil)
+		fb, err := os.Lstat(filepath.Join(layer.Path(), "lib/b"))
+		c.Assert(err, IsNil)
+		c.Assert(os.SameFile(fa, fb), Equals, false)
+
+		c.Assert(layer.asset.removeTarSplit(), IsNil)
+
+		buf := new(bytes.Buffer)
+		_, err = layer.PackWithOptions(buf, &PackOptions{Reproducible: true})
+		c.Assert(err, IsNil)
+
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			c.Assert(header.Typeflag, Not(Equals), byte(tar.TypeLink), Commentf("%v", header.Name))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package overmount
+
+import (
+	// SHA-384 and SHA-512 are only available to go-digest when registered.
+	_ "crypto/sha512"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const algorithmPath = "algorithm"
+
+// supportedAlgorithms are the digest algorithms repositories can use.
+var supportedAlgorithms = []digest.Algorithm{digest.SHA256, digest.SHA384, digest.SHA512}
+
+// DigestAlgorithm returns the algorithm used for the digests, and thus the IDs,
+// of the layers in the repository. The default is SHA-256.
+func (r *Repository) DigestAlgorithm() digest.Algorithm {
+	return r.algorithm
+}
+
+// SetDigestAlgorithm sets the algorithm used for the digests of the layers in
+// the repository to SHA-256, SHA-384 or SHA-512. The choice is stored with the
+// repository, so it applies whenever it is opened again. As layer IDs are
+// digests, the algorithm cannot be changed once the repository holds layers;
+// ErrDigestAlgorithm is returned in that case.
+func (r *Repository) SetDigestAlgorithm(alg digest.Algorithm) error {
+	if err := checkAlgorithm(alg); err != nil {
+		return err
+	}
+
+	return r.edit(func() error {
+		if alg == r.algorithm {
+			return nil
+		}
+
+		layers, err := r.fs.ReadDir(filepath.Join(r.baseDir, layerBase))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if len(layers) != 0 {
+			return errors.Wrapf(ErrDigestAlgorithm, "repository already holds %v layers", r.algorithm)
+		}
+
+		if err := writeFile(r.fs, filepath.Join(r.baseDir, algorithmPath), []byte(alg.String()+"\n"), 0600); err != nil {
+			return err
+		}
+
+		r.algorithm = alg
+		return nil
+	})
+}
+
+// loadAlgorithm reads the digest algorithm stored with the repository, if any.
+func (r *Repository) loadAlgorithm() error {
+	content, err := readFile(r.fs, filepath.Join(r.baseDir, algorithmPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	alg := digest.Algorithm(strings.TrimSpace(string(content)))
+	if err := checkAlgorithm(alg); err != nil {
+		return err
+	}
+
+	r.algorithm = alg
+	return nil
+}
+
+func checkAlgorithm(alg digest.Algorithm) error {
+	for _, supported := range supportedAlgorithms {
+		if alg == supported && alg.Available() {
+			return nil
+		}
+	}
+
+	return errors.Wrapf(ErrDigestAlgorithm, "unsupported algorithm %q", alg)
+}
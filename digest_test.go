@@ -0,0 +1,65 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestDigestAlgorithm(c *C) {
+	c.Assert(m.Repository.DigestAlgorithm(), Equals, digest.SHA256)
+
+	tmpdir, err := ioutil.TempDir("", "overmount-digest-")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(tmpdir)
+
+	repo, err := NewRepository(tmpdir, m.Repository.IsVirtual())
+	c.Assert(err, IsNil)
+
+	c.Assert(errors.Cause(repo.SetDigestAlgorithm(digest.Algorithm("md5"))), Equals, ErrDigestAlgorithm)
+	c.Assert(repo.SetDigestAlgorithm(digest.SHA512), IsNil)
+
+	tarball := makeTar(c, []tarEntry{{name: "file", content: "content", typeflag: tar.TypeReg}}).Bytes()
+
+	layer, err := repo.CreateLayerFromAsset(bytes.NewReader(tarball), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(layer.ID(), Equals, digest.SHA512.FromBytes(tarball).Hex())
+	c.Assert(layer.Digest().Algorithm(), Equals, digest.SHA512)
+
+	dg, err := layer.LoadDigest()
+	c.Assert(err, IsNil)
+	c.Assert(dg, Equals, digest.SHA512.FromBytes(tarball))
+
+	// the algorithm is kept with the repository, and cannot change while it
+	// holds layers.
+	reopened, err := NewRepository(tmpdir, m.Repository.IsVirtual())
+	c.Assert(err, IsNil)
+	c.Assert(reopened.DigestAlgorithm(), Equals, digest.SHA512)
+	c.Assert(errors.Cause(reopened.SetDigestAlgorithm(digest.SHA256)), Equals, ErrDigestAlgorithm)
+	c.Assert(reopened.SetDigestAlgorithm(digest.SHA512), IsNil)
+
+	// algorithms cannot be mixed.
+	_, err = repo.CreateLayerFromAssetWithOptions(bytes.NewReader(tarball), nil, true, &UnpackOptions{ExpectedDigest: digest.FromBytes(tarball)})
+	c.Assert(errors.Cause(err), Equals, ErrDigestAlgorithm)
+
+	_, err = m.Repository.CreateLayerFromAsset(bytes.NewReader(tarball), layer, false)
+	c.Assert(errors.Cause(err), Equals, ErrDigestAlgorithm)
+
+	_, err = repo.CreateLayerFromAssetWithOptions(bytes.NewReader(tarball), nil, true, &UnpackOptions{ExpectedDigest: digest.SHA512.FromBytes(tarball)})
+	c.Assert(err, IsNil)
+
+	// rebased image configurations get IDs of the same algorithm.
+	child, err := repo.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "child", content: "child", typeflag: tar.TypeReg}}), layer, false)
+	c.Assert(err, IsNil)
+	c.Assert(child.SaveConfig(&ImageConfig{ID: "stale", Parent: layer.ID()}), IsNil)
+	c.Assert(repo.Rebase(child, layer, nil), IsNil)
+
+	config, err := child.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.ID, Equals, digest.SHA512.FromBytes([]byte(" "+child.ID())).Hex())
+}
@@ -0,0 +1,167 @@
+package overmount
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// MountDriver mounts the layers of a Mount at its target. OverlayDriver is
+// used unless the repository is given another driver with SetMountDriver.
+type MountDriver interface {
+	// Name is the name of the driver, as accepted by NewMountDriver.
+	Name() string
+
+	// MinLayers is the fewest layers, the upper one included, that the driver
+	// needs for a writable mount of an image.
+	MinLayers() int
+
+	// Mount makes the merged layers of m visible at its target.
+	Mount(m *Mount) error
+
+	// Unmount undoes Mount; changes made at the target end up in the upper
+	// dir of a writable mount. The target dir itself is left in place.
+	Unmount(m *Mount) error
+}
+
+// NewMountDriver returns the mount driver by the name of "overlay", "vfs" or
+// "bind".
+func NewMountDriver(name string) (MountDriver, error) {
+	switch name {
+	case "overlay":
+		return OverlayDriver{}, nil
+	case "vfs":
+		return VFSDriver{}, nil
+	case "bind":
+		return BindDriver{}, nil
+	}
+
+	return nil, errors.Wrapf(ErrMountCannotProceed, "unknown mount driver %q", name)
+}
+
+// SetMountDriver sets the driver mounts of the repository are created with
+// from now on. The default, and what a nil driver stands for, is
+// OverlayDriver. Like SetDedupe, the setting is not saved in the repository.
+func (r *Repository) SetMountDriver(driver MountDriver) {
+	r.mountDriver = driver
+}
+
+// MountDriver returns the driver set with SetMountDriver.
+func (r *Repository) MountDriver() MountDriver {
+	if r.mountDriver == nil {
+		return OverlayDriver{}
+	}
+
+	return r.mountDriver
+}
+
+func (m *Mount) mountDriver() MountDriver {
+	if m.driver == nil {
+		return OverlayDriver{}
+	}
+
+	return m.driver
+}
+
+// OverlayDriver mounts an overlay filesystem, which needs privileges and at
+// least two layers. Read-only mounts of a single layer are bind mounts, which
+// take none of the Options.
+type OverlayDriver struct {
+	Options OverlayOptions
+}
+
+// Name returns "overlay".
+func (OverlayDriver) Name() string {
+	return "overlay"
+}
+
+// MinLayers returns 2: overlay needs at least one lower dir.
+func (OverlayDriver) MinLayers() int {
+	return 2
+}
+
+// Mount mounts the overlay at the target of m.
+func (d OverlayDriver) Mount(m *Mount) error {
+	extra, err := overlayOptions(d.Options, m.ReadOnly())
+	if err != nil {
+		return err
+	}
+
+	opts, err := m.makeMountOptions(extra)
+	if err != nil {
+		return err
+	}
+
+	var flags uintptr
+	if m.ReadOnly() {
+		flags = unix.MS_RDONLY
+
+		if !strings.Contains(m.lower, ":") {
+			return bindReadOnly(m.lower, m.target)
+		}
+	}
+
+	if !mountOptionsFit(opts) {
+		return m.openLong(flags, extra)
+	}
+
+	return unix.Mount("overlay", m.target, "overlay", flags, opts)
+}
+
+// Unmount unmounts the target of m.
+func (OverlayDriver) Unmount(m *Mount) error {
+	return unix.Unmount(m.target, 0)
+}
+
+// BindDriver bind mounts images of a single layer: the upper dir of writable
+// mounts, or the lower dir of read-only ones. It needs privileges, but no
+// overlay support.
+type BindDriver struct{}
+
+// Name returns "bind".
+func (BindDriver) Name() string {
+	return "bind"
+}
+
+// MinLayers returns 1.
+func (BindDriver) MinLayers() int {
+	return 1
+}
+
+// Mount bind mounts the only layer of m at its target.
+func (BindDriver) Mount(m *Mount) error {
+	if m.ReadOnly() {
+		if m.lower == "" || strings.Contains(m.lower, ":") {
+			return errors.Wrap(ErrMountCannotProceed, "bind mounts need exactly one layer")
+		}
+
+		return bindReadOnly(m.lower, m.target)
+	}
+
+	if m.lower != "" {
+		return errors.Wrap(ErrMountCannotProceed, "bind mounts need exactly one layer")
+	}
+
+	return unix.Mount(m.upper, m.target, "", unix.MS_BIND, "")
+}
+
+// Unmount unmounts the target of m.
+func (BindDriver) Unmount(m *Mount) error {
+	return unix.Unmount(m.target, 0)
+}
+
+// bindReadOnly bind mounts source at target, read-only.
+func bindReadOnly(source, target string) error {
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+
+	// bind mounts only become read-only when remounted.
+	if err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		unix.Unmount(target, 0)
+		return err
+	}
+
+	return nil
+}
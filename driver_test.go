@@ -0,0 +1,227 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+// readTree returns the contents of the regular files below dir, and "" for
+// its dirs.
+func readTree(c *C, dir string) map[string]string {
+	files := map[string]string{}
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			files[rel] = string(content)
+		} else {
+			files[rel] = ""
+		}
+
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	return files
+}
+
+func (m *mountSuite) TestVFSDriver(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "base", typeflag: tar.TypeReg},
+		{name: "etc/passwd", content: "root:x:0:0", typeflag: tar.TypeReg},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/apt", content: "cache", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "layer", typeflag: tar.TypeReg},
+		{name: "etc/.wh.passwd", typeflag: tar.TypeReg},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "var/cache/new", content: "new", typeflag: tar.TypeReg},
+	}), base, false)
+	c.Assert(err, IsNil)
+
+	merged := map[string]string{
+		"etc":           "",
+		"etc/motd":      "layer",
+		"var":           "",
+		"var/cache":     "",
+		"var/cache/new": "new",
+	}
+
+	for _, driver := range []VFSDriver{{}, {Hardlink: true}} {
+		m.Repository.SetMountDriver(driver)
+		image := m.Repository.NewImage(layer)
+		c.Assert(image.MountReadOnly(), IsNil)
+		c.Assert(readTree(c, layer.MountPath()), DeepEquals, merged)
+
+		fi1, err := os.Lstat(filepath.Join(layer.MountPath(), "etc/motd"))
+		c.Assert(err, IsNil)
+		fi2, err := os.Lstat(filepath.Join(layer.Path(), "etc/motd"))
+		c.Assert(err, IsNil)
+		c.Assert(os.SameFile(fi1, fi2), Equals, driver.Hardlink)
+
+		c.Assert(image.Unmount(), IsNil)
+		c.Assert(readTree(c, layer.MountPath()), DeepEquals, map[string]string{})
+		c.Assert(os.Remove(layer.MountPath()), IsNil)
+
+		// the layers can still be packed to the tars they were unpacked from.
+		dg, err := layer.LoadDigest()
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, layer.ID())
+	}
+
+	// changes to writable mounts end up in the upper dir.
+	m.Repository.SetMountDriver(VFSDriver{})
+	top, err := m.Repository.CreateLayer("top", layer, false)
+	c.Assert(err, IsNil)
+
+	image := m.Repository.NewImage(top)
+	c.Assert(image.Mount(), IsNil)
+	c.Assert(readTree(c, top.MountPath()), DeepEquals, merged)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(top.MountPath(), "etc/motd"), []byte("top"), 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(top.MountPath(), "usr/bin"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(top.MountPath(), "usr/bin/sh"), []byte("#!"), 0755), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(top.MountPath(), "var/cache")), IsNil)
+	c.Assert(image.Unmount(), IsNil)
+	c.Assert(os.Remove(top.MountPath()), IsNil)
+
+	c.Assert(readTree(c, top.Path()), DeepEquals, map[string]string{
+		"etc":           "",
+		"etc/motd":      "top",
+		"usr":           "",
+		"usr/bin":       "",
+		"usr/bin/sh":    "#!",
+		"var":           "",
+		"var/.wh.cache": "",
+	})
+
+	fi, err := os.Stat(filepath.Join(top.Path(), "usr/bin/sh"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0755))
+
+	c.Assert(image.MountReadOnly(), IsNil)
+	c.Assert(readTree(c, top.MountPath()), DeepEquals, map[string]string{
+		"etc":        "",
+		"etc/motd":   "top",
+		"usr":        "",
+		"usr/bin":    "",
+		"usr/bin/sh": "#!",
+		"var":        "",
+	})
+	c.Assert(image.Unmount(), IsNil)
+}
+
+func (m *mountSuite) TestBindDriver(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	m.Repository.SetMountDriver(BindDriver{})
+	c.Assert(m.Repository.MountDriver().Name(), Equals, "bind")
+
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "motd", content: "base", typeflag: tar.TypeReg}}), nil, false)
+	c.Assert(err, IsNil)
+
+	image := m.Repository.NewImage(base)
+	c.Assert(image.Mount(), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(base.MountPath(), "issue"), []byte("issue"), 0644), IsNil)
+	c.Assert(image.Unmount(), IsNil)
+	c.Assert(os.Remove(base.MountPath()), IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(base.Path(), "issue"))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "issue")
+
+	layer, err := m.Repository.CreateLayer("layer", base, false)
+	c.Assert(err, IsNil)
+	image = m.Repository.NewImage(layer)
+	c.Assert(errors.Cause(image.Mount()), Equals, ErrMountCannotProceed)
+	c.Assert(errors.Cause(image.MountReadOnly()), Equals, ErrMountCannotProceed)
+}
+
+// minLayersDriver is a VFSDriver that needs min layers.
+type minLayersDriver struct {
+	VFSDriver
+	min int
+}
+
+func (d minLayersDriver) MinLayers() int {
+	return d.min
+}
+
+func (m *mountSuite) TestMountDriverMinLayers(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	for _, driver := range []MountDriver{OverlayDriver{}, VFSDriver{}, BindDriver{}} {
+		min := 1
+		if driver.Name() == "overlay" {
+			min = 2
+		}
+		c.Assert(driver.MinLayers(), Equals, min)
+	}
+
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "motd", content: "base", typeflag: tar.TypeReg}}), nil, false)
+	c.Assert(err, IsNil)
+	layer, err := m.Repository.CreateLayer("layer", base, false)
+	c.Assert(err, IsNil)
+
+	m.Repository.SetMountDriver(minLayersDriver{min: 3})
+	image := m.Repository.NewImage(layer)
+	err = image.Mount()
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+	c.Assert(err, ErrorMatches, "vfs driver needs at least 3 layers, image has 2.*")
+
+	top, err := m.Repository.CreateLayer("top", layer, false)
+	c.Assert(err, IsNil)
+	image = m.Repository.NewImage(top)
+	c.Assert(image.Mount(), IsNil)
+	c.Assert(readTree(c, top.MountPath()), DeepEquals, map[string]string{"motd": "base"})
+	c.Assert(image.Unmount(), IsNil)
+}
+
+func (m *mountSuite) TestNewMountDriver(c *C) {
+	for _, name := range []string{"overlay", "vfs", "bind"} {
+		driver, err := NewMountDriver(name)
+		c.Assert(err, IsNil)
+		c.Assert(driver.Name(), Equals, name)
+	}
+
+	_, err := NewMountDriver("aufs")
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+
+	c.Assert(m.Repository.MountDriver(), Equals, MountDriver(OverlayDriver{}))
+}
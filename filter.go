@@ -0,0 +1,219 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// packFilter selects the entries of a tar by the Include and Exclude patterns
+// of PackOptions.
+type packFilter struct {
+	pm       *fileutils.PatternMatcher
+	patterns []string
+
+	// moved maps excluded hardlink targets to the entry which holds their
+	// contents in their stead.
+	moved map[string]string
+}
+
+// newPackFilter returns the filter for the patterns in opts, or nil if there
+// are none.
+func newPackFilter(opts *PackOptions) (*packFilter, error) {
+	if opts == nil || (len(opts.Include) == 0 && len(opts.Exclude) == 0) {
+		return nil, nil
+	}
+
+	patterns := []string{}
+
+	// an include list is an exclusion of everything, with the included paths
+	// as exceptions.
+	if len(opts.Include) > 0 {
+		patterns = append(patterns, "**")
+
+		for _, pattern := range opts.Include {
+			pattern = strings.TrimSpace(pattern)
+			if strings.HasPrefix(pattern, "!") {
+				patterns = append(patterns, cleanPattern(pattern[1:]))
+			} else if pattern != "" {
+				patterns = append(patterns, "!"+cleanPattern(pattern))
+			}
+		}
+	}
+
+	for _, pattern := range opts.Exclude {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			patterns = append(patterns, "!"+cleanPattern(pattern[1:]))
+		} else if pattern != "" {
+			patterns = append(patterns, cleanPattern(pattern))
+		}
+	}
+
+	pm, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, errors.Wrapf(ErrInvalidAsset, "invalid pattern: %v", err)
+	}
+
+	return &packFilter{pm: pm, patterns: patterns, moved: map[string]string{}}, nil
+}
+
+// cleanPattern makes pattern relative to the root of the asset, as in
+// .dockerignore files.
+func cleanPattern(pattern string) string {
+	pattern = strings.TrimLeft(filepath.Clean(strings.TrimSpace(pattern)), "/")
+	if pattern == "" {
+		return "**"
+	}
+
+	return pattern
+}
+
+// filter reports if the entry for header is excluded. A hardlink to an
+// excluded entry is turned into a regular file; the name of the target whose
+// contents it must be given is returned, and the caller sets its size.
+func (f *packFilter) filter(header *tar.Header) (bool, string, error) {
+	if f == nil {
+		return false, "", nil
+	}
+
+	excluded, err := f.pm.Matches(cleanEntryName(header.Name))
+	if err != nil || excluded {
+		return excluded, "", err
+	}
+
+	if header.Typeflag != tar.TypeLink {
+		return false, "", nil
+	}
+
+	target := cleanEntryName(header.Linkname)
+	if first, ok := f.moved[target]; ok {
+		header.Linkname = first
+		return false, "", nil
+	}
+
+	excluded, err = f.pm.Matches(target)
+	if err != nil || !excluded {
+		return false, "", err
+	}
+
+	f.moved[target] = header.Name
+	header.Typeflag = tar.TypeReg
+	header.Linkname = ""
+
+	return false, target, nil
+}
+
+// skip reports if name, described by fi, is excluded while walking a tree.
+// For directories nothing below which can be included again, the error is
+// filepath.SkipDir.
+func (f *packFilter) skip(name string, fi os.FileInfo) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+
+	excluded, err := f.pm.Matches(name)
+	if err != nil || !excluded {
+		return false, err
+	}
+
+	if fi.IsDir() && !f.pm.Exclusions() {
+		return true, filepath.SkipDir
+	}
+
+	return true, nil
+}
+
+// packFiltered writes the entries of the virtual asset's tar selected by
+// filter to writer. Sparse files are written out in full, as archive/tar
+// cannot write them.
+func (a *Asset) packFiltered(writer io.Writer, filter *packFilter) error {
+	f, err := a.fs.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	tw := tar.NewWriter(writer)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+
+		excluded, target, err := filter.filter(header)
+		if err != nil {
+			return err
+		}
+
+		if excluded {
+			continue
+		}
+
+		if isSparseHeader(header) {
+			size := header.Size
+			header = sparsePlaceholder(header)
+			header.Size = size
+		}
+
+		if target != "" {
+			err = a.copyEntry(tw, header, target)
+		} else if err = tw.WriteHeader(header); err == nil {
+			_, err = io.Copy(tw, tr)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// copyEntry writes header to tw, with the contents of the entry for target.
+func (a *Asset) copyEntry(tw *tar.Writer, header *tar.Header, target string) error {
+	index, err := a.loadIndex()
+	if err != nil {
+		return err
+	}
+
+	entry, err := findEntry(index, target)
+	if err != nil {
+		return err
+	}
+
+	rc, err := a.Open(target)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	header.Size = entry.Header.Size
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, rc)
+	return err
+}
+
+// copyFrom copies the contents of the file p to writer.
+func copyFrom(writer io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(writer, f)
+	return err
+}
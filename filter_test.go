@@ -0,0 +1,89 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestPackFilter(c *C) {
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/passwd", content: "root:x:0:0", typeflag: tar.TypeReg},
+		{name: "etc/motd.old", linkname: "etc/motd", typeflag: tar.TypeLink},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/apt.bin", content: "cache", typeflag: tar.TypeReg},
+		{name: "root/", typeflag: tar.TypeDir},
+		{name: "root/.ssh/", typeflag: tar.TypeDir},
+		{name: "root/.ssh/id_rsa", content: "secret", typeflag: tar.TypeReg},
+	}
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+
+	pack := func(opts PackOptions) map[string]string {
+		buf := new(bytes.Buffer)
+		dg, err := layer.PackWithOptions(buf, &opts)
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Not(Equals), layer.ID())
+
+		files := map[string]string{}
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+
+			content, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			if header.Typeflag == tar.TypeLink {
+				content = []byte("-> " + header.Linkname)
+			}
+			files[cleanEntryName(header.Name)] = string(content)
+		}
+
+		return files
+	}
+
+	for _, reproducible := range []bool{false, true} {
+		comment := Commentf("reproducible: %v", reproducible)
+
+		// the hardlink carries the contents of its excluded target.
+		files := pack(PackOptions{Reproducible: reproducible, Exclude: []string{"var/cache", "/root/.ssh/*", "etc/motd"}})
+		c.Assert(files, DeepEquals, map[string]string{
+			"etc":          "",
+			"etc/passwd":   "root:x:0:0",
+			"etc/motd.old": "hello",
+			"var":          "",
+			"root":         "",
+			"root/.ssh":    "",
+		}, comment)
+
+		files = pack(PackOptions{Reproducible: reproducible, Include: []string{"etc"}, Exclude: []string{"etc/passwd"}})
+		c.Assert(files, DeepEquals, map[string]string{
+			"etc":          "",
+			"etc/motd":     "hello",
+			"etc/motd.old": "-> etc/motd",
+		}, comment)
+
+		files = pack(PackOptions{Reproducible: reproducible, Exclude: []string{"etc", "!etc/passwd", "var", "root"}})
+		c.Assert(files, DeepEquals, map[string]string{"etc/passwd": "root:x:0:0"}, comment)
+	}
+
+	// without filters, the unpacked tar is packed again.
+	c.Assert(readLayer(c, layer)["root/.ssh/id_rsa"], Equals, "secret")
+	dg, err := layer.PackWithOptions(ioutil.Discard, &PackOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, layer.ID())
+
+	_, err = layer.PackWithOptions(ioutil.Discard, &PackOptions{Exclude: []string{"["}})
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+}
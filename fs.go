@@ -0,0 +1,148 @@
+package overmount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileSystem holds the files of a repository and its assets: those of the
+// host, or, for memory repositories, a tree held in memory. Expanded layers
+// and mounts always live on the host.
+type fileSystem interface {
+	Open(name string) (file, error)
+	Create(name string) (file, error)
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	TempFile(dir, pattern string) (file, error)
+	TempDir(dir, pattern string) (string, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Chmod(name string, mode os.FileMode) error
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// Lock takes an exclusive lock named by name, failing if it is held
+	// elsewhere; the returned func releases it.
+	Lock(name string) (func() error, error)
+}
+
+// file is an open file of a fileSystem.
+type file interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+func readFile(fs fileSystem, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func writeFile(fs fileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// osFS is the fileSystem of the host.
+type osFS struct{}
+
+func (osFS) Open(name string) (file, error) {
+	return wrapOSFile(os.Open(name))
+}
+
+func (osFS) Create(name string) (file, error) {
+	return wrapOSFile(os.Create(name))
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	return wrapOSFile(os.OpenFile(name, flag, perm))
+}
+
+func (osFS) TempFile(dir, pattern string) (file, error) {
+	return wrapOSFile(ioutil.TempFile(dir, pattern))
+}
+
+func (osFS) TempDir(dir, pattern string) (string, error) {
+	return ioutil.TempDir(dir, pattern)
+}
+
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (osFS) Lock(name string) (func() error, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() error {
+		defer f.Close()
+		return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	}, nil
+}
+
+// wrapOSFile keeps a nil *os.File from becoming a non-nil file.
+func wrapOSFile(f *os.File, err error) (file, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
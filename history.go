@@ -0,0 +1,151 @@
+package overmount
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const historyPath = "history.json"
+
+// LayerHistory is the metadata of a single layer. Unlike the ImageConfig,
+// which describes the whole image up to a layer, it only ever applies to the
+// layer it is saved with. Exporters turn it into the history of the image.
+type LayerHistory struct {
+	// Created is when the layer was created.
+	Created time.Time `json:"created"`
+
+	// CreatedBy is the command which created the layer.
+	CreatedBy string `json:"created_by,omitempty"`
+
+	// Author is the author of the layer.
+	Author string `json:"author,omitempty"`
+
+	// Comment is a free-form description of the layer.
+	Comment string `json:"comment,omitempty"`
+
+	// EmptyLayer marks layers which do not change the filesystem.
+	EmptyLayer bool `json:"empty_layer,omitempty"`
+
+	// Size is the size of the uncompressed layer tar.
+	Size int64 `json:"size"`
+
+	// MediaType is the media type of the tar the layer was created from.
+	MediaType string `json:"media_type,omitempty"`
+
+	// Annotations are arbitrary metadata for the layer.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ConfigStep is a metadata-only step of an image, such as setting ENV or
+// LABEL. It has no layer directory or tar of its own. As layers are shared by
+// images, config steps are kept with the ImageConfig of the image instead of
+// the layer they follow; see (*Image).AddConfigStep.
+type ConfigStep struct {
+	LayerHistory
+
+	// After is the ID of the layer the step was taken on top of, or "" for
+	// steps taken before the first layer.
+	After string `json:"after,omitempty"`
+}
+
+// StepsAfter returns the history entries of the config steps taken on top of
+// the layer with ID id, or before the first layer if id is "", in order. They
+// are marked as empty layers.
+func (c *ImageConfig) StepsAfter(id string) []LayerHistory {
+	entries := []LayerHistory{}
+
+	for _, step := range c.ConfigSteps {
+		if step.After == id {
+			entry := step.LayerHistory
+			entry.EmptyLayer = true
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// moveSteps makes the config steps taken on top of any of the layers with the
+// IDs in from follow the layer with ID to instead.
+func (c *ImageConfig) moveSteps(from map[string]bool, to string) {
+	for i := range c.ConfigSteps {
+		if from[c.ConfigSteps[i].After] {
+			c.ConfigSteps[i].After = to
+		}
+	}
+}
+
+func (l *Layer) historyPath() string {
+	return filepath.Join(l.layerBase(), historyPath)
+}
+
+// History returns the history record of the layer. Layers created from an
+// asset get one on creation; for other layers, the error satisfies
+// os.IsNotExist until SaveHistory is called.
+func (l *Layer) History() (*LayerHistory, error) {
+	f, err := l.repository.fs.Open(l.historyPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var h LayerHistory
+	return &h, json.NewDecoder(f).Decode(&h)
+}
+
+// SaveHistory writes the history record of the layer.
+func (l *Layer) SaveHistory(history *LayerHistory) error {
+	return l.edit(func() error {
+		f, err := l.repository.fs.Create(l.historyPath())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return json.NewEncoder(f).Encode(history)
+	})
+}
+
+// AddConfigStep records a metadata-only step taken on top of the image, such
+// as setting ENV or LABEL, for its history. Unlike creating an empty layer for
+// it, this uses no storage, and the step takes up no lower directory when
+// mounting.
+//
+// The step is kept in the image configuration of the top layer (see
+// SaveConfig), which is created if there is none, so it is not part of other
+// images sharing the layer. An image built on top of this one carries the
+// steps along with the rest of the configuration.
+func (i *Image) AddConfigStep(step *LayerHistory) error {
+	config, err := i.layer.Config()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		config = &ImageConfig{}
+	}
+
+	if step.Created.IsZero() {
+		step.Created = time.Now().UTC()
+	}
+
+	step.EmptyLayer = true
+	config.ConfigSteps = append(config.ConfigSteps, ConfigStep{LayerHistory: *step, After: i.layer.ID()})
+
+	return i.layer.SaveConfig(config)
+}
+
+// saveInitialHistory records the creation of a layer from asset, unless the
+// layer already has a history.
+func (l *Layer) saveInitialHistory(asset *Asset) error {
+	if _, err := l.repository.fs.Stat(l.historyPath()); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	return l.SaveHistory(&LayerHistory{
+		Created:   time.Now().UTC(),
+		Size:      asset.Size(),
+		MediaType: asset.Compression().MediaType(),
+	})
+}
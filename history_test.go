@@ -0,0 +1,109 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestLayerHistory(c *C) {
+	original := makeTar(c, []tarEntry{{name: "file", content: "content", typeflag: tar.TypeReg}}).Bytes()
+
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	_, err := gz.Write(original)
+	c.Assert(err, IsNil)
+	c.Assert(gz.Close(), IsNil)
+
+	before := time.Now().Add(-time.Second)
+
+	layer, err := m.Repository.CreateLayerFromAsset(compressed, nil, false)
+	c.Assert(err, IsNil)
+
+	history, err := layer.History()
+	c.Assert(err, IsNil)
+	c.Assert(history.Created.After(before), Equals, true)
+	c.Assert(history.Size, Equals, int64(len(original)))
+	c.Assert(history.MediaType, Equals, "application/vnd.oci.image.layer.v1.tar+gzip")
+	c.Assert(history.EmptyLayer, Equals, false)
+
+	history.CreatedBy = "/bin/sh -c make install"
+	history.Comment = "install"
+	history.Annotations = map[string]string{"org.example.step": "1"}
+	c.Assert(layer.SaveHistory(history), IsNil)
+
+	// the record is kept with the layer.
+	repo, err := NewRepository(m.Repository.baseDir, m.Repository.IsVirtual())
+	c.Assert(err, IsNil)
+	layer, err = repo.NewLayer(layer.ID(), nil)
+	c.Assert(err, IsNil)
+
+	saved, err := layer.History()
+	c.Assert(err, IsNil)
+	c.Assert(saved.CreatedBy, Equals, "/bin/sh -c make install")
+	c.Assert(saved.Comment, Equals, "install")
+	c.Assert(saved.Annotations, DeepEquals, map[string]string{"org.example.step": "1"})
+	c.Assert(saved.Created.Equal(history.Created), Equals, true)
+
+	empty, err := m.Repository.CreateLayer("empty", nil, false)
+	c.Assert(err, IsNil)
+	_, err = empty.History()
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(Uncompressed.MediaType(), Equals, LayerMediaType)
+	c.Assert(Zstd.MediaType(), Equals, LayerMediaType+"+zstd")
+}
+
+func (m *mountSuite) TestConfigSteps(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "file", content: "content", typeflag: tar.TypeReg}}), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(base.SaveConfig(&ImageConfig{Cmd: []string{"sh"}}), IsNil)
+
+	image := m.Repository.NewImage(base)
+	c.Assert(image.AddConfigStep(&LayerHistory{CreatedBy: "ENV PATH=/bin"}), IsNil)
+	c.Assert(image.AddConfigStep(&LayerHistory{CreatedBy: "LABEL step=2", Comment: "label"}), IsNil)
+
+	// config steps do not create layers of their own.
+	dirs, err := ioutil.ReadDir(filepath.Join(m.Repository.baseDir, layerBase))
+	c.Assert(err, IsNil)
+	c.Assert(dirs, HasLen, 1)
+
+	config, err := base.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Cmd, DeepEquals, []string{"sh"})
+	c.Assert(config.StepsAfter(""), HasLen, 0)
+
+	entries := config.StepsAfter(base.ID())
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[0].CreatedBy, Equals, "ENV PATH=/bin")
+	c.Assert(entries[0].EmptyLayer, Equals, true)
+	c.Assert(entries[0].Created.IsZero(), Equals, false)
+	c.Assert(entries[1].Comment, Equals, "label")
+	c.Assert(entries[1].EmptyLayer, Equals, true)
+
+	// they are kept with the image, not the layer, which other images share.
+	history, err := base.History()
+	c.Assert(err, IsNil)
+	c.Assert(history.EmptyLayer, Equals, false)
+
+	other, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "other", content: "other", typeflag: tar.TypeReg}}), base, false)
+	c.Assert(err, IsNil)
+	c.Assert(m.Repository.NewImage(other).AddConfigStep(&LayerHistory{CreatedBy: "CMD other"}), IsNil)
+	config, err = other.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.ConfigSteps, HasLen, 1)
+	c.Assert(config.ConfigSteps[0].After, Equals, other.ID())
+
+	// squashed layers pass their steps on to the squashed layer.
+	squashed, err := m.Repository.Squash(other, nil)
+	c.Assert(err, IsNil)
+	config, err = squashed.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.StepsAfter(squashed.ID()), HasLen, 1)
+}
@@ -0,0 +1,230 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ownerXattr holds the uid and gid of a file, as they were in the tar, when
+// they could not be applied with chown.
+const ownerXattr = "user.overmount.owner"
+
+// IDMap maps Size consecutive IDs starting at ContainerID in the layer to IDs
+// starting at HostID on the host.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// IDMapping is the set of uid and gid ranges used to shift the owners of files
+// unpacked into expanded layers; see Repository.SetIDMapping.
+type IDMapping struct {
+	UIDs []IDMap
+	GIDs []IDMap
+}
+
+// ParseSubIDs reads ranges in the format of /etc/subuid and /etc/subgid
+// (name:start:count, one per line) for the user name, which may also be a
+// numeric ID. The ranges are mapped in order to the container IDs starting at
+// 0.
+func ParseSubIDs(reader io.Reader, name string) ([]IDMap, error) {
+	maps := []IDMap{}
+	containerID := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 {
+			return nil, errors.Wrapf(ErrInvalidAsset, "invalid subordinate id range %q", line)
+		}
+
+		if parts[0] != name {
+			continue
+		}
+
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidAsset, "invalid subordinate id range %q", line)
+		}
+
+		count, err := strconv.Atoi(parts[2])
+		if err != nil || count <= 0 {
+			return nil, errors.Wrapf(ErrInvalidAsset, "invalid subordinate id range %q", line)
+		}
+
+		maps = append(maps, IDMap{ContainerID: containerID, HostID: start, Size: count})
+		containerID += count
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return maps, nil
+}
+
+// SetIDMapping sets the mapping used for the layers of the repository. When
+// expanded layers are unpacked, the owners in the tar are shifted to host IDs
+// with it, and packing shifts them back. If the owners cannot be changed,
+// because the process is not root, the owners from the tar are recorded in
+// the user.overmount.owner xattr instead, and packing uses that; this is done
+// even without a mapping. Symlinks cannot carry these xattrs. Virtual layers
+// keep their tar as is and are not affected.
+func (r *Repository) SetIDMapping(mapping *IDMapping) {
+	r.edit(func() error {
+		r.idMapping = mapping
+		for _, layer := range r.layers {
+			layer.asset.SetIDMapping(mapping)
+		}
+		return nil
+	})
+}
+
+// SetIDMapping sets the ID mapping of the asset. See Repository.SetIDMapping.
+func (a *Asset) SetIDMapping(mapping *IDMapping) {
+	a.idMapping = mapping
+}
+
+func toIDTools(maps []IDMap) []idtools.IDMap {
+	if len(maps) == 0 {
+		return nil
+	}
+
+	result := []idtools.IDMap{}
+	for _, m := range maps {
+		result = append(result, idtools.IDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+
+	return result
+}
+
+func toContainer(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+
+	// IDs outside the mapping, such as those of files created by the user
+	// outside any mapped range, are written unchanged.
+	return id
+}
+
+// containerOwner returns the owner to write to a tar for the file p, which is
+// owned by uid and gid on the host.
+func (a *Asset) containerOwner(p string, uid, gid int) (int, int, error) {
+	value, err := lgetxattr(p, ownerXattr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if value != nil {
+		var xuid, xgid int
+		if _, err := fmt.Sscanf(string(value), "%d:%d", &xuid, &xgid); err != nil {
+			return 0, 0, errors.Wrapf(ErrInvalidAsset, "invalid %s on %q", ownerXattr, p)
+		}
+		return xuid, xgid, nil
+	}
+
+	if a.idMapping == nil {
+		return uid, gid, nil
+	}
+
+	return toContainer(a.idMapping.UIDs, uid), toContainer(a.idMapping.GIDs, gid), nil
+}
+
+// unpackOwners unpacks the tar in reader to the asset's path, shifting owners
+// with the ID mapping, or recording them in xattrs if they cannot be applied.
+func (a *Asset) unpackOwners(reader io.Reader) error {
+	opts := &archive.TarOptions{NoLchown: os.Geteuid() != 0}
+	if a.idMapping != nil {
+		opts.UIDMaps = toIDTools(a.idMapping.UIDs)
+		opts.GIDMaps = toIDTools(a.idMapping.GIDs)
+	}
+
+	if !opts.NoLchown {
+		return archive.Unpack(reader, a.path, opts)
+	}
+
+	tee, finish := recordOwners(reader)
+	err := archive.Unpack(tee, a.path, opts)
+	owners, ownerErr := finish()
+	if err != nil {
+		return err
+	}
+
+	if ownerErr != nil {
+		return ownerErr
+	}
+
+	for name, owner := range owners {
+		value := []byte(fmt.Sprintf("%d:%d", owner[0], owner[1]))
+		switch err := unix.Lsetxattr(filepath.Join(a.path, name), ownerXattr, value, 0); err {
+		// whiteouts do not exist on disk; symlinks and device nodes cannot
+		// carry user xattrs; and not all filesystems support them.
+		case nil, unix.ENOENT, unix.EPERM, unix.ENOTSUP:
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordOwners reads the headers of the tar passing through reader in the
+// background. The returned function must be called once the stream has been
+// read; it returns the owners of all entries by their cleaned path.
+func recordOwners(reader io.Reader) (io.Reader, func() (map[string][2]int, error)) {
+	pr, pw := io.Pipe()
+	owners := map[string][2]int{}
+	errChan := make(chan error, 1)
+
+	go func() {
+		tr := tar.NewReader(pr)
+
+		var err error
+		for {
+			var header *tar.Header
+			header, err = tr.Next()
+			if err != nil {
+				break
+			}
+
+			owners[path.Clean("/"+header.Name)] = [2]int{header.Uid, header.Gid}
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+
+		// keep draining so the writing side never blocks.
+		io.Copy(ioutil.Discard, pr)
+		errChan <- err
+	}()
+
+	finish := func() (map[string][2]int, error) {
+		pw.Close()
+		return owners, <-errChan
+	}
+
+	return io.TeeReader(reader, pw), finish
+}
@@ -0,0 +1,132 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func packedOwners(c *C, layer *Layer, opts *PackOptions) map[string][2]int {
+	buf := new(bytes.Buffer)
+	_, err := layer.PackWithOptions(buf, opts)
+	c.Assert(err, IsNil)
+
+	owners := map[string][2]int{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		owners[strings.TrimSuffix(header.Name, "/")] = [2]int{header.Uid, header.Gid}
+	}
+
+	return owners
+}
+
+func (m *mountSuite) TestRecordOwners(c *C) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "./a/", Typeflag: tar.TypeDir, Uid: 3, Gid: 4}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "a/b", Typeflag: tar.TypeReg, Size: 1, Uid: 5, Gid: 6}), IsNil)
+	_, err := tw.Write([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	reader, finish := recordOwners(buf)
+	_, err = io.Copy(ioutil.Discard, reader)
+	c.Assert(err, IsNil)
+	owners, err := finish()
+	c.Assert(err, IsNil)
+	c.Assert(owners, DeepEquals, map[string][2]int{"/a": {3, 4}, "/a/b": {5, 6}})
+}
+
+func (m *mountSuite) TestIDMapping(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar as is")
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		c.Skip("owners can only be shifted as root")
+		return
+	}
+
+	subuid := "# comment\nother:200000:65536\nbuilder:100000:1000\nbuilder:300000:64536\n"
+	maps, err := ParseSubIDs(strings.NewReader(subuid), "builder")
+	c.Assert(err, IsNil)
+	c.Assert(maps, DeepEquals, []IDMap{
+		{ContainerID: 0, HostID: 100000, Size: 1000},
+		{ContainerID: 1000, HostID: 300000, Size: 64536},
+	})
+
+	_, err = ParseSubIDs(strings.NewReader("builder:100000"), "builder")
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+	m.Repository.SetIDMapping(&IDMapping{UIDs: maps, GIDs: maps})
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, header := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000},
+		{Name: "home/user", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1001},
+	} {
+		c.Assert(tw.WriteHeader(header), IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(buf, nil, false)
+	c.Assert(err, IsNil)
+
+	for name, owner := range map[string][2]uint32{
+		"etc/passwd": {100000, 100000},
+		"home":       {300000, 300000},
+		"home/user":  {300000, 300001},
+	} {
+		fi, err := os.Lstat(filepath.Join(layer.Path(), name))
+		c.Assert(err, IsNil)
+		stat := fi.Sys().(*syscall.Stat_t)
+		c.Assert([2]uint32{stat.Uid, stat.Gid}, Equals, owner, Commentf("%v", name))
+	}
+
+	want := map[string][2]int{
+		"etc":        {0, 0},
+		"etc/passwd": {0, 0},
+		"home":       {1000, 1000},
+		"home/user":  {1000, 1001},
+	}
+
+	c.Assert(packedOwners(c, layer, &PackOptions{Reproducible: true}), DeepEquals, want)
+
+	// the shifted owners still match the tar they were unpacked from, until
+	// one of them changes on the host.
+	ok, err := layer.asset.tarSplitMatches()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(os.Lchown(filepath.Join(layer.Path(), "home/user"), 300005, 300001), IsNil)
+	c.Assert(packedOwners(c, layer, nil)["home/user"], Equals, [2]int{1005, 1001})
+	c.Assert(os.Lchown(filepath.Join(layer.Path(), "home/user"), 300000, 300001), IsNil)
+
+	c.Assert(layer.asset.removeTarSplit(), IsNil)
+	c.Assert(packedOwners(c, layer, nil), DeepEquals, want)
+
+	// owners recorded in xattrs take precedence.
+	err = unix.Lsetxattr(filepath.Join(layer.Path(), "etc/passwd"), ownerXattr, []byte("5:6"), 0)
+	if err == unix.ENOTSUP {
+		return
+	}
+	c.Assert(err, IsNil)
+	c.Assert(packedOwners(c, layer, nil)["etc/passwd"], Equals, [2]int{5, 6})
+}
@@ -2,6 +2,7 @@ package overmount
 
 import (
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,8 +13,10 @@ func (r *Repository) NewImage(topLayer *Layer) *Image {
 }
 
 // Mount mounts an image with the specified layer as its highest element.
-// Images must have at least two layers to be mounted. If you need to work with
-// the first layer, operate on the layer directly with the Asset interface.
+// Images must have at least as many layers as the MountDriver needs, which is
+// two for the overlay driver. If you need to work with the first layer,
+// operate on the layer directly with the Asset interface, or mount it with
+// another MountDriver.
 //
 // Call unmount to undo this operation.
 func (i *Image) Mount() error {
@@ -28,23 +31,20 @@ func (i *Image) Mount() error {
 		return errors.Wrap(ErrMountCannotProceed, "mount exists")
 	}
 
-	layer := i.layer.Parent
-	if layer == nil {
-		return errors.Wrap(ErrMountCannotProceed, "must have at least two layers")
+	count := 0
+	for iter := i.layer; iter != nil; iter = iter.Parent {
+		count++
 	}
 
-	lower := ""
+	if min := i.repository.MountDriver().MinLayers(); count < min {
+		return errors.Wrapf(ErrMountCannotProceed, "%s driver needs at least %d layers, image has %d", i.repository.MountDriver().Name(), min, count)
+	}
 
-	for layer != nil {
-		if err := i.repository.mkdirCheckRel(layer.Path()); err != nil {
-			return err
-		}
-		if lower != "" {
-			lower = layer.Path() + ":" + lower
-		} else {
-			lower = layer.Path()
-		}
-		layer = layer.Parent
+	layer := i.layer.Parent
+
+	lower, err := i.lowerDirs(layer)
+	if err != nil {
+		return err
 	}
 
 	for _, path := range []string{target, upper} {
@@ -53,6 +53,21 @@ func (i *Image) Mount() error {
 		}
 	}
 
+	// the upper dir is about to be written to, so it can no longer be
+	// reassembled into the tar it was unpacked from.
+	if err := i.layer.asset.removeTarSplit(); err != nil {
+		return errors.Wrap(ErrMountCannotProceed, err.Error())
+	}
+
+	if err := i.layer.removeManifest(); err != nil {
+		return errors.Wrap(ErrMountCannotProceed, err.Error())
+	}
+
+	// for the same reason, it must not share files with other layers.
+	if err := i.repository.unshareTree(upper); err != nil {
+		return errors.Wrap(ErrMountCannotProceed, err.Error())
+	}
+
 	mount, err := i.repository.NewMount(target, lower, upper)
 	if err != nil {
 		return err
@@ -63,6 +78,58 @@ func (i *Image) Mount() error {
 	return mount.Open()
 }
 
+// MountReadOnly mounts the image read-only, with all of its layers, including
+// the top one, as lower dirs and neither an upper nor a work dir. Unlike Mount,
+// it cannot change any layer, so it is safe for inspecting tagged images; it
+// also works for images of a single layer, which are bind mounted read-only.
+//
+// Call unmount to undo this operation.
+func (i *Image) MountReadOnly() error {
+	if i.repository.IsVirtual() {
+		return errors.Wrap(ErrMountCannotProceed, "cannot mount in virtual repository")
+	}
+
+	target := i.layer.MountPath()
+
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		return errors.Wrap(ErrMountCannotProceed, "mount exists")
+	}
+
+	lower, err := i.lowerDirs(i.layer)
+	if err != nil {
+		return err
+	}
+
+	if err := i.repository.mkdirCheckRel(target); err != nil {
+		return errors.Wrap(ErrMountCannotProceed, err.Error())
+	}
+
+	mount, err := i.repository.NewReadOnlyMount(target, lower)
+	if err != nil {
+		return err
+	}
+
+	i.mount = mount
+
+	return mount.Open()
+}
+
+// lowerDirs returns the lower dirs of an overlay mount of layer and its
+// parents, creating them as needed. Overlay stacks them from the right, so
+// layer comes first.
+func (i *Image) lowerDirs(layer *Layer) (string, error) {
+	dirs := []string{}
+
+	for ; layer != nil; layer = layer.Parent {
+		if err := i.repository.mkdirCheckRel(layer.Path()); err != nil {
+			return "", err
+		}
+		dirs = append(dirs, layer.Path())
+	}
+
+	return strings.Join(dirs, ":"), nil
+}
+
 // Unmount unmounts the image. This does not affect layer storage.
 func (i *Image) Unmount() error {
 	if i.mount == nil {
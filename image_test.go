@@ -1,7 +1,10 @@
 package overmount
 
 import (
+	"archive/tar"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	. "gopkg.in/check.v1"
 
@@ -45,3 +48,84 @@ func (m *mountSuite) TestImageCommit(c *C) {
 		}
 	}
 }
+
+func (m *mountSuite) TestImageMountOrder(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "motd", content: "base", typeflag: tar.TypeReg},
+		{name: "issue", content: "base", typeflag: tar.TypeReg},
+		{name: "hostname", content: "base", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	middle, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "motd", content: "middle", typeflag: tar.TypeReg},
+		{name: "issue", content: "middle", typeflag: tar.TypeReg},
+	}), base, false)
+	c.Assert(err, IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "motd", content: "layer", typeflag: tar.TypeReg}}), middle, false)
+	c.Assert(err, IsNil)
+
+	top, err := m.Repository.CreateLayer("top", layer, false)
+	c.Assert(err, IsNil)
+
+	image := m.Repository.NewImage(top)
+	if m.Repository.IsVirtual() {
+		c.Assert(errors.Cause(image.Mount()), Equals, ErrMountCannotProceed)
+		return
+	}
+
+	c.Assert(image.Mount(), IsNil)
+	defer image.Unmount()
+
+	// upper layers win over lower ones.
+	for name, content := range map[string]string{"motd": "layer", "issue": "middle", "hostname": "base"} {
+		b, err := ioutil.ReadFile(filepath.Join(top.MountPath(), name))
+		c.Assert(err, IsNil)
+		c.Assert(string(b), Equals, content, Commentf("%v", name))
+	}
+}
+
+func (m *mountSuite) TestImageMountReadOnly(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "motd", content: "base", typeflag: tar.TypeReg},
+		{name: "issue", content: "issue", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "motd", content: "layer", typeflag: tar.TypeReg}}), base, false)
+	c.Assert(err, IsNil)
+
+	image := m.Repository.NewImage(layer)
+	if m.Repository.IsVirtual() {
+		c.Assert(errors.Cause(image.MountReadOnly()), Equals, ErrMountCannotProceed)
+		return
+	}
+
+	for _, test := range []struct {
+		layer *Layer
+		files map[string]string
+	}{
+		{layer, map[string]string{"motd": "layer", "issue": "issue"}},
+		{base, map[string]string{"motd": "base", "issue": "issue"}},
+	} {
+		image := m.Repository.NewImage(test.layer)
+		c.Assert(image.MountReadOnly(), IsNil)
+		c.Assert(image.mount.ReadOnly(), Equals, true)
+
+		for name, content := range test.files {
+			b, err := ioutil.ReadFile(filepath.Join(test.layer.MountPath(), name))
+			c.Assert(err, IsNil)
+			c.Assert(string(b), Equals, content)
+		}
+
+		err := ioutil.WriteFile(filepath.Join(test.layer.MountPath(), "motd"), []byte("changed"), 0644)
+		c.Assert(err, NotNil)
+		c.Assert(image.Unmount(), IsNil)
+
+		// the layer can still be packed to the tar it was unpacked from.
+		dg, err := test.layer.LoadDigest()
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Equals, test.layer.ID())
+	}
+}
@@ -0,0 +1,668 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the number of symlinks resolved in a single lookup before
+// giving up, mirroring the kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// ImageFS is a read-only view of an image's merged filesystem. Paths are
+// resolved through the layer chain in user space, so no mount (and no root)
+// is required. Whiteouts and opaque directories, in both the aufs (.wh.) and
+// overlay (0/0 character device, trusted.overlay.opaque) formats, are honored.
+// Symlinks are resolved relative to the image root.
+//
+// ImageFS implements fs.FS, fs.StatFS, fs.ReadDirFS and fs.ReadLinkFS.
+type ImageFS struct {
+	layers []layerFS
+}
+
+// layerFS is the raw, unmerged view of a single layer. All names are cleaned,
+// slash-separated and relative to the layer root; the root itself is ".".
+type layerFS interface {
+	lstat(name string) (fs.FileInfo, error)
+	readDir(name string) ([]fs.FileInfo, error)
+	readLink(name string) (string, error)
+	open(name string) (fs.File, error)
+	opaque(name string) bool
+}
+
+// FS returns a read-only filesystem view of the image. Both expanded and
+// virtual repositories are supported.
+func (i *Image) FS() *ImageFS {
+	f := &ImageFS{}
+
+	for iter := i.layer; iter != nil; iter = iter.Parent {
+		if iter.repository.IsVirtual() {
+			f.layers = append(f.layers, &virtualLayerFS{path: iter.Path(), files: iter.repository.fs})
+		} else {
+			f.layers = append(f.layers, &rootfsLayerFS{root: iter.Path()})
+		}
+	}
+
+	return f
+}
+
+// Open opens the named file, following symlinks.
+func (f *ImageFS) Open(name string) (fs.File, error) {
+	resolved, fi, idx, err := f.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case fi.IsDir():
+		infos, err := f.readDir(resolved)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		entries := []fs.DirEntry{}
+		for _, info := range infos {
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+
+		return &dirFile{info: renameInfo(fi, path.Base(name)), entries: entries}, nil
+	case fi.Mode().IsRegular():
+		file, err := f.layers[idx].open(resolved)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return file, nil
+	default:
+		return &specialFile{info: fi}, nil
+	}
+}
+
+// Stat returns a fs.FileInfo for the named file, following symlinks.
+func (f *ImageFS) Stat(name string) (fs.FileInfo, error) {
+	_, fi, _, err := f.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return renameInfo(fi, path.Base(name)), nil
+}
+
+// Lstat returns a fs.FileInfo for the named file without following a
+// trailing symlink.
+func (f *ImageFS) Lstat(name string) (fs.FileInfo, error) {
+	_, fi, _, err := f.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return renameInfo(fi, path.Base(name)), nil
+}
+
+// ReadDir reads the merged contents of the named directory, sorted by name.
+func (f *ImageFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, fi, _, err := f.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	infos, err := f.readDir(resolved)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := []fs.DirEntry{}
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+
+	return entries, nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (f *ImageFS) ReadLink(name string) (string, error) {
+	resolved, fi, idx, err := f.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	target, err := f.layers[idx].readLink(resolved)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	return target, nil
+}
+
+// resolve walks name one component at a time, substituting symlinks. It
+// returns the resolved name, its file info and the index of the layer that
+// provides it.
+func (f *ImageFS) resolve(op, name string, followLast bool) (string, fs.FileInfo, int, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var (
+		links    int
+		resolved = "."
+		rest     = strings.Split(name, "/")
+	)
+
+	if name == "." {
+		rest = nil
+	}
+
+	for len(rest) > 0 {
+		component := rest[0]
+		rest = rest[1:]
+
+		next := path.Join(resolved, component)
+		if next == ".." {
+			// symlinks pointing above the root stay at the root.
+			next = "."
+		}
+
+		fi, idx, err := f.lstat(next)
+		if err != nil {
+			return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 && (len(rest) > 0 || followLast) {
+			links++
+			if links > maxSymlinks {
+				return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+
+			target, err := f.layers[idx].readLink(next)
+			if err != nil {
+				return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: err}
+			}
+
+			if path.IsAbs(target) {
+				resolved = "."
+			}
+
+			rest = append(strings.Split(strings.Trim(target, "/"), "/"), rest...)
+			continue
+		}
+
+		if len(rest) > 0 && !fi.IsDir() {
+			return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+
+		resolved = next
+	}
+
+	fi, idx, err := f.lstat(resolved)
+	if err != nil {
+		return "", nil, 0, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	return resolved, fi, idx, nil
+}
+
+// lstat returns the merged file info for name, which must not contain
+// symlinks in its directory components.
+func (f *ImageFS) lstat(name string) (fs.FileInfo, int, error) {
+	stack, err := f.stack(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.layers[stack[0]].lstat(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return fi, stack[0], nil
+}
+
+// stack returns the indexes of the layers that contribute to name, from the
+// top down. Only directories can be provided by more than one layer.
+func (f *ImageFS) stack(name string) ([]int, error) {
+	result := []int{}
+
+	ancestors := []string{}
+	if name != "." {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			ancestors = append([]string{dir}, ancestors...)
+		}
+	}
+
+	for i, layer := range f.layers {
+		var stop bool
+
+		for _, dir := range ancestors {
+			fi, err := layer.lstat(dir)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return nil, err
+				}
+
+				if isLayerWhiteout(layer, dir) {
+					return notEmpty(result)
+				}
+
+				continue
+			}
+
+			if !fi.IsDir() {
+				// files, symlinks and overlay whiteouts all hide anything below
+				// them in lower layers.
+				return notEmpty(result)
+			}
+
+			if layer.opaque(dir) {
+				stop = true
+			}
+		}
+
+		fi, err := layer.lstat(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			if isLayerWhiteout(layer, name) {
+				return notEmpty(result)
+			}
+		} else {
+			if isWhiteoutInfo(fi) {
+				return notEmpty(result)
+			}
+
+			result = append(result, i)
+
+			if !fi.IsDir() || layer.opaque(name) {
+				return result, nil
+			}
+		}
+
+		if stop {
+			break
+		}
+	}
+
+	return notEmpty(result)
+}
+
+func notEmpty(stack []int) ([]int, error) {
+	if len(stack) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	return stack, nil
+}
+
+// readDir merges the directory listings of every layer that contributes to
+// name, removing whiteouts and the entries they hide.
+func (f *ImageFS) readDir(name string) ([]fs.FileInfo, error) {
+	stack, err := f.stack(name)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	result := []fs.FileInfo{}
+
+	for _, idx := range stack {
+		infos, err := f.layers[idx].readDir(name)
+		if err != nil {
+			return nil, err
+		}
+
+		hidden := []string{}
+
+		for _, fi := range infos {
+			if strings.HasPrefix(fi.Name(), archive.WhiteoutMetaPrefix) {
+				continue
+			}
+
+			if strings.HasPrefix(fi.Name(), archive.WhiteoutPrefix) {
+				hidden = append(hidden, strings.TrimPrefix(fi.Name(), archive.WhiteoutPrefix))
+				continue
+			}
+
+			if _, ok := seen[fi.Name()]; ok {
+				continue
+			}
+			seen[fi.Name()] = struct{}{}
+
+			if !isWhiteoutInfo(fi) {
+				result = append(result, fi)
+			}
+		}
+
+		for _, name := range hidden {
+			seen[name] = struct{}{}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+
+	return result, nil
+}
+
+func isLayerWhiteout(layer layerFS, name string) bool {
+	_, err := layer.lstat(path.Join(path.Dir(name), archive.WhiteoutPrefix+path.Base(name)))
+	return err == nil
+}
+
+// isWhiteoutInfo reports whether fi is an overlay-style whiteout: a character
+// device with device number 0/0.
+func isWhiteoutInfo(fi fs.FileInfo) bool {
+	if fi.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+
+	switch sys := fi.Sys().(type) {
+	case *syscall.Stat_t:
+		return sys.Rdev == 0
+	case *tar.Header:
+		return sys.Devmajor == 0 && sys.Devminor == 0
+	}
+
+	return false
+}
+
+type renamedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (r renamedInfo) Name() string {
+	return r.name
+}
+
+func renameInfo(fi fs.FileInfo, name string) fs.FileInfo {
+	if fi.Name() == name {
+		return fi
+	}
+
+	return renamedInfo{FileInfo: fi, name: name}
+}
+
+// dirFile is a merged directory returned by (*ImageFS).Open.
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: syscall.EISDIR}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// specialFile is a device, fifo or socket; it has no readable content.
+type specialFile struct {
+	info fs.FileInfo
+}
+
+func (s *specialFile) Stat() (fs.FileInfo, error) { return s.info, nil }
+func (s *specialFile) Read([]byte) (int, error)   { return 0, io.EOF }
+func (s *specialFile) Close() error               { return nil }
+
+// rootfsLayerFS reads an expanded layer's rootfs directly.
+type rootfsLayerFS struct {
+	root string
+}
+
+func (r *rootfsLayerFS) hostPath(name string) string {
+	return filepath.Join(r.root, filepath.FromSlash(name))
+}
+
+func (r *rootfsLayerFS) lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(r.hostPath(name))
+}
+
+func (r *rootfsLayerFS) readDir(name string) ([]fs.FileInfo, error) {
+	return ioutil.ReadDir(r.hostPath(name))
+}
+
+func (r *rootfsLayerFS) readLink(name string) (string, error) {
+	return os.Readlink(r.hostPath(name))
+}
+
+func (r *rootfsLayerFS) open(name string) (fs.File, error) {
+	return os.Open(r.hostPath(name))
+}
+
+func (r *rootfsLayerFS) opaque(name string) bool {
+	if _, err := os.Lstat(filepath.Join(r.hostPath(name), archive.WhiteoutOpaqueDir)); err == nil {
+		return true
+	}
+
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(r.hostPath(name), overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// virtualEntry is an entry in a virtual layer's tar. pos is the ordinal of the
+// entry in the tar, or -1 for directories implied by other entries.
+type virtualEntry struct {
+	header *tar.Header
+	pos    int
+}
+
+// virtualLayerFS reads a virtual layer's tar. The tar is scanned once to
+// build an in-memory index of its headers; content is read by scanning to the
+// entry.
+type virtualLayerFS struct {
+	path  string
+	files fileSystem
+
+	once     sync.Once
+	err      error
+	entries  map[string]*virtualEntry
+	children map[string][]string
+}
+
+func virtualName(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+func (v *virtualLayerFS) index() error {
+	v.once.Do(func() {
+		v.entries = map[string]*virtualEntry{
+			".": {header: &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(0, 0)}, pos: -1},
+		}
+		v.children = map[string][]string{}
+
+		f, err := v.files.Open(v.path)
+		if err != nil {
+			v.err = err
+			return
+		}
+		defer f.Close()
+
+		tr := tar.NewReader(f)
+		for pos := 0; ; pos++ {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				v.err = err
+				return
+			}
+
+			name := virtualName(header.Name)
+			if name == "." {
+				continue
+			}
+
+			v.add(name, header, pos)
+		}
+	})
+
+	return v.err
+}
+
+func (v *virtualLayerFS) add(name string, header *tar.Header, pos int) {
+	if _, ok := v.entries[name]; !ok {
+		dir := path.Dir(name)
+		v.children[dir] = append(v.children[dir], name)
+
+		if _, ok := v.entries[dir]; !ok {
+			v.add(dir, &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Unix(0, 0)}, -1)
+		}
+	}
+
+	h := *header
+	h.Name = name
+	v.entries[name] = &virtualEntry{header: &h, pos: pos}
+}
+
+func (v *virtualLayerFS) lookup(name string) (*virtualEntry, error) {
+	if err := v.index(); err != nil {
+		return nil, err
+	}
+
+	entry, ok := v.entries[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	if entry.header.Typeflag == tar.TypeLink {
+		target, ok := v.entries[virtualName(entry.header.Linkname)]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+
+		h := *target.header
+		h.Name = name
+		return &virtualEntry{header: &h, pos: target.pos}, nil
+	}
+
+	return entry, nil
+}
+
+func (v *virtualLayerFS) lstat(name string) (fs.FileInfo, error) {
+	entry, err := v.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.header.FileInfo(), nil
+}
+
+func (v *virtualLayerFS) readDir(name string) ([]fs.FileInfo, error) {
+	if err := v.index(); err != nil {
+		return nil, err
+	}
+
+	infos := []fs.FileInfo{}
+	for _, child := range v.children[name] {
+		fi, err := v.lstat(child)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+
+	return infos, nil
+}
+
+func (v *virtualLayerFS) readLink(name string) (string, error) {
+	entry, err := v.lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	if entry.header.Typeflag != tar.TypeSymlink {
+		return "", fs.ErrInvalid
+	}
+
+	return entry.header.Linkname, nil
+}
+
+func (v *virtualLayerFS) open(name string) (fs.File, error) {
+	entry, err := v.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := v.files.Open(v.path)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(f)
+	for pos := 0; pos <= entry.pos; pos++ {
+		if _, err := tr.Next(); err != nil {
+			f.Close()
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	return &virtualFile{info: entry.header.FileInfo(), reader: tr, file: f}, nil
+}
+
+func (v *virtualLayerFS) opaque(name string) bool {
+	if _, err := v.lookup(path.Join(name, archive.WhiteoutOpaqueDir)); err == nil {
+		return true
+	}
+
+	entry, err := v.lookup(name)
+	return err == nil && entry.header.Xattrs[overlayOpaqueXattr] == "y"
+}
+
+// virtualFile is a regular file read out of a virtual layer's tar.
+type virtualFile struct {
+	info   fs.FileInfo
+	reader io.Reader
+	file   file
+}
+
+func (v *virtualFile) Stat() (fs.FileInfo, error) { return v.info, nil }
+func (v *virtualFile) Read(p []byte) (int, error) { return v.reader.Read(p) }
+func (v *virtualFile) Close() error               { return v.file.Close() }
@@ -0,0 +1,117 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"testing/fstest"
+
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestImageFS(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "usr/", typeflag: tar.TypeDir},
+		{name: "usr/lib/", typeflag: tar.TypeDir},
+		{name: "usr/lib/os-release", content: "ID=base", typeflag: tar.TypeReg},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/os-release", linkname: "../usr/lib/os-release", typeflag: tar.TypeSymlink},
+		{name: "etc/passwd", content: "root", typeflag: tar.TypeReg},
+		{name: "etc/shadow", content: "secret", typeflag: tar.TypeReg},
+		{name: "lib", linkname: "/usr/lib", typeflag: tar.TypeSymlink},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/stale", content: "stale", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	top, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/.wh.shadow", typeflag: tar.TypeReg},
+		{name: "etc/hosts", content: "localhost", typeflag: tar.TypeReg},
+		{name: "etc/hostname", linkname: "etc/hosts", typeflag: tar.TypeLink},
+		{name: "usr/lib/os-release", content: "ID=top", typeflag: tar.TypeReg},
+		{name: "var/cache/", typeflag: tar.TypeDir},
+		{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "var/cache/fresh", content: "fresh", typeflag: tar.TypeReg},
+		{name: "loop", linkname: "loop", typeflag: tar.TypeSymlink},
+	}), base, false)
+	c.Assert(err, IsNil)
+
+	fsys := m.Repository.NewImage(top).FS()
+
+	content, err := fs.ReadFile(fsys, "etc/os-release")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "ID=top")
+
+	content, err = fs.ReadFile(fsys, "lib/os-release")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "ID=top")
+
+	content, err = fs.ReadFile(fsys, "etc/passwd")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "root")
+
+	content, err = fs.ReadFile(fsys, "etc/hostname")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "localhost")
+
+	_, err = fsys.Stat("etc/shadow")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = fsys.Open("etc/shadow")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = fsys.Stat("var/cache/stale")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = fsys.Stat("loop")
+	c.Assert(err, NotNil)
+	_, err = fsys.Stat("/etc/passwd")
+	c.Assert(err, NotNil)
+
+	link, err := fsys.ReadLink("etc/os-release")
+	c.Assert(err, IsNil)
+	c.Assert(link, Equals, "../usr/lib/os-release")
+	_, err = fsys.ReadLink("etc/passwd")
+	c.Assert(err, NotNil)
+
+	fi, err := fsys.Lstat("lib")
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode()&fs.ModeSymlink, Not(Equals), fs.FileMode(0))
+	fi, err = fsys.Stat("lib")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+	c.Assert(fi.Name(), Equals, "lib")
+
+	names := func(dir string) []string {
+		entries, err := fsys.ReadDir(dir)
+		c.Assert(err, IsNil)
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Name())
+		}
+		return result
+	}
+
+	c.Assert(names("etc"), DeepEquals, []string{"hostname", "hosts", "os-release", "passwd"})
+	c.Assert(names("var/cache"), DeepEquals, []string{"fresh"})
+	c.Assert(names("lib"), DeepEquals, []string{"os-release"})
+	c.Assert(names("."), DeepEquals, []string{"etc", "lib", "loop", "usr", "var"})
+
+	dir, err := fsys.Open("etc")
+	c.Assert(err, IsNil)
+	entries, err := dir.(fs.ReadDirFile).ReadDir(-1)
+	c.Assert(err, IsNil)
+	c.Assert(len(entries), Equals, 4)
+	c.Assert(dir.Close(), IsNil)
+
+	f, err := fsys.Open("usr/lib/os-release")
+	c.Assert(err, IsNil)
+	content, err = ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "ID=top")
+	c.Assert(f.Close(), IsNil)
+
+	etc, err := fs.Sub(fsys, "etc")
+	c.Assert(err, IsNil)
+	c.Assert(fstest.TestFS(etc, "passwd", "hostname", "os-release"), IsNil)
+}
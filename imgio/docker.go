@@ -1,13 +1,18 @@
 package imgio
 
-import "github.com/docker/docker/client"
+import (
+	om "github.com/box-builder/overmount"
+	"github.com/docker/docker/client"
+)
 
 // Docker implements image i/o (overmount.Importer and overmount.Exporter)
 // through docker. Note that no attempt will be made to pull the images from
 // remote sources; they must exist on your client's daemon before they can be
 // used by this import/export interface.
 type Docker struct {
-	client *client.Client
+	client        *client.Client
+	packOptions   *om.PackOptions
+	unpackOptions *om.UnpackOptions
 }
 
 // NewDocker creates a new *Docker for use. If c is nil,
@@ -23,3 +28,16 @@ func NewDocker(c *client.Client) (*Docker, error) {
 
 	return &Docker{client: c}, nil
 }
+
+// SetPackOptions sets the options used to pack layers on export, such as
+// path filters to leave caches or secrets out of the layers. In reproducible
+// mode, the times in the image config and its history are clamped as well.
+func (d *Docker) SetPackOptions(opts *om.PackOptions) {
+	d.packOptions = opts
+}
+
+// SetUnpackOptions sets the options used to unpack layers on import, such as
+// limits for images from untrusted sources.
+func (d *Docker) SetUnpackOptions(opts *om.UnpackOptions) {
+	d.unpackOptions = opts
+}
@@ -23,6 +23,11 @@ func (d *Docker) Export(repo *om.Repository, layer *om.Layer, tags []string) (io
 		return nil, errors.Wrap(om.ErrInvalidLayer, "layer does not exist")
 	}
 
+	// docker identifies images and layers by their SHA-256 digests only.
+	if alg := repo.DigestAlgorithm(); alg != digest.SHA256 {
+		return nil, errors.Wrapf(om.ErrDigestAlgorithm, "%v layers cannot be exported to docker", alg)
+	}
+
 	r, w := io.Pipe()
 	go d.writeTar(repo, layer, w, tags)
 
@@ -40,10 +45,10 @@ func (d *Docker) writeTar(repo *om.Repository, layer *om.Layer, w *io.PipeWriter
 
 	tw := tar.NewWriter(w)
 
-	chainIDs, diffIDs, _, _, err := runChain(layer, tw, func(parent digest.Digest, iter *om.Layer, tw *tar.Writer) (digest.Digest, digest.Digest, int64, error) {
+	chainIDs, diffIDs, _, _, layers, err := runChain(layer, tw, func(parent digest.Digest, iter *om.Layer, tw *tar.Writer) (digest.Digest, digest.Digest, digest.Digest, int64, error) {
 		tf, err := repo.TempFile()
 		if err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		defer func() {
@@ -51,20 +56,20 @@ func (d *Docker) writeTar(repo *om.Repository, layer *om.Layer, w *io.PipeWriter
 			os.Remove(tf.Name())
 		}()
 
-		chainID, diffID, err := calcLayer(parent, iter, tf)
+		chainID, diffID, blobID, err := calcLayer(parent, iter, tf, d.packOptions)
 		if err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		if err := d.packLayer(chainID, tf, tw); err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		if err := d.writeLayerConfig(chainID, parent, iter, tw); err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
-		return chainID, diffID, 0, nil
+		return chainID, diffID, blobID, 0, nil
 	})
 	if err != nil {
 		return err
@@ -78,7 +83,12 @@ func (d *Docker) writeTar(repo *om.Repository, layer *om.Layer, w *io.PipeWriter
 		return err
 	}
 
-	if err := d.writeImageConfig(chainIDs[len(chainIDs)-1], diffIDs, layer, tw); err != nil {
+	history, err := chainHistory(layers)
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeImageConfig(chainIDs[len(chainIDs)-1], diffIDs, layers, history, layer, tw); err != nil {
 		return err
 	}
 
@@ -217,7 +227,7 @@ func (d *Docker) writeManifest(layer *om.Layer, chainIDs []digest.Digest, tw *ta
 	return nil
 }
 
-func (d *Docker) writeImageConfig(chainID digest.Digest, diffIDs []digest.Digest, layer *om.Layer, tw *tar.Writer) error {
+func (d *Docker) writeImageConfig(chainID digest.Digest, diffIDs []digest.Digest, layers []*om.Layer, history []*om.LayerHistory, layer *om.Layer, tw *tar.Writer) error {
 	config, err := layer.Config()
 	if err != nil {
 		return errors.Wrap(om.ErrInvalidLayer, err.Error())
@@ -232,6 +242,11 @@ func (d *Docker) writeImageConfig(chainID digest.Digest, diffIDs []digest.Digest
 		return errors.Wrap(om.ErrInvalidLayer, err.Error())
 	}
 
+	img.Created, err = d.packOptions.ClampTime(img.Created)
+	if err != nil {
+		return err
+	}
+
 	dids := []dl.DiffID{}
 	for _, diff := range diffIDs {
 		dids = append(dids, dl.DiffID(diff))
@@ -246,6 +261,21 @@ func (d *Docker) writeImageConfig(chainID digest.Digest, diffIDs []digest.Digest
 		Parent: image.ID(config.Parent),
 	}
 
+	entries, err := imageHistory(layers, history, config, d.packOptions)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		outerConfig.History = append(outerConfig.History, image.History{
+			Created:    entry.Created,
+			Author:     entry.Author,
+			CreatedBy:  entry.CreatedBy,
+			Comment:    entry.Comment,
+			EmptyLayer: entry.EmptyLayer,
+		})
+	}
+
 	content, err := json.Marshal(outerConfig)
 	if err != nil {
 		return err
@@ -29,6 +29,11 @@ type unpackedImage struct {
 // it into the overmount repository.  Returns the top-most layer and any
 // error.
 func (d *Docker) Import(r *om.Repository, reader io.ReadCloser) ([]*om.Layer, error) {
+	// docker identifies layers by their SHA-256 digests only.
+	if alg := r.DigestAlgorithm(); alg != digest.SHA256 {
+		return nil, errors.Wrapf(om.ErrDigestAlgorithm, "docker images cannot be imported into %v repositories", alg)
+	}
+
 	tempdir, err := r.TempDir()
 	if err != nil {
 		return nil, err
@@ -73,8 +78,15 @@ func (d *Docker) constructImage(r *om.Repository, up *unpackedImage) ([]*om.Laye
 			return nil, errors.New("top layer doesn't appear to exist")
 		}
 
+		steps, err := importHistory(img, digestMap)
+		if err != nil {
+			return nil, err
+		}
+
 		// force a write on the top layer.
-		if err := top.SaveConfig(configmap.FromDockerV1(&img.V1Image)); err != nil {
+		config := configmap.FromDockerV1(&img.V1Image)
+		config.ConfigSteps = steps
+		if err := top.SaveConfig(config); err != nil {
 			return nil, err
 		}
 
@@ -104,6 +116,107 @@ func (d *Docker) constructImage(r *om.Repository, up *unpackedImage) ([]*om.Laye
 	return layers, nil
 }
 
+// importHistory saves the history entries of img with the layers they
+// belong to. Empty layer entries are image-scoped; they are returned as config
+// steps, to be saved with the configuration of the top layer.
+func importHistory(img *image.Image, digestMap map[digest.Digest]*om.Layer) ([]om.ConfigStep, error) {
+	var (
+		i     int
+		after string
+		steps = []om.ConfigStep{}
+	)
+
+	for _, entry := range img.History {
+		record := om.LayerHistory{
+			Created:    entry.Created,
+			CreatedBy:  entry.CreatedBy,
+			Author:     entry.Author,
+			Comment:    entry.Comment,
+			EmptyLayer: entry.EmptyLayer,
+		}
+
+		if entry.EmptyLayer {
+			steps = append(steps, om.ConfigStep{LayerHistory: record, After: after})
+			continue
+		}
+
+		if i >= len(img.RootFS.DiffIDs) {
+			return nil, errors.New("image history has more layers than the image")
+		}
+
+		layer, ok := digestMap[digest.Digest(img.RootFS.DiffIDs[i])]
+		i++
+		if !ok {
+			continue
+		}
+		after = layer.ID()
+
+		h, err := layer.History()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			h = &om.LayerHistory{}
+		}
+
+		h.Created = record.Created
+		h.CreatedBy = record.CreatedBy
+		h.Author = record.Author
+		h.Comment = record.Comment
+
+		if err := layer.SaveHistory(h); err != nil {
+			return nil, err
+		}
+	}
+
+	return steps, nil
+}
+
+// expectedDiffIDs maps the layer tars listed in the manifest of the unpacked
+// image at tempdir to the diffIDs the image config expects them to have.
+func expectedDiffIDs(tempdir string) (map[string]digest.Digest, error) {
+	diffIDs := map[string]digest.Digest{}
+
+	content, err := ioutil.ReadFile(filepath.Join(tempdir, "manifest.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return diffIDs, nil
+		}
+		return nil, err
+	}
+
+	manifest := []struct {
+		Config string
+		Layers []string
+	}{}
+
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+
+	for _, item := range manifest {
+		content, err := ioutil.ReadFile(filepath.Join(tempdir, filepath.Clean("/"+item.Config)))
+		if err != nil {
+			return nil, err
+		}
+
+		img := &image.Image{}
+		if err := json.Unmarshal(content, img); err != nil {
+			return nil, err
+		}
+
+		if img.RootFS == nil || len(img.RootFS.DiffIDs) != len(item.Layers) {
+			return nil, errors.New("image config does not match the manifest")
+		}
+
+		for i, layer := range item.Layers {
+			diffIDs[filepath.Clean(layer)] = digest.Digest(img.RootFS.DiffIDs[i])
+		}
+	}
+
+	return diffIDs, nil
+}
+
 func (d *Docker) unpackLayers(r *om.Repository, tempdir string) (*unpackedImage, error) {
 	up := &unpackedImage{
 		tempdir:        tempdir,
@@ -113,7 +226,12 @@ func (d *Docker) unpackLayers(r *om.Repository, tempdir string) (*unpackedImage,
 		tagMap:         map[digest.Digest][]string{},
 	}
 
-	err := filepath.Walk(tempdir, func(p string, fi os.FileInfo, err error) error {
+	diffIDs, err := expectedDiffIDs(tempdir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(tempdir, func(p string, fi os.FileInfo, err error) error {
 		if path.Base(p) == "layer.tar" {
 			f, err := os.Open(filepath.Join(path.Dir(p), "json"))
 			if err != nil {
@@ -145,7 +263,19 @@ func (d *Docker) unpackLayers(r *om.Repository, tempdir string) (*unpackedImage,
 				return err
 			}
 
-			layer, err := r.CreateLayerFromAsset(f, nil, true)
+			opts := om.UnpackOptions{}
+			if d.unpackOptions != nil {
+				opts = *d.unpackOptions
+			}
+
+			rel, err := filepath.Rel(tempdir, p)
+			if err != nil {
+				f.Close()
+				return err
+			}
+			opts.ExpectedDigest = diffIDs[rel]
+
+			layer, err := r.CreateLayerFromAssetWithOptions(f, nil, true, &opts)
 			f.Close()
 			if err != nil {
 				return err
@@ -1,10 +1,21 @@
 package imgio
 
+import om "github.com/box-builder/overmount"
+
 // OCI implements writing to OCI format image trees. These trees are then
 // tarred and compressed for distribution purposes.
-type OCI struct{}
+type OCI struct {
+	packOptions *om.PackOptions
+}
 
 // NewOCI creates a new *OCI.
 func NewOCI() *OCI {
 	return &OCI{}
 }
+
+// SetPackOptions sets the options used to pack layers on export, such as
+// path filters to leave caches or secrets out of the layers. In reproducible
+// mode, the times in the image config and its history are clamped as well.
+func (o *OCI) SetPackOptions(opts *om.PackOptions) {
+	o.packOptions = opts
+}
@@ -17,9 +17,8 @@ import (
 const (
 	ociSchemaVersion  = 2
 	refsDir           = "refs"
-	blobsDir          = "blobs/sha256"
+	blobsDir          = "blobs"
 	tempfilePrefix    = "overmount-pack-"
-	layerMediaType    = "application/vnd.oci.image.layer.v1.tar"
 	configMediaType   = "application/vnd.oci.image.config.v1+json"
 	manifestMediaType = "application/vnd.oci.image.manifest.v1+json"
 )
@@ -36,7 +35,22 @@ func (o *OCI) Export(repo *om.Repository, layer *om.Layer, tags []string) (io.Re
 	return r, nil
 }
 
-func (o *OCI) writeImageConfig(layer *om.Layer, tw *tar.Writer, diffIDs []digest.Digest) (digest.Digest, int64, error) {
+// layerMediaType returns the media type of the layer blobs for the
+// compression in the pack options. The OCI spec only knows gzip and zstd.
+func (o *OCI) layerMediaType() (string, error) {
+	if o.packOptions == nil {
+		return om.LayerMediaType, nil
+	}
+
+	switch o.packOptions.Compression {
+	case om.Uncompressed, om.Gzip, om.Zstd:
+		return o.packOptions.Compression.MediaType(), nil
+	}
+
+	return "", errors.Wrapf(om.ErrImageCannotBeComposed, "%v layers cannot be exported to OCI", o.packOptions.Compression)
+}
+
+func (o *OCI) writeImageConfig(layer *om.Layer, alg digest.Algorithm, tw *tar.Writer, diffIDs []digest.Digest, layers []*om.Layer, history []*om.LayerHistory) (digest.Digest, int64, error) {
 	config, err := layer.Config()
 	if err != nil {
 		return "", 0, err
@@ -44,27 +58,54 @@ func (o *OCI) writeImageConfig(layer *om.Layer, tw *tar.Writer, diffIDs []digest
 
 	oci := configmap.ToOCIV1(config)
 
+	created, err := o.packOptions.ClampTime(config.Created)
+	if err != nil {
+		return "", 0, err
+	}
+	oci.Created = &created
+
 	oci.RootFS = v1.RootFS{
 		Type:    "layers",
 		DiffIDs: diffIDs,
 	}
 
-	return o.writeJSONBlob(oci, tw)
+	entries, err := imageHistory(layers, history, config, o.packOptions)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, entry := range entries {
+		ociEntry := v1.History{
+			Author:     entry.Author,
+			CreatedBy:  entry.CreatedBy,
+			Comment:    entry.Comment,
+			EmptyLayer: entry.EmptyLayer,
+		}
+
+		if !entry.Created.IsZero() {
+			created := entry.Created
+			ociEntry.Created = &created
+		}
+
+		oci.History = append(oci.History, ociEntry)
+	}
+
+	return o.writeJSONBlob(oci, alg, tw)
 }
 
-func (o *OCI) writePrefix(tw *tar.Writer) error {
-	if err := o.writeDirs(tw); err != nil {
+func (o *OCI) writePrefix(alg digest.Algorithm, tw *tar.Writer) error {
+	if err := o.writeDirs(alg, tw); err != nil {
 		return err
 	}
 
 	return o.writeImageLayout(tw)
 }
 
-func (o *OCI) writeLayers(repo *om.Repository, layer *om.Layer, tw *tar.Writer) ([]digest.Digest, []digest.Digest, []int64, []*om.Layer, error) {
-	return runChain(layer, tw, func(parent digest.Digest, iter *om.Layer, tw *tar.Writer) (digest.Digest, digest.Digest, int64, error) {
+func (o *OCI) writeLayers(repo *om.Repository, layer *om.Layer, tw *tar.Writer) ([]digest.Digest, []digest.Digest, []digest.Digest, []int64, []*om.Layer, error) {
+	return runChain(layer, tw, func(parent digest.Digest, iter *om.Layer, tw *tar.Writer) (digest.Digest, digest.Digest, digest.Digest, int64, error) {
 		tf, err := repo.TempFile()
 		if err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		defer func() {
@@ -72,49 +113,54 @@ func (o *OCI) writeLayers(repo *om.Repository, layer *om.Layer, tw *tar.Writer)
 			os.Remove(tf.Name())
 		}()
 
-		chainID, diffID, err := calcLayer(parent, iter, tf)
+		chainID, diffID, blobID, err := calcLayer(parent, iter, tf, o.packOptions)
 		if err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		if _, err := tf.Seek(0, 0); err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		fi, err := tf.Stat()
 		if err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
 		err = tw.WriteHeader(&tar.Header{
-			Name:     path.Join(blobsDir, diffID.Hex()),
+			Name:     blobPath(blobID),
 			Mode:     0600,
 			Typeflag: tar.TypeReg,
 			Size:     fi.Size(),
 		})
 
 		if err != nil {
-			return "", "", 0, errors.Wrap(om.ErrImageCannotBeComposed, "cannot add file to tar writer")
+			return "", "", "", 0, errors.Wrap(om.ErrImageCannotBeComposed, "cannot add file to tar writer")
 		}
 
 		if _, err := io.Copy(tw, tf); err != nil {
-			return "", "", 0, err
+			return "", "", "", 0, err
 		}
 
-		return chainID, diffID, fi.Size(), nil
+		return chainID, diffID, blobID, fi.Size(), nil
 	})
 }
 
-func (o *OCI) writeJSONBlob(obj interface{}, tw *tar.Writer) (digest.Digest, int64, error) {
+// blobPath returns the path of the blob with digest dg in the image layout.
+func blobPath(dg digest.Digest) string {
+	return path.Join(blobsDir, dg.Algorithm().String(), dg.Hex())
+}
+
+func (o *OCI) writeJSONBlob(obj interface{}, alg digest.Algorithm, tw *tar.Writer) (digest.Digest, int64, error) {
 	content, err := json.Marshal(obj)
 	if err != nil {
 		return "", 0, err
 	}
 
-	dg := digest.FromBytes(content)
+	dg := alg.FromBytes(content)
 
 	err = tw.WriteHeader(&tar.Header{
-		Name:     path.Join(blobsDir, dg.Hex()),
+		Name:     blobPath(dg),
 		Mode:     0600,
 		Typeflag: tar.TypeReg,
 		Size:     int64(len(content)),
@@ -155,9 +201,9 @@ func (o *OCI) writeJSONTar(filename string, obj interface{}, tw *tar.Writer) (di
 	return dg, nil
 }
 
-func (o *OCI) writeDirs(tw *tar.Writer) error {
+func (o *OCI) writeDirs(alg digest.Algorithm, tw *tar.Writer) error {
 	err := tw.WriteHeader(&tar.Header{
-		Name:     "blobs",
+		Name:     blobsDir,
 		Mode:     0700,
 		Typeflag: tar.TypeDir,
 	})
@@ -165,7 +211,7 @@ func (o *OCI) writeDirs(tw *tar.Writer) error {
 		return err
 	}
 	err = tw.WriteHeader(&tar.Header{
-		Name:     blobsDir,
+		Name:     path.Join(blobsDir, alg.String()),
 		Mode:     0700,
 		Typeflag: tar.TypeDir,
 	})
@@ -185,9 +231,9 @@ func (o *OCI) writeImageLayout(tw *tar.Writer) error {
 	return nil
 }
 
-func (o *OCI) writeManifest(manifest v1.Manifest, tw *tar.Writer) (digest.Digest, int64, error) {
+func (o *OCI) writeManifest(manifest v1.Manifest, alg digest.Algorithm, tw *tar.Writer) (digest.Digest, int64, error) {
 	manifest.SchemaVersion = 2
-	return o.writeJSONBlob(manifest, tw)
+	return o.writeJSONBlob(manifest, alg, tw)
 }
 
 func (o *OCI) write(repo *om.Repository, w *io.PipeWriter, layer *om.Layer, tags []string) (retErr error) {
@@ -201,25 +247,39 @@ func (o *OCI) write(repo *om.Repository, w *io.PipeWriter, layer *om.Layer, tags
 	defer w.Close()
 	defer tw.Close()
 
-	if err := o.writePrefix(tw); err != nil {
+	// all blobs are addressed with the digest algorithm of the repository.
+	alg := repo.DigestAlgorithm()
+
+	if err := o.writePrefix(alg, tw); err != nil {
+		return err
+	}
+
+	mediaType, err := o.layerMediaType()
+	if err != nil {
+		return err
+	}
+
+	_, diffIDs, blobIDs, sizes, layers, err := o.writeLayers(repo, layer, tw)
+	if err != nil {
 		return err
 	}
 
-	_, diffIDs, sizes, _, err := o.writeLayers(repo, layer, tw)
+	history, err := chainHistory(layers)
 	if err != nil {
 		return err
 	}
 
 	layerDescriptors := []v1.Descriptor{}
-	for i, diff := range diffIDs {
+	for i, blob := range blobIDs {
 		layerDescriptors = append(layerDescriptors, v1.Descriptor{
-			MediaType: layerMediaType,
-			Digest:    diff,
-			Size:      sizes[i],
+			MediaType:   mediaType,
+			Digest:      blob,
+			Size:        sizes[i],
+			Annotations: history[i].Annotations,
 		})
 	}
 
-	configHash, configSize, err := o.writeImageConfig(layer, tw, diffIDs)
+	configHash, configSize, err := o.writeImageConfig(layer, alg, tw, diffIDs, layers, history)
 	if err != nil {
 		return err
 	}
@@ -233,7 +293,7 @@ func (o *OCI) write(repo *om.Repository, w *io.PipeWriter, layer *om.Layer, tags
 		Layers: layerDescriptors,
 	}
 
-	manifestHash, manifestSize, err := o.writeManifest(manifest, tw)
+	manifestHash, manifestSize, err := o.writeManifest(manifest, alg, tw)
 	if err != nil {
 		return err
 	}
@@ -6,28 +6,79 @@ import (
 
 	om "github.com/box-builder/overmount"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 )
 
-func calcLayer(parentDigest digest.Digest, iter *om.Layer, tf *os.File) (digest.Digest, digest.Digest, error) {
-	packDigest, err := iter.Pack(tf)
+// calcLayer packs iter to tf and returns the chain ID, the diff ID and the
+// digest of the (possibly compressed) blob written to tf.
+func calcLayer(parentDigest digest.Digest, iter *om.Layer, tf *os.File, opts *om.PackOptions) (digest.Digest, digest.Digest, digest.Digest, error) {
+	packDigest, err := iter.PackWithOptions(tf, opts)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
 	hexDigest := ""
 	if parentDigest != "" {
+		if parentDigest.Algorithm() != packDigest.Algorithm() {
+			return "", "", "", errors.Wrapf(om.ErrDigestAlgorithm, "layer %v uses %v, its parent uses %v", iter.ID(), packDigest.Algorithm(), parentDigest.Algorithm())
+		}
 		hexDigest = parentDigest.Hex()
 	}
 
-	chainID := digest.FromBytes([]byte(string(hexDigest) + " " + string(packDigest.Hex())))
+	// the chain ID uses the algorithm of the layers.
+	chainID := packDigest.Algorithm().FromBytes([]byte(string(hexDigest) + " " + string(packDigest.Hex())))
+
+	return chainID, packDigest, iter.CompressedDigest(), nil
+}
+
+// chainHistory returns the history records of layers, as returned by
+// runChain, from the bottom up. Layers without one get an empty record.
+func chainHistory(layers []*om.Layer) ([]*om.LayerHistory, error) {
+	history := []*om.LayerHistory{}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		h, err := layers[i].History()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			h = &om.LayerHistory{}
+		}
+
+		history = append(history, h)
+	}
+
+	return history, nil
+}
+
+// imageHistory returns the history entries of an image: the records of its
+// layers, as returned by chainHistory for layers, with the config steps of
+// config after the layers they were taken on. Their times are clamped as
+// opts.ClampTime does.
+func imageHistory(layers []*om.Layer, history []*om.LayerHistory, config *om.ImageConfig, opts *om.PackOptions) ([]om.LayerHistory, error) {
+	entries := config.StepsAfter("")
+
+	for i, h := range history {
+		entries = append(entries, *h)
+		entries = append(entries, config.StepsAfter(layers[len(layers)-1-i].ID())...)
+	}
+
+	for i := range entries {
+		created, err := opts.ClampTime(entries[i].Created)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Created = created
+	}
 
-	return chainID, packDigest, nil
+	return entries, nil
 }
 
-func runChain(layer *om.Layer, tw *tar.Writer, run func(digest.Digest, *om.Layer, *tar.Writer) (digest.Digest, digest.Digest, int64, error)) ([]digest.Digest, []digest.Digest, []int64, []*om.Layer, error) {
+func runChain(layer *om.Layer, tw *tar.Writer, run func(digest.Digest, *om.Layer, *tar.Writer) (digest.Digest, digest.Digest, digest.Digest, int64, error)) ([]digest.Digest, []digest.Digest, []digest.Digest, []int64, []*om.Layer, error) {
 	layers := []*om.Layer{}
 	chainIDs := []digest.Digest{}
 	diffIDs := []digest.Digest{}
+	blobIDs := []digest.Digest{}
 	sizes := []int64{}
 
 	var parent digest.Digest
@@ -39,17 +90,18 @@ func runChain(layer *om.Layer, tw *tar.Writer, run func(digest.Digest, *om.Layer
 
 	for i := len(layers) - 1; i >= 0; i-- {
 		iter := layers[i]
-		chainID, diffID, size, err := run(parent, iter, tw)
+		chainID, diffID, blobID, size, err := run(parent, iter, tw)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return nil, nil, nil, nil, nil, err
 		}
 
 		chainIDs = append(chainIDs, chainID)
 		diffIDs = append(diffIDs, diffID)
+		blobIDs = append(blobIDs, blobID)
 		sizes = append(sizes, size)
 
 		parent = chainID
 	}
 
-	return chainIDs, diffIDs, sizes, layers, nil
+	return chainIDs, diffIDs, blobIDs, sizes, layers, nil
 }
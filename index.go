@@ -0,0 +1,356 @@
+package overmount
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// indexSuffix is appended to a virtual asset's path to find its index. For
+// layers, this places it next to the layer.tar.
+const indexSuffix = ".index.json"
+
+// tarBlockSize is the size of the blocks tar entries are aligned to.
+const tarBlockSize = 512
+
+// maxLinkDepth is the number of hardlinks Open follows to find the contents of
+// an entry.
+const maxLinkDepth = 32
+
+// indexEntry records where an entry of a virtual asset's tar is stored.
+type indexEntry struct {
+	Header *tar.Header `json:"header"`
+
+	// Offset is the offset of the first header block of the entry, including
+	// any extended headers.
+	Offset int64 `json:"offset"`
+
+	// DataOffset is the offset of the contents of the entry.
+	DataOffset int64 `json:"data_offset"`
+}
+
+func (a *Asset) indexPath() string {
+	return a.path + indexSuffix
+}
+
+// recordIndex returns a writer which indexes the tar written to it. The
+// returned function must be called once the tar was written; it stores the
+// index. A stream that cannot be indexed is not an error here, as Open and List
+// retry, and fail, on their own.
+func (a *Asset) recordIndex() (io.Writer, func() error) {
+	pr, pw := io.Pipe()
+	done := make(chan []indexEntry, 1)
+
+	go func() {
+		index, err := indexTar(pr)
+		if err != nil {
+			index = nil
+		}
+
+		io.Copy(ioutil.Discard, pr)
+		done <- index
+	}()
+
+	return pw, func() error {
+		pw.Close()
+		index := <-done
+
+		if index == nil {
+			return a.removeIndex()
+		}
+
+		return a.saveIndex(index)
+	}
+}
+
+// indexTar reads the tar in reader and records where each of its entries is
+// stored.
+func indexTar(reader io.Reader) ([]indexEntry, error) {
+	cw := &countWriter{}
+	tr := tar.NewReader(io.TeeReader(reader, cw))
+
+	index := []indexEntry{}
+
+	for {
+		// the contents of the last entry were read in full, so the next
+		// header starts at the next block.
+		offset := (cw.n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+
+		header, err := tr.Next()
+		if err == io.EOF {
+			return index, nil
+		} else if err != nil {
+			return nil, errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+
+		index = append(index, indexEntry{Header: header, Offset: offset, DataOffset: cw.n})
+
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return nil, errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+	}
+}
+
+func (a *Asset) saveIndex(index []indexEntry) error {
+	f, err := a.fs.Create(a.indexPath())
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(index); err != nil {
+		f.Close()
+		a.fs.Remove(f.Name())
+		return err
+	}
+
+	return f.Close()
+}
+
+// loadIndex returns the index of the virtual asset, building and storing it
+// first if the tar was not indexed when it was unpacked.
+func (a *Asset) loadIndex() ([]indexEntry, error) {
+	if err := a.checkVirtualSymlink(); err != nil {
+		return nil, err
+	}
+
+	var index []indexEntry
+
+	f, err := a.fs.Open(a.indexPath())
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&index); err == nil {
+			return index, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tf, err := a.fs.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer tf.Close()
+
+	index, err = indexTar(tf)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index is only a cache; failing to store it is not fatal.
+	a.saveIndex(index)
+
+	return index, nil
+}
+
+// removeIndex discards the index.
+func (a *Asset) removeIndex() error {
+	if err := a.fs.Remove(a.indexPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// List returns the headers of all entries of the asset. For virtual assets,
+// they are read from the index recorded by Unpack, so the tar is not scanned,
+// and are in the order of the tar. Expanded assets are walked, and their
+// headers are made up from the files.
+func (a *Asset) List() ([]*tar.Header, error) {
+	if !a.virtual {
+		return a.listDir()
+	}
+
+	index, err := a.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	headers := []*tar.Header{}
+	for _, entry := range index {
+		headers = append(headers, entry.Header)
+	}
+
+	return headers, nil
+}
+
+// Open opens the regular file at p, relative to the root of the asset, for
+// reading. For virtual assets, the index recorded by Unpack is used to read
+// the file straight from its place in the tar. As in a tar, the last entry
+// for p wins; hardlinks are followed, but symlinks are not. If there is no
+// such entry, the error satisfies os.IsNotExist.
+func (a *Asset) Open(p string) (io.ReadCloser, error) {
+	name := cleanEntryName(p)
+
+	if !a.virtual {
+		return a.openDir(name)
+	}
+
+	index, err := a.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := findEntry(index, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := a.fs.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+
+	size := entry.Header.Size
+	if !isSparseHeader(entry.Header) {
+		return readCloser{Reader: io.NewSectionReader(f, entry.DataOffset, size), Closer: f}, nil
+	}
+
+	// sparse files have to be reassembled by the tar reader.
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	tr := tar.NewReader(io.NewSectionReader(f, entry.Offset, fi.Size()-entry.Offset))
+	if _, err := tr.Next(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(ErrInvalidAsset, "cannot read %q: %v", p, err)
+	}
+
+	return readCloser{Reader: tr, Closer: f}, nil
+}
+
+// List returns the headers of all entries in the layer. See Asset.List.
+func (l *Layer) List() ([]*tar.Header, error) {
+	return l.asset.List()
+}
+
+// Open opens the regular file at p in the layer for reading. See Asset.Open.
+func (l *Layer) Open(p string) (io.ReadCloser, error) {
+	return l.asset.Open(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func findEntry(index []indexEntry, name string) (*indexEntry, error) {
+	for depth := 0; depth < maxLinkDepth; depth++ {
+		var found *indexEntry
+
+		for i := len(index) - 1; i >= 0; i-- {
+			if cleanEntryName(index[i].Header.Name) == name {
+				found = &index[i]
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+
+		switch found.Header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			return found, nil
+		case tar.TypeLink:
+			name = cleanEntryName(found.Header.Linkname)
+		default:
+			return nil, errors.Wrapf(ErrInvalidAsset, "%q is not a regular file", name)
+		}
+	}
+
+	return nil, errors.Wrapf(ErrInvalidAsset, "too many links to follow for %q", name)
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (a *Asset) openDir(name string) (io.ReadCloser, error) {
+	if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
+		return nil, err
+	}
+
+	root, err := filepath.EvalSymlinks(a.path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(name))
+
+	// symlinks could point anywhere, including outside of the asset.
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolved != p {
+		return nil, errors.Wrapf(ErrInvalidAsset, "%q is a symlink or below one", name)
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, errors.Wrapf(ErrInvalidAsset, "%q is not a regular file", name)
+	}
+
+	return os.Open(p)
+}
+
+func (a *Asset) listDir() ([]*tar.Header, error) {
+	if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
+		return nil, err
+	}
+
+	headers := []*tar.Header{}
+
+	err := filepath.Walk(a.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(a.path, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		header.Uid, header.Gid, err = a.containerOwner(p, header.Uid, header.Gid)
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+
+		headers = append(headers, header)
+		return nil
+	})
+
+	return headers, err
+}
@@ -0,0 +1,90 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func readEntry(c *C, layer *Layer, p string) string {
+	rc, err := layer.Open(p)
+	c.Assert(err, IsNil, Commentf("%v", p))
+	defer rc.Close()
+
+	content, err := ioutil.ReadAll(rc)
+	c.Assert(err, IsNil)
+	return string(content)
+}
+
+func (m *mountSuite) TestIndex(c *C) {
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/passwd", content: "root:x:0:0", typeflag: tar.TypeReg},
+		{name: "etc/issue", linkname: "motd", typeflag: tar.TypeSymlink},
+		{name: "etc/empty", typeflag: tar.TypeReg},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/motd.old", linkname: "etc/motd", typeflag: tar.TypeLink},
+		{name: "usr/share/doc/README", content: string(make([]byte, 1500)), typeflag: tar.TypeReg},
+	}
+
+	if m.Repository.IsVirtual() {
+		// as in a tar, the last entry for a path wins.
+		entries = append([]tarEntry{{name: "etc/motd", content: "old", typeflag: tar.TypeReg}}, entries...)
+	}
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+
+	if m.Repository.IsVirtual() {
+		_, err := os.Stat(layer.Path() + indexSuffix)
+		c.Assert(err, IsNil)
+	}
+
+	check := func() {
+		c.Assert(readEntry(c, layer, "etc/passwd"), Equals, "root:x:0:0")
+		c.Assert(readEntry(c, layer, "/etc/motd"), Equals, "hello")
+		c.Assert(readEntry(c, layer, "./etc/motd.old"), Equals, "hello")
+		c.Assert(readEntry(c, layer, "etc/empty"), Equals, "")
+		c.Assert(readEntry(c, layer, "usr/share/doc/README"), Equals, string(make([]byte, 1500)))
+
+		_, err := layer.Open("etc/shadow")
+		c.Assert(os.IsNotExist(err), Equals, true)
+
+		_, err = layer.Open("etc/issue")
+		c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+		_, err = layer.Open("etc")
+		c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+		headers, err := layer.List()
+		c.Assert(err, IsNil)
+
+		names := map[string]bool{}
+		for _, header := range headers {
+			names[cleanEntryName(header.Name)] = true
+		}
+
+		for _, entry := range entries {
+			c.Assert(names[cleanEntryName(entry.name)], Equals, true, Commentf("%v", entry.name))
+		}
+	}
+
+	check()
+
+	if m.Repository.IsVirtual() {
+		// tars without an index are indexed on first use.
+		c.Assert(os.Remove(layer.Path()+indexSuffix), IsNil)
+		check()
+		_, err := os.Stat(layer.Path() + indexSuffix)
+		c.Assert(err, IsNil)
+
+		headers, err := layer.List()
+		c.Assert(err, IsNil)
+		c.Assert(headers, HasLen, len(entries))
+		c.Assert(headers[0].Name, Equals, "etc/motd")
+		c.Assert(headers[0].Size, Equals, int64(3))
+	}
+}
@@ -3,7 +3,6 @@ package overmount
 import (
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -23,11 +22,19 @@ const (
 
 // CreateLayerFromAsset prepares a new layer for work and creates it in the
 // repository. The ID is calculated from the digest.
-func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overwrite bool) (retLayer *Layer, retErr error) {
+func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overwrite bool) (*Layer, error) {
+	return r.CreateLayerFromAssetWithOptions(reader, parent, overwrite, nil)
+}
+
+// CreateLayerFromAssetWithOptions creates a layer like CreateLayerFromAsset,
+// unpacking the tar as controlled by opts. If the tar violates the limits set
+// there, or does not have the expected digest, no layer is created; see
+// Asset.UnpackWithOptions.
+func (r *Repository) CreateLayerFromAssetWithOptions(reader io.Reader, parent *Layer, overwrite bool, opts *UnpackOptions) (retLayer *Layer, retErr error) {
 	var path string
 	var err error
 	if r.IsVirtual() {
-		f, err := r.TempFile()
+		f, err := r.tempFile()
 		if err != nil {
 			return nil, err
 		}
@@ -36,7 +43,8 @@ func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overw
 
 		defer func() {
 			if retErr != nil {
-				os.Remove(path)
+				r.fs.Remove(path)
+				r.fs.Remove(path + indexSuffix)
 			}
 		}()
 	} else {
@@ -48,16 +56,23 @@ func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overw
 		defer func() {
 			if retErr != nil {
 				os.RemoveAll(path)
+				os.Remove(path + tarSplitSuffix)
+				os.Remove(path + sparseSuffix)
+				os.Remove(path + selinuxSuffix)
 			}
 		}()
 	}
 
-	asset, err := NewAsset(path, digest.SHA256.Digester(), r.IsVirtual())
+	asset, err := NewAsset(path, r.algorithm.Digester(), r.IsVirtual())
 	if err != nil {
 		return nil, err
 	}
 
-	if err := asset.Unpack(reader); err != nil {
+	asset.fs = r.fs
+	asset.SetIDMapping(r.idMapping)
+	asset.SetSELinuxLabel(r.selinuxLabel)
+
+	if err := asset.UnpackWithOptions(reader, opts); err != nil {
 		return nil, err
 	}
 
@@ -67,7 +82,7 @@ func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overw
 	}
 
 	if overwrite {
-		if err := os.RemoveAll(layer.layerBase()); err != nil && !os.IsNotExist(err) {
+		if err := r.fs.RemoveAll(layer.layerBase()); err != nil && !os.IsNotExist(err) {
 			return nil, err
 		}
 	}
@@ -76,14 +91,53 @@ func (r *Repository) CreateLayerFromAsset(reader io.Reader, parent *Layer, overw
 		return nil, err
 	}
 
-	if err := os.Rename(path, layer.Path()); err != nil {
+	if err := r.fs.Rename(path, layer.Path()); err != nil {
 		return nil, err
 	}
 
+	if r.IsVirtual() {
+		if err := r.fs.Rename(asset.indexPath(), layer.Path()+indexSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		if err := os.Rename(asset.tarSplitPath(), layer.Path()+tarSplitSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err := os.Rename(asset.sparsePath(), layer.Path()+sparseSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err := os.Rename(asset.selinuxPath(), layer.Path()+selinuxSuffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
 	// FIXME some hackery around moving the asset; should probably codify.
 	asset.path = layer.Path()
 	layer.asset = asset
 
+	// the manifest records the layer as it was unpacked, before anything
+	// else can change it.
+	if err := layer.edit(func() error {
+		if err := layer.saveDigests(); err != nil {
+			return err
+		}
+
+		_, err := layer.saveManifest()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := r.dedupeLayer(layer.Path()); err != nil {
+		return nil, err
+	}
+
+	if err := layer.saveInitialHistory(asset); err != nil {
+		return nil, err
+	}
+
 	return layer, layer.SaveParent()
 }
 
@@ -110,6 +164,10 @@ func (r *Repository) newLayer(id string, parent *Layer, create, overwrite bool)
 		return nil, errors.Wrap(ErrInvalidLayer, "ID is empty")
 	}
 
+	if parent != nil && parent.repository.algorithm != r.algorithm {
+		return nil, errors.Wrapf(ErrDigestAlgorithm, "parent uses %v, repository uses %v", parent.repository.algorithm, r.algorithm)
+	}
+
 	var err error
 
 	layer := &Layer{
@@ -130,16 +188,25 @@ func (r *Repository) newLayer(id string, parent *Layer, create, overwrite bool)
 		return nil, err
 	}
 
-	layer.asset, err = NewAsset(layer.Path(), digest.SHA256.Digester(), r.IsVirtual())
+	layer.asset, err = NewAsset(layer.Path(), r.algorithm.Digester(), r.IsVirtual())
 	if err != nil {
 		return nil, err
 	}
 
+	layer.asset.fs = r.fs
+
+	layer.asset.SetIDMapping(r.idMapping)
+	layer.asset.SetSELinuxLabel(r.selinuxLabel)
+
+	if err := layer.loadDigests(); err != nil {
+		return nil, err
+	}
+
 	return layer, nil
 }
 
 func (l *Layer) edit(editFunc func() error) (retErr error) {
-	return edit(path.Join(l.layerBase(), lockFilePath), l.editMutex, editFunc)
+	return edit(l.repository.fs, path.Join(l.layerBase(), lockFilePath), l.editMutex, editFunc)
 }
 
 // ID returns the ID of the layer.
@@ -154,7 +221,7 @@ func (l *Layer) MountPath() string {
 
 // Exists indicates whether or not a layer already exists.
 func (l *Layer) Exists() bool {
-	fi, err := os.Stat(l.layerBase())
+	fi, err := l.repository.fs.Stat(l.layerBase())
 	if err != nil {
 		return false
 	}
@@ -167,6 +234,20 @@ func (l *Layer) Digest() digest.Digest {
 	return l.asset.Digest()
 }
 
+// CompressedDigest returns the digest of the layer tar as it was last read or
+// written, compression included. See Asset.CompressedDigest. Layers loaded
+// from the repository return that of the tar they were last unpacked from, as
+// do Digest and Compression.
+func (l *Layer) CompressedDigest() digest.Digest {
+	return l.asset.CompressedDigest()
+}
+
+// Compression returns the compression of the layer tar as it was last read or
+// written.
+func (l *Layer) Compression() Compression {
+	return l.asset.Compression()
+}
+
 // LoadDigest recalculates the digest for the asset, and returns it (and any
 // error)
 func (l *Layer) LoadDigest() (digest.Digest, error) {
@@ -176,14 +257,15 @@ func (l *Layer) LoadDigest() (digest.Digest, error) {
 // Create creates the layer and makes it available for use, if possible.
 // Otherwise, it returns an error.
 func (l *Layer) Create() error {
-	return checkDir(l.layerBase(), ErrInvalidLayer)
+	return checkDir(l.repository.fs, l.layerBase(), ErrInvalidLayer)
 }
 
 func (l *Layer) layerBase() string {
 	return filepath.Join(l.repository.baseDir, layerBase, l.id)
 }
 
-// Path gets the layer store path for a given subpath.
+// Path gets the layer store path for a given subpath. In memory repositories,
+// it is not a path on the host.
 func (l *Layer) Path() string {
 	if l.repository.IsVirtual() {
 		return filepath.Join(l.layerBase(), virtualLayerPath)
@@ -202,7 +284,7 @@ func (l *Layer) configPath() string {
 
 // Config returns a reference to the image configuration for this layer.
 func (l *Layer) Config() (*ImageConfig, error) {
-	f, err := os.Open(l.configPath())
+	f, err := l.repository.fs.Open(l.configPath())
 	if err != nil {
 		return nil, err
 	}
@@ -215,7 +297,7 @@ func (l *Layer) Config() (*ImageConfig, error) {
 // SaveConfig writes a *v1.Image configuration to the repository for the layer.
 func (l *Layer) SaveConfig(config *ImageConfig) error {
 	return l.edit(func() error {
-		f, err := os.Create(l.configPath())
+		f, err := l.repository.fs.Create(l.configPath())
 		if err != nil {
 			return err
 		}
@@ -232,7 +314,7 @@ func (l *Layer) SaveParent() error {
 			return nil
 		}
 
-		fi, err := os.Stat(l.parentPath())
+		fi, err := l.repository.fs.Stat(l.parentPath())
 		if err != nil {
 			if os.IsNotExist(err) {
 				return l.overwriteParent()
@@ -252,13 +334,13 @@ func (l *Layer) overwriteParent() error {
 		return nil
 	}
 
-	return ioutil.WriteFile(l.parentPath(), []byte(l.Parent.ID()), 0600)
+	return writeFile(l.repository.fs, l.parentPath(), []byte(l.Parent.ID()), 0600)
 }
 
 // LoadParent loads only the parent for this specific instance. See
 // RestoreParent for restoring the whole chain.
 func (l *Layer) LoadParent() error {
-	id, err := ioutil.ReadFile(l.parentPath())
+	id, err := readFile(l.repository.fs, l.parentPath())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil
@@ -275,7 +357,7 @@ func (l *Layer) LoadParent() error {
 		return err
 	}
 
-	fi, err := os.Stat(parent.layerBase())
+	fi, err := l.repository.fs.Stat(parent.layerBase())
 	if err != nil || !fi.IsDir() {
 		return errors.Wrap(ErrInvalidLayer, parent.layerBase())
 	}
@@ -300,13 +382,33 @@ func (l *Layer) RestoreParent() error {
 
 // Unpack unpacks the asset into the layer Path(). It returns the computed digest.
 func (l *Layer) Unpack(reader io.Reader) (digest.Digest, error) {
-	err := l.edit(func() error { return l.asset.Unpack(reader) })
+	err := l.edit(func() error {
+		if err := l.removeManifest(); err != nil {
+			return err
+		}
+
+		if err := l.asset.Unpack(reader); err != nil {
+			return err
+		}
+
+		if err := l.saveDigests(); err != nil {
+			return err
+		}
+
+		return l.repository.dedupeLayer(l.Path())
+	})
 	return l.asset.Digest(), err
 }
 
 // Pack archives the layer to the writer as a tar file.
 func (l *Layer) Pack(writer io.Writer) (digest.Digest, error) {
-	err := l.edit(func() error { return l.asset.Pack(writer) })
+	return l.PackWithOptions(writer, nil)
+}
+
+// PackWithOptions archives the layer to the writer as a tar file, as
+// controlled by opts.
+func (l *Layer) PackWithOptions(writer io.Writer, opts *PackOptions) (digest.Digest, error) {
+	err := l.edit(func() error { return l.asset.PackWithOptions(writer, opts) })
 	return l.asset.Digest(), err
 }
 
@@ -314,6 +416,6 @@ func (l *Layer) Pack(writer io.Writer) (digest.Digest, error) {
 func (l *Layer) Remove() error {
 	return l.edit(func() error {
 		l.repository.RemoveLayer(l)
-		return os.RemoveAll(l.layerBase())
+		return l.repository.fs.RemoveAll(l.layerBase())
 	})
 }
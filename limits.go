@@ -0,0 +1,288 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ratioThreshold is the amount of uncompressed data read before the expansion
+// ratio is enforced; below it, the ratio of tiny, highly compressible tars is
+// meaningless.
+const ratioThreshold = 1 << 20
+
+// UnpackOptions limits what Unpack accepts from a tar, for tars from untrusted
+// sources. A nil *UnpackOptions is the same as the zero value, which imposes
+// no limits; neither does any zero field.
+type UnpackOptions struct {
+	// MaxBytes is the total size of the contents of all entries.
+	MaxBytes int64
+
+	// MaxFiles is the number of entries.
+	MaxFiles int64
+
+	// MaxDepth is the number of components in the path of any entry.
+	MaxDepth int
+
+	// MaxFileSize is the size of the contents of any entry.
+	MaxFileSize int64
+
+	// MaxRatio is the size of the uncompressed tar divided by the size of the
+	// compressed one. It is enforced once more than a megabyte was
+	// decompressed.
+	MaxRatio float64
+
+	// Strict rejects entries which escape the root of the layer, absolute or
+	// escaping symlink targets, device nodes, and setuid or setgid bits.
+	Strict bool
+
+	// ExpectedDigest is the digest the uncompressed tar must have (its
+	// diffID). If it differs, a *DigestMismatchError is returned.
+	ExpectedDigest digest.Digest
+}
+
+// LimitError is returned when a tar violates the UnpackOptions it was unpacked
+// with. Its cause is ErrUnpackLimit.
+type LimitError struct {
+	// Limit is the name of the UnpackOptions field that was violated.
+	Limit string
+
+	// Path is the name of the offending entry, if any.
+	Path string
+
+	// Reason describes the violation.
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v: %s: %s", ErrUnpackLimit, e.Limit, e.Reason)
+	}
+
+	return fmt.Sprintf("%v: %s: %s: %s", ErrUnpackLimit, e.Limit, e.Path, e.Reason)
+}
+
+// Cause returns ErrUnpackLimit, for errors.Cause.
+func (e *LimitError) Cause() error {
+	return ErrUnpackLimit
+}
+
+// limited reports if any limits are set.
+func (opts *UnpackOptions) limited() bool {
+	limits := *opts
+	limits.ExpectedDigest = ""
+	return limits != (UnpackOptions{})
+}
+
+// limit returns a reader which passes reader through, but fails once the tar
+// read so far violates the options. compressed counts the bytes read before
+// decompression. finish must be called when done reading; it returns the
+// violation, if any.
+func (opts *UnpackOptions) limit(reader io.Reader, compressed *countWriter) (io.Reader, func() error) {
+	lr := &limitReader{reader: reader, opts: opts, compressed: compressed, pending: new(bytes.Buffer)}
+	lr.tr = tar.NewReader(io.TeeReader(reader, lr.pending))
+
+	return lr, func() error {
+		if _, ok := lr.err.(*LimitError); ok || errors.Cause(lr.err) == ErrInvalidAsset {
+			return lr.err
+		}
+		return nil
+	}
+}
+
+// limitReader parses the tar as it is read, as holdSparse does, but hands on
+// the bytes the tar.Reader consumed rather than writing the entries anew, so
+// the tar is passed through unchanged. A header is checked before any of its
+// bytes are returned, so no entry reaches the unpacker unchecked.
+type limitReader struct {
+	reader     io.Reader
+	opts       *UnpackOptions
+	compressed *countWriter
+	tr         *tar.Reader
+	pending    *bytes.Buffer
+	inEntry    bool
+	done       bool
+	n          int64
+	files      int64
+	total      int64
+	err        error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	for l.pending.Len() == 0 {
+		var err error
+
+		switch {
+		case l.done:
+			// whatever follows the end of the archive is passed through.
+			var n int
+			n, err = l.reader.Read(p)
+			if n > 0 {
+				if err := l.count(n); err != nil {
+					return 0, err
+				}
+			}
+			return n, err
+		case l.inEntry:
+			// the contents are only read to move the tar.Reader along; the
+			// bytes it consumed are what is handed on.
+			_, err = l.tr.Read(p)
+			if err == io.EOF {
+				l.inEntry = false
+				continue
+			}
+		default:
+			var header *tar.Header
+			header, err = l.tr.Next()
+			if err == io.EOF {
+				l.done = true
+				continue
+			} else if err == nil {
+				err = l.check(header)
+				l.inEntry = true
+			}
+		}
+
+		if err != nil {
+			if _, ok := err.(*LimitError); !ok {
+				err = errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+			}
+			l.err = err
+			return 0, err
+		}
+	}
+
+	n := len(p)
+	if n > l.pending.Len() {
+		n = l.pending.Len()
+	}
+
+	if err := l.count(n); err != nil {
+		return 0, err
+	}
+
+	return l.pending.Read(p[:n])
+}
+
+// count adds n bytes to those handed on and enforces the expansion ratio.
+func (l *limitReader) count(n int) error {
+	l.n += int64(n)
+
+	if l.opts.MaxRatio > 0 && l.n > ratioThreshold && l.compressed.n > 0 {
+		if ratio := float64(l.n) / float64(l.compressed.n); ratio > l.opts.MaxRatio {
+			l.err = &LimitError{Limit: "MaxRatio", Reason: fmt.Sprintf("expanded more than %g times", l.opts.MaxRatio)}
+			return l.err
+		}
+	}
+
+	return nil
+}
+
+// check enforces the limits on the next entry of the tar.
+func (l *limitReader) check(header *tar.Header) error {
+	opts := l.opts
+
+	l.files++
+	if opts.MaxFiles > 0 && l.files > opts.MaxFiles {
+		return &LimitError{Limit: "MaxFiles", Path: header.Name, Reason: fmt.Sprintf("more than %d entries", opts.MaxFiles)}
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+	if depth := len(strings.Split(name, "/")); opts.MaxDepth > 0 && depth > opts.MaxDepth {
+		return &LimitError{Limit: "MaxDepth", Path: header.Name, Reason: fmt.Sprintf("%d components, more than %d", depth, opts.MaxDepth)}
+	}
+
+	if opts.MaxFileSize > 0 && header.Size > opts.MaxFileSize {
+		return &LimitError{Limit: "MaxFileSize", Path: header.Name, Reason: fmt.Sprintf("%d bytes, more than %d", header.Size, opts.MaxFileSize)}
+	}
+
+	l.total += header.Size
+	if opts.MaxBytes > 0 && l.total > opts.MaxBytes {
+		return &LimitError{Limit: "MaxBytes", Path: header.Name, Reason: fmt.Sprintf("more than %d bytes in total", opts.MaxBytes)}
+	}
+
+	if opts.Strict {
+		if reason := strictViolation(header); reason != "" {
+			return &LimitError{Limit: "Strict", Path: header.Name, Reason: reason}
+		}
+	}
+
+	return nil
+}
+
+func strictViolation(header *tar.Header) string {
+	name := path.Clean(header.Name)
+	if escapes(name) {
+		return "escapes the root"
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if path.IsAbs(header.Linkname) {
+			return "absolute symlink target"
+		}
+		if escapes(path.Join(path.Dir(strings.TrimPrefix(name, "/")), header.Linkname)) {
+			return "symlink target escapes the root"
+		}
+	case tar.TypeLink:
+		if escapes(path.Clean(strings.TrimPrefix(header.Linkname, "/"))) {
+			return "hardlink target escapes the root"
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		return "device node"
+	}
+
+	if header.Mode&(tarSetuid|tarSetgid) != 0 {
+		return "setuid or setgid bit"
+	}
+
+	return ""
+}
+
+// mode bits of tar headers.
+const (
+	tarSetuid = 04000
+	tarSetgid = 02000
+)
+
+func escapes(p string) bool {
+	return p == ".." || strings.HasPrefix(p, "../")
+}
+
+// clearDir removes everything inside dir, but not dir itself.
+func clearDir(dir string) error {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
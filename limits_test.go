@@ -0,0 +1,150 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestUnpackLimits(c *C) {
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/passwd", content: "root:x:0:0", typeflag: tar.TypeReg},
+		{name: "etc/issue", linkname: "motd", typeflag: tar.TypeSymlink},
+	}
+
+	// the repository is left as it was by a violation.
+	checkEmpty := func() {
+		for _, dir := range []string{layerBase, tmpdirBase} {
+			fis, err := ioutil.ReadDir(filepath.Join(m.Repository.baseDir, dir))
+			if os.IsNotExist(err) {
+				continue
+			}
+			c.Assert(err, IsNil)
+			c.Assert(fis, HasLen, 0, Commentf("%v", dir))
+		}
+	}
+
+	for _, test := range []struct {
+		opts    UnpackOptions
+		entries []tarEntry
+		limit   string
+	}{
+		{UnpackOptions{MaxFiles: 3}, entries, "MaxFiles"},
+		{UnpackOptions{MaxBytes: 10}, entries, "MaxBytes"},
+		{UnpackOptions{MaxFileSize: 8}, entries, "MaxFileSize"},
+		{UnpackOptions{MaxDepth: 2}, append(entries, tarEntry{name: "etc/ssl/certs/ca.pem", typeflag: tar.TypeReg}), "MaxDepth"},
+		{UnpackOptions{Strict: true}, []tarEntry{{name: "link", linkname: "/etc/passwd", typeflag: tar.TypeSymlink}}, "Strict"},
+		{UnpackOptions{Strict: true}, []tarEntry{{name: "etc/link", linkname: "../../etc/passwd", typeflag: tar.TypeSymlink}}, "Strict"},
+		{UnpackOptions{Strict: true}, []tarEntry{{name: "dev/null", typeflag: tar.TypeChar}}, "Strict"},
+	} {
+		_, err := m.Repository.CreateLayerFromAssetWithOptions(makeTar(c, test.entries), nil, false, &test.opts)
+		c.Assert(errors.Cause(err), Equals, ErrUnpackLimit, Commentf("%+v", test.opts))
+		limitErr, ok := err.(*LimitError)
+		c.Assert(ok, Equals, true)
+		c.Assert(limitErr.Limit, Equals, test.limit)
+		checkEmpty()
+	}
+
+	setuid := new(bytes.Buffer)
+	tw := tar.NewWriter(setuid)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "su", Typeflag: tar.TypeReg, Mode: 04755}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	_, err := m.Repository.CreateLayerFromAssetWithOptions(setuid, nil, false, &UnpackOptions{Strict: true})
+	c.Assert(errors.Cause(err), Equals, ErrUnpackLimit)
+	checkEmpty()
+
+	// megabytes of zeroes compress very well.
+	bomb := new(bytes.Buffer)
+	gz := gzip.NewWriter(bomb)
+	gz.Write(makeTar(c, []tarEntry{{name: "zeroes", content: string(make([]byte, 4<<20)), typeflag: tar.TypeReg}}).Bytes())
+	c.Assert(gz.Close(), IsNil)
+
+	_, err = m.Repository.CreateLayerFromAssetWithOptions(bytes.NewReader(bomb.Bytes()), nil, false, &UnpackOptions{MaxRatio: 100})
+	c.Assert(err, FitsTypeOf, &LimitError{})
+	c.Assert(err.(*LimitError).Limit, Equals, "MaxRatio")
+	checkEmpty()
+
+	// within the limits, nothing changes.
+	limited, err := m.Repository.CreateLayerFromAssetWithOptions(makeTar(c, entries), nil, false, &UnpackOptions{
+		MaxFiles:    4,
+		MaxBytes:    15,
+		MaxFileSize: 10,
+		MaxDepth:    2,
+		MaxRatio:    100,
+		Strict:      true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(limited.ID(), Equals, digest.FromBytes(makeTar(c, entries).Bytes()).Hex())
+	c.Assert(readLayer(c, limited)["etc/motd"], Equals, "hello")
+
+	// assets unpacked directly are cleaned up, too.
+	dir, err := m.Repository.TempDir()
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	path := dir
+	if m.Repository.IsVirtual() {
+		path = filepath.Join(dir, "layer.tar")
+	}
+
+	asset, err := NewAsset(path, digest.SHA256.Digester(), m.Repository.IsVirtual())
+	c.Assert(err, IsNil)
+	err = asset.UnpackWithOptions(makeTar(c, entries), &UnpackOptions{MaxFiles: 1})
+	c.Assert(errors.Cause(err), Equals, ErrUnpackLimit)
+
+	fis, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(fis, HasLen, 0)
+
+	if m.Repository.IsVirtual() {
+		return
+	}
+
+	// a violation halfway through an unpack into an asset with contents
+	// would leave part of the tar behind, so that is refused outright.
+	c.Assert(asset.Unpack(makeTar(c, entries[:2])), IsNil)
+	err = asset.UnpackWithOptions(makeTar(c, entries), &UnpackOptions{MaxFiles: 10})
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+	names, err := readDirNames(filepath.Join(dir, "etc"))
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"motd"})
+}
+
+func (m *mountSuite) TestUnpackLimitsOrder(c *C) {
+	buf := makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "dev/null", typeflag: tar.TypeChar},
+	})
+
+	// nothing of the offending entry is handed on, however the tar is read.
+	for _, size := range []int{1, 100, 512, 4096} {
+		opts := &UnpackOptions{Strict: true}
+		limited, finish := opts.limit(bytes.NewReader(buf.Bytes()), &countWriter{})
+
+		passed := new(bytes.Buffer)
+		p := make([]byte, size)
+		var err error
+		for err == nil {
+			var n int
+			n, err = limited.Read(p)
+			passed.Write(p[:n])
+		}
+
+		c.Assert(err, FitsTypeOf, &LimitError{})
+		c.Assert(finish(), Equals, err)
+		c.Assert(bytes.Contains(passed.Bytes(), []byte("hello")), Equals, true)
+		c.Assert(bytes.Contains(passed.Bytes(), []byte("dev/null")), Equals, false, Commentf("%d", size))
+	}
+}
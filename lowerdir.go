@@ -0,0 +1,177 @@
+package overmount
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// maxLowerDirs is the most lower dirs overlay stacks in one mount.
+const maxLowerDirs = 500
+
+// fsconfig(2) commands, which golang.org/x/sys/unix does not define.
+const (
+	fsconfigSetFlag   = 0
+	fsconfigSetString = 1
+	fsconfigCmdCreate = 6
+)
+
+// openLong mounts the overlay when its options do not fit in the single page
+// mount(2) accepts, which happens to images with many layers. The new mount
+// API takes the lower dirs one at a time; on kernels without lowerdir+ (before
+// 6.8), they are shortened to /proc/self/fd links to open directories.
+func (m *Mount) openLong(flags uintptr, extra []overlayOption) error {
+	lower := strings.Split(m.lower, ":")
+	if len(lower) > maxLowerDirs {
+		return errors.Wrapf(ErrMountCannotProceed, "cannot mount %d layers, overlay stacks at most %d; squash some of them", len(lower), maxLowerDirs)
+	}
+
+	ok, err := m.openFsconfig(lower, flags, extra)
+	if ok || err != nil {
+		return err
+	}
+
+	dirs := append([]string{m.upper, m.work}, lower...)
+	fds := []int{}
+
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+
+	for i, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return errors.Wrapf(ErrMountCannotProceed, "cannot open %q: %v", dir, err)
+		}
+
+		fds = append(fds, fd)
+		dirs[i] = fmt.Sprintf("/proc/self/fd/%d", fd)
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s", strings.Join(dirs[2:], ":"))
+	if !m.ReadOnly() {
+		opts = fmt.Sprintf("upperdir=%s,%s,workdir=%s", dirs[0], opts, dirs[1])
+	}
+
+	for _, opt := range extra {
+		opts += "," + opt.String()
+	}
+
+	if !mountOptionsFit(opts) {
+		return errors.Wrapf(ErrMountCannotProceed, "cannot mount %d layers: their lower dirs do not fit in the mount options, and the kernel does not support lowerdir+; squash some of them", len(lower))
+	}
+
+	if err := unix.Mount("overlay", m.target, "overlay", flags, opts); err != nil {
+		return errors.Wrapf(ErrMountCannotProceed, "cannot mount overlay of %d layers at %q: %v", len(lower), m.target, err)
+	}
+
+	return nil
+}
+
+// openFsconfig mounts the overlay with the new mount API, adding the lower
+// dirs with one lowerdir+ each. It returns false if the kernel does not
+// support that.
+func (m *Mount) openFsconfig(lower []string, flags uintptr, extra []overlayOption) (bool, error) {
+	fd, err := unix.Fsopen("overlay", unix.FSOPEN_CLOEXEC)
+	if err != nil {
+		return false, nil
+	}
+	defer unix.Close(fd)
+
+	for _, dir := range lower {
+		if err := fsconfigString(fd, "lowerdir+", dir); err != nil {
+			if err == unix.EINVAL {
+				return false, nil
+			}
+			return true, errors.Wrapf(ErrMountCannotProceed, "cannot add lower dir %q: %v", dir, err)
+		}
+	}
+
+	if !m.ReadOnly() {
+		if err := fsconfigString(fd, "upperdir", m.upper); err != nil {
+			return true, errors.Wrapf(ErrMountCannotProceed, "cannot set upper dir: %v", err)
+		}
+
+		if err := fsconfigString(fd, "workdir", m.work); err != nil {
+			return true, errors.Wrapf(ErrMountCannotProceed, "cannot set work dir: %v", err)
+		}
+	}
+
+	for _, opt := range extra {
+		if err := fsconfigOption(fd, opt); err != nil {
+			return true, errors.Wrapf(ErrMountCannotProceed, "cannot set overlay option %s: %v", opt, err)
+		}
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), fsconfigCmdCreate, 0, 0, 0, 0); errno != 0 {
+		return true, errors.Wrapf(ErrMountCannotProceed, "cannot create overlay of %d layers: %v", len(lower), errno)
+	}
+
+	var attrs int
+	if flags&unix.MS_RDONLY != 0 {
+		attrs = unix.MOUNT_ATTR_RDONLY
+	}
+
+	mfd, err := unix.Fsmount(fd, unix.FSMOUNT_CLOEXEC, attrs)
+	if err != nil {
+		return true, errors.Wrapf(ErrMountCannotProceed, "cannot mount overlay of %d layers: %v", len(lower), err)
+	}
+	defer unix.Close(mfd)
+
+	if err := unix.MoveMount(mfd, "", unix.AT_FDCWD, m.target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return true, errors.Wrapf(ErrMountCannotProceed, "cannot mount overlay of %d layers at %q: %v", len(lower), m.target, err)
+	}
+
+	return true, nil
+}
+
+// fsconfigOption sets opt, which is a flag if it has no value.
+func fsconfigOption(fd int, opt overlayOption) error {
+	if opt.value != "" {
+		return fsconfigString(fd, opt.key, opt.value)
+	}
+
+	k, err := unix.BytePtrFromString(opt.key)
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), fsconfigSetFlag, uintptr(unsafe.Pointer(k)), 0, 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func fsconfigString(fd int, key, value string) error {
+	k, err := unix.BytePtrFromString(key)
+	if err != nil {
+		return err
+	}
+
+	v, err := unix.BytePtrFromString(value)
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fd), fsconfigSetString, uintptr(unsafe.Pointer(k)), uintptr(unsafe.Pointer(v)), 0, 0); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// mountOptionsFit reports if opts fit in the page of options mount(2) copies.
+func mountOptionsFit(opts string) bool {
+	return len(opts) < os.Getpagesize()
+}
@@ -0,0 +1,375 @@
+package overmount
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const manifestPath = "manifest.json"
+
+// Types of manifest entries.
+const (
+	ManifestFile     = "file"
+	ManifestDir      = "dir"
+	ManifestSymlink  = "symlink"
+	ManifestHardlink = "hardlink"
+	ManifestChar     = "char"
+	ManifestBlock    = "block"
+	ManifestFifo     = "fifo"
+	ManifestSocket   = "socket"
+	ManifestUnknown  = "unknown"
+)
+
+// ManifestEntry describes a single entry in a layer.
+type ManifestEntry struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Mode     os.FileMode       `json:"mode"`
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	Size     int64             `json:"size,omitempty"`
+	ModTime  time.Time         `json:"mtime"`
+	Linkname string            `json:"linkname,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+	Digest   digest.Digest     `json:"digest,omitempty"`
+}
+
+// Manifest is the list of every entry in a layer, sorted by path. Paths are
+// relative to the root of the layer. Regular files carry the SHA-256 digest
+// of their content.
+type Manifest []ManifestEntry
+
+func (l *Layer) manifestPath() string {
+	return filepath.Join(l.layerBase(), manifestPath)
+}
+
+// Manifest returns the manifest of the layer. Layers created from an asset
+// record it as soon as the asset is unpacked; for others, the first call
+// generates it from the contents of the layer. It is stored next to the
+// config, and later calls return the stored manifest, so it records the layer
+// as it was then. Unpacking into the layer or mounting it as the upper layer
+// of an image discards it.
+func (l *Layer) Manifest() (Manifest, error) {
+	var manifest Manifest
+
+	err := l.edit(func() error {
+		f, err := l.repository.fs.Open(l.manifestPath())
+		if err == nil {
+			defer f.Close()
+			return json.NewDecoder(f).Decode(&manifest)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		manifest, err = l.saveManifest()
+		return err
+	})
+
+	return manifest, err
+}
+
+// saveManifest generates the manifest from the contents of the layer and
+// stores it.
+func (l *Layer) saveManifest() (Manifest, error) {
+	manifest, err := l.asset.manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := l.repository.fs.Create(l.manifestPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return manifest, json.NewEncoder(f).Encode(manifest)
+}
+
+// VerifyManifest compares the contents of the layer with its stored manifest.
+// It returns the paths that were added, removed or changed since, and an
+// ErrManifestMismatch if there are any. If no manifest was stored, it returns
+// ErrInvalidLayer.
+func (l *Layer) VerifyManifest() ([]string, error) {
+	var changed []string
+
+	err := l.edit(func() error {
+		f, err := l.repository.fs.Open(l.manifestPath())
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errors.Wrap(ErrInvalidLayer, "layer has no manifest")
+			}
+			return err
+		}
+		defer f.Close()
+
+		var stored Manifest
+		if err := json.NewDecoder(f).Decode(&stored); err != nil {
+			return errors.Wrapf(ErrInvalidLayer, "invalid manifest: %v", err)
+		}
+
+		current, err := l.asset.manifest()
+		if err != nil {
+			return err
+		}
+
+		changed = diffManifests(stored, current)
+		if len(changed) > 0 {
+			return errors.Wrapf(ErrManifestMismatch, "%d entries differ: %s", len(changed), strings.Join(changed, ", "))
+		}
+
+		return nil
+	})
+
+	return changed, err
+}
+
+// removeManifest discards the stored manifest; it is used when the contents
+// of the layer are about to change.
+func (l *Layer) removeManifest() error {
+	if err := l.repository.fs.Remove(l.manifestPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func diffManifests(stored, current Manifest) []string {
+	entries := map[string]ManifestEntry{}
+	for _, entry := range stored {
+		entries[entry.Path] = entry
+	}
+
+	changed := []string{}
+	for _, entry := range current {
+		old, ok := entries[entry.Path]
+		delete(entries, entry.Path)
+
+		if !ok || !old.equal(entry) {
+			changed = append(changed, entry.Path)
+		}
+	}
+
+	for p := range entries {
+		changed = append(changed, p)
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+func (e ManifestEntry) equal(other ManifestEntry) bool {
+	if len(e.Xattrs) == 0 && len(other.Xattrs) == 0 {
+		e.Xattrs, other.Xattrs = nil, nil
+	}
+
+	return e.ModTime.Equal(other.ModTime) && reflect.DeepEqual(e.withoutTime(), other.withoutTime())
+}
+
+func (e ManifestEntry) withoutTime() ManifestEntry {
+	e.ModTime = time.Time{}
+	return e
+}
+
+// manifest generates the manifest of the asset from its contents.
+func (a *Asset) manifest() (Manifest, error) {
+	var (
+		manifest Manifest
+		err      error
+	)
+
+	if a.virtual {
+		if err := a.checkVirtualSymlink(); err != nil {
+			return nil, err
+		}
+		manifest, err = a.tarManifest()
+	} else {
+		if err := checkDir(a.fs, a.path, ErrInvalidAsset); err != nil {
+			return nil, err
+		}
+		manifest, err = a.dirManifest()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].Path < manifest[j].Path })
+	return manifest, nil
+}
+
+func (a *Asset) dirManifest() (Manifest, error) {
+	manifest := Manifest{}
+
+	err := filepath.Walk(a.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(a.path, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		entry := ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Type:    manifestType(fi.Mode()),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime().UTC(),
+		}
+
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			entry.UID, entry.GID, err = a.containerOwner(p, int(stat.Uid), int(stat.Gid))
+			if err != nil {
+				return err
+			}
+
+			if entry.Type == ManifestChar || entry.Type == ManifestBlock {
+				entry.Devmajor, entry.Devminor = int64(unix.Major(uint64(stat.Rdev))), int64(unix.Minor(uint64(stat.Rdev)))
+			}
+		}
+
+		switch entry.Type {
+		case ManifestSymlink:
+			if entry.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case ManifestFile:
+			entry.Size = fi.Size()
+			if entry.Digest, err = fileDigest(p); err != nil {
+				return err
+			}
+		}
+
+		header := &tar.Header{}
+		if err := a.setXattrs(header, p); err != nil {
+			return err
+		}
+		entry.Xattrs = manifestXattrs(header)
+
+		manifest = append(manifest, entry)
+		return nil
+	})
+
+	return manifest, err
+}
+
+func (a *Asset) tarManifest() (Manifest, error) {
+	f, err := a.fs.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := Manifest{}
+	tr := tar.NewReader(f)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		if name == "" {
+			continue
+		}
+
+		fi := header.FileInfo()
+		entry := ManifestEntry{
+			Path:     name,
+			Type:     manifestType(fi.Mode()),
+			Mode:     fi.Mode(),
+			UID:      header.Uid,
+			GID:      header.Gid,
+			ModTime:  header.ModTime.UTC(),
+			Devmajor: header.Devmajor,
+			Devminor: header.Devminor,
+			Xattrs:   manifestXattrs(header),
+		}
+
+		switch header.Typeflag {
+		case tar.TypeLink:
+			entry.Type = ManifestHardlink
+			entry.Linkname = strings.TrimPrefix(path.Clean("/"+header.Linkname), "/")
+		case tar.TypeSymlink:
+			entry.Linkname = header.Linkname
+		case tar.TypeReg, tar.TypeRegA:
+			digester := digest.SHA256.Digester()
+			if entry.Size, err = io.Copy(digester.Hash(), tr); err != nil {
+				return nil, err
+			}
+			entry.Digest = digester.Digest()
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	return manifest, nil
+}
+
+func manifestType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return ManifestFile
+	case mode.IsDir():
+		return ManifestDir
+	case mode&os.ModeSymlink != 0:
+		return ManifestSymlink
+	case mode&os.ModeCharDevice != 0:
+		return ManifestChar
+	case mode&os.ModeDevice != 0:
+		return ManifestBlock
+	case mode&os.ModeNamedPipe != 0:
+		return ManifestFifo
+	case mode&os.ModeSocket != 0:
+		return ManifestSocket
+	}
+
+	return ManifestUnknown
+}
+
+func manifestXattrs(header *tar.Header) map[string]string {
+	var xattrs map[string]string
+
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			if xattrs == nil {
+				xattrs = map[string]string{}
+			}
+			xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = value
+		}
+	}
+
+	return xattrs
+}
+
+func fileDigest(p string) (digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return digest.SHA256.FromReader(f)
+}
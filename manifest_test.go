@@ -0,0 +1,83 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestManifest(c *C) {
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/passwd", content: "root:x:0:0", typeflag: tar.TypeReg},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/issue", typeflag: tar.TypeSymlink, linkname: "motd"},
+	}
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+
+	// the manifest is recorded as the layer is created.
+	_, err = os.Stat(filepath.Join(layer.layerBase(), manifestPath))
+	c.Assert(err, IsNil)
+
+	changed, err := layer.VerifyManifest()
+	c.Assert(err, IsNil)
+	c.Assert(changed, HasLen, 0)
+
+	manifest, err := layer.Manifest()
+	c.Assert(err, IsNil)
+	c.Assert(len(manifest), Equals, 4)
+
+	paths := []string{}
+	for _, entry := range manifest {
+		paths = append(paths, entry.Path)
+	}
+	c.Assert(paths, DeepEquals, []string{"etc", "etc/issue", "etc/motd", "etc/passwd"})
+
+	c.Assert(manifest[0].Type, Equals, ManifestDir)
+	c.Assert(manifest[1].Type, Equals, ManifestSymlink)
+	c.Assert(manifest[1].Linkname, Equals, "motd")
+	c.Assert(manifest[2].Type, Equals, ManifestFile)
+	c.Assert(manifest[2].Size, Equals, int64(5))
+	c.Assert(manifest[2].Digest, Equals, digest.FromString("hello"))
+	c.Assert(manifest[3].Mode.Perm(), Equals, os.FileMode(0644))
+
+	// a second call returns the stored manifest.
+	again, err := layer.Manifest()
+	c.Assert(err, IsNil)
+	c.Assert(len(again), Equals, len(manifest))
+	for i := range again {
+		c.Assert(again[i].equal(manifest[i]), Equals, true)
+	}
+
+	changed, err = layer.VerifyManifest()
+	c.Assert(err, IsNil)
+	c.Assert(changed, HasLen, 0)
+
+	if m.Repository.IsVirtual() {
+		// replace the tar with one that differs in a single file.
+		entries[2].content = "goodbye"
+		c.Assert(ioutil.WriteFile(layer.Path(), makeTar(c, entries[:3]).Bytes(), 0600), IsNil)
+	} else {
+		c.Assert(ioutil.WriteFile(filepath.Join(layer.Path(), "etc/motd"), []byte("goodbye"), 0644), IsNil)
+		c.Assert(os.Remove(filepath.Join(layer.Path(), "etc/issue")), IsNil)
+		// keep the directory looking untouched, so only the entries show up.
+		c.Assert(os.Chtimes(filepath.Join(layer.Path(), "etc"), manifest[0].ModTime, manifest[0].ModTime), IsNil)
+	}
+
+	changed, err = layer.VerifyManifest()
+	c.Assert(errors.Cause(err), Equals, ErrManifestMismatch)
+	c.Assert(changed, DeepEquals, []string{"etc/issue", "etc/motd"})
+
+	// unpacking discards the manifest.
+	_, err = layer.Unpack(makeTar(c, entries))
+	c.Assert(err, IsNil)
+	_, err = layer.VerifyManifest()
+	c.Assert(errors.Cause(err), Equals, ErrInvalidLayer)
+}
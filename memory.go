@@ -0,0 +1,492 @@
+package overmount
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// NewMemoryRepository creates a virtual repository held entirely in memory,
+// for example for unit tests of code working with images. Its layers are tars
+// in memory, along with their configs, parents, history and tags; neither
+// privileges nor a filesystem are needed. It is the same *Repository as any
+// other, and everything but mounting works as with NewRepository. Mounting
+// fails, as in all virtual repositories.
+//
+// Nothing is shared with other repositories or processes, and nothing
+// outlives the repository. TempDir and TempFile still return paths on the
+// host, in the system's temp dir, as their callers need them there.
+//
+// Close drops the repository and everything in it.
+func NewMemoryRepository() *Repository {
+	return &Repository{
+		baseDir:   "/",
+		layers:    map[string]*Layer{},
+		mounts:    []*Mount{},
+		editMutex: new(sync.Mutex),
+		virtual:   true,
+		memory:    true,
+		fs:        newMemFS(),
+		algorithm: digest.SHA256,
+	}
+}
+
+// IsMemory reports if the repository was created with NewMemoryRepository.
+func (r *Repository) IsMemory() bool {
+	return r.memory
+}
+
+// Close drops a repository created with NewMemoryRepository, along with all
+// of its layers, which must not be used afterwards. Other repositories are
+// kept, so Close does nothing for them.
+func (r *Repository) Close() error {
+	if !r.memory {
+		return nil
+	}
+
+	return r.edit(func() error {
+		r.layers = map[string]*Layer{}
+		return r.fs.RemoveAll(r.baseDir)
+	})
+}
+
+// memFS is a fileSystem held in memory. It knows only dirs and regular
+// files.
+type memFS struct {
+	mutex sync.Mutex
+	nodes map[string]*memNode
+	next  int
+}
+
+type memNode struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		nodes: map[string]*memNode{
+			"/": {dir: true, mode: 0755, modTime: time.Now()},
+		},
+	}
+}
+
+func memPathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// below reports if name is p or below it.
+func below(name, p string) bool {
+	return name == p || strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/")
+}
+
+// parent returns the dir holding name, which must exist.
+func (m *memFS) parent(op, name string) error {
+	node, ok := m.nodes[filepath.Dir(name)]
+	if !ok {
+		return memPathError(op, name, os.ErrNotExist)
+	}
+
+	if !node.dir {
+		return memPathError(op, name, syscall.ENOTDIR)
+	}
+
+	return nil
+}
+
+func (m *memFS) Open(name string) (file, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) Create(name string) (file, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.openFile(filepath.Clean(name), flag, perm)
+}
+
+func (m *memFS) openFile(name string, flag int, perm os.FileMode) (file, error) {
+	node, ok := m.nodes[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, os.ErrExist)
+	case ok && node.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, memPathError("open", name, syscall.EISDIR)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, os.ErrNotExist)
+	case !ok:
+		if err := m.parent("open", name); err != nil {
+			return nil, err
+		}
+
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = node
+	case flag&os.O_TRUNC != 0:
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+}
+
+func (m *memFS) tempName(dir, pattern string) string {
+	m.next++
+	return filepath.Join(dir, fmt.Sprintf("%s%d", pattern, m.next))
+}
+
+func (m *memFS) TempFile(dir, pattern string) (file, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.openFile(m.tempName(filepath.Clean(dir), pattern), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+func (m *memFS) TempDir(dir, pattern string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name := m.tempName(filepath.Clean(dir), pattern)
+	if err := m.parent("mkdir", name); err != nil {
+		return "", err
+	}
+
+	m.nodes[name] = &memNode{dir: true, mode: 0700, modTime: time.Now()}
+	return name, nil
+}
+
+func (m *memFS) MkdirAll(name string, perm os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	missing := []string{}
+	for p := filepath.Clean(name); ; p = filepath.Dir(p) {
+		if node, ok := m.nodes[p]; ok {
+			if !node.dir {
+				return memPathError("mkdir", p, syscall.ENOTDIR)
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+
+	for _, p := range missing {
+		m.nodes[p] = &memNode{dir: true, mode: perm.Perm(), modTime: time.Now()}
+	}
+
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return memPathError("remove", name, os.ErrNotExist)
+	}
+
+	if node.dir {
+		for p := range m.nodes {
+			if p != name && below(p, name) {
+				return memPathError("remove", name, syscall.ENOTEMPTY)
+			}
+		}
+	}
+
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	for p := range m.nodes {
+		if below(p, name) && p != "/" {
+			delete(m.nodes, p)
+		}
+	}
+
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	node, ok := m.nodes[oldname]
+	if !ok {
+		return memPathError("rename", oldname, os.ErrNotExist)
+	}
+
+	if err := m.parent("rename", newname); err != nil {
+		return err
+	}
+
+	if target, ok := m.nodes[newname]; ok {
+		if target.dir != node.dir {
+			if target.dir {
+				return memPathError("rename", newname, syscall.EISDIR)
+			}
+			return memPathError("rename", newname, syscall.ENOTDIR)
+		}
+
+		for p := range m.nodes {
+			if p != newname && below(p, newname) {
+				return memPathError("rename", newname, syscall.ENOTEMPTY)
+			}
+		}
+	}
+
+	if node.dir && below(newname, oldname) {
+		return memPathError("rename", newname, syscall.EINVAL)
+	}
+
+	moved := map[string]*memNode{}
+	for p, n := range m.nodes {
+		if below(p, oldname) {
+			moved[newname+strings.TrimPrefix(p, oldname)] = n
+			delete(m.nodes, p)
+		}
+	}
+
+	for p, n := range moved {
+		m.nodes[p] = n
+	}
+
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	return m.Lstat(name)
+}
+
+func (m *memFS) Lstat(name string) (os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, memPathError("lstat", name, os.ErrNotExist)
+	}
+
+	return node.info(name), nil
+}
+
+func (m *memFS) Chmod(name string, mode os.FileMode) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return memPathError("chmod", name, os.ErrNotExist)
+	}
+
+	node.mode = mode.Perm()
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name = filepath.Clean(name)
+	node, ok := m.nodes[name]
+	if !ok {
+		return nil, memPathError("open", name, os.ErrNotExist)
+	}
+
+	if !node.dir {
+		return nil, memPathError("readdirent", name, syscall.ENOTDIR)
+	}
+
+	infos := []os.FileInfo{}
+	for p, n := range m.nodes {
+		if p != name && filepath.Dir(p) == name {
+			infos = append(infos, n.info(p))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Lock only checks that the dir holding the lock exists: nothing outside of
+// the process can reach the files, and edits already hold a mutex.
+func (m *memFS) Lock(name string) (func() error, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.parent("open", filepath.Clean(name)); err != nil {
+		return nil, err
+	}
+
+	return func() error { return nil }, nil
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	mode := n.mode
+	if n.dir {
+		mode |= os.ModeDir
+	}
+
+	return &memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: mode, modTime: n.modTime}
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() os.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+// memFile is an open file of a memFS. Like files on the host, it still
+// reaches its contents once it is removed or renamed.
+type memFile struct {
+	fs     *memFS
+	node   *memNode
+	name   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, memPathError("read", f.name, os.ErrClosed)
+	}
+
+	if f.node.dir {
+		return 0, memPathError("read", f.name, syscall.EISDIR)
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, memPathError("write", f.name, os.ErrClosed)
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, memPathError("write", f.name, syscall.EBADF)
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.node.data)
+			f.node.data = data
+		}
+		f.node.data = f.node.data[:end]
+	}
+
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, memPathError("seek", f.name, os.ErrClosed)
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, memPathError("seek", f.name, syscall.EINVAL)
+	}
+
+	if offset < 0 {
+		return 0, memPathError("seek", f.name, syscall.EINVAL)
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, memPathError("stat", f.name, os.ErrClosed)
+	}
+
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	return f.node.info(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return memPathError("close", f.name, os.ErrClosed)
+	}
+
+	f.closed = true
+	return nil
+}
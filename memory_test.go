@@ -0,0 +1,194 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestMemoryRepository(c *C) {
+	repo := NewMemoryRepository()
+	c.Assert(repo.IsMemory(), Equals, true)
+	c.Assert(repo.IsVirtual(), Equals, true)
+	c.Assert(m.Repository.IsMemory(), Equals, false)
+
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/issue", content: "welcome", typeflag: tar.TypeReg},
+	}
+
+	base, err := repo.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(base.ID(), Equals, digest.FromBytes(makeTar(c, entries).Bytes()).Hex())
+	c.Assert(base.Exists(), Equals, true)
+	c.Assert(readEntry(c, base, "etc/motd"), Equals, "hello")
+
+	headers, err := base.List()
+	c.Assert(err, IsNil)
+	c.Assert(len(headers), Equals, 3)
+
+	top, err := repo.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/motd", content: "bye", typeflag: tar.TypeReg},
+		{name: "etc/.wh.issue", typeflag: tar.TypeReg},
+	}), base, false)
+	c.Assert(err, IsNil)
+	c.Assert(top.SaveConfig(&ImageConfig{Cmd: []string{"sh"}}), IsNil)
+	c.Assert(repo.AddTag("latest", top), IsNil)
+
+	// the layer tars are held in memory, not on the host.
+	_, err = os.Stat(top.Path())
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(filepath.Join(repo.baseDir, layerBase))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	tagged, err := repo.GetTag("latest")
+	c.Assert(err, IsNil)
+	c.Assert(tagged.ID(), Equals, top.ID())
+	c.Assert(tagged.RestoreParent(), IsNil)
+	c.Assert(tagged.Parent.ID(), Equals, base.ID())
+
+	config, err := tagged.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Cmd, DeepEquals, []string{"sh"})
+
+	history, err := top.History()
+	c.Assert(err, IsNil)
+	c.Assert(history.Size, Equals, top.asset.Size())
+
+	changed, err := top.VerifyManifest()
+	c.Assert(err, IsNil)
+	c.Assert(changed, HasLen, 0)
+
+	buf := new(bytes.Buffer)
+	dg, err := top.Pack(buf)
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, top.ID())
+
+	// digests are stored with the layer, as in other repositories.
+	loaded, err := repo.newLayer(top.ID(), nil, false, true)
+	c.Assert(err, IsNil)
+	c.Assert(loaded.Digest(), Equals, top.Digest())
+
+	content, err := fs.ReadFile(repo.NewImage(top).FS(), "etc/motd")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "bye")
+	_, err = fs.Stat(repo.NewImage(top).FS(), "etc/issue")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	clone, err := top.Clone("clone", base)
+	c.Assert(err, IsNil)
+	c.Assert(readEntry(c, clone, "etc/motd"), Equals, "bye")
+
+	squashed, err := repo.Squash(top, nil)
+	c.Assert(err, IsNil)
+	c.Assert(readEntry(c, squashed, "etc/motd"), Equals, "bye")
+	_, err = squashed.Open("etc/issue")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	builder := repo.NewLayerBuilder(top)
+	c.Assert(builder.AddFile("etc/hostname", []byte("box"), Metadata{Mode: 0644}), IsNil)
+	built, err := builder.Build()
+	c.Assert(err, IsNil)
+	c.Assert(readEntry(c, built, "etc/hostname"), Equals, "box")
+
+	c.Assert(repo.Rebase(built, top, base), IsNil)
+	c.Assert(built.Parent.ID(), Equals, base.ID())
+
+	err = repo.NewImage(top).Mount()
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+
+	c.Assert(repo.SetDigestAlgorithm(digest.SHA512), NotNil)
+
+	// scratch space for callers is still on the host.
+	dir, err := repo.TempDir()
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	fi, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+
+	c.Assert(top.Remove(), IsNil)
+	c.Assert(top.Exists(), Equals, false)
+
+	c.Assert(repo.Close(), IsNil)
+	c.Assert(base.Exists(), Equals, false)
+	_, err = repo.GetTag("latest")
+	c.Assert(errors.Cause(err), Equals, ErrTagDoesNotExist)
+
+	// repositories are not shared.
+	other := NewMemoryRepository()
+	c.Assert(other.SetDigestAlgorithm(digest.SHA512), IsNil)
+	layer, err := other.CreateLayerFromAsset(makeTar(c, entries), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(layer.Digest().Algorithm(), Equals, digest.SHA512)
+	c.Assert(NewMemoryRepository().DigestAlgorithm(), Equals, digest.SHA256)
+
+	// other repositories are kept.
+	c.Assert(m.Repository.Close(), IsNil)
+	_, err = os.Stat(m.Repository.baseDir)
+	c.Assert(err, IsNil)
+}
+
+func (m *mountSuite) TestMemoryFS(c *C) {
+	mfs := newMemFS()
+
+	_, err := mfs.Create("/missing/file")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(mfs.MkdirAll("/a/b", 0700), IsNil)
+	f, err := mfs.Create("/a/b/file")
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("hello world"))
+	c.Assert(err, IsNil)
+	_, err = f.Seek(6, io.SeekStart)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("there"))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	content, err := readFile(mfs, "/a/b/file")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello there")
+
+	_, err = mfs.OpenFile("/a/b/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	c.Assert(os.IsExist(err), Equals, true)
+
+	// open files keep their contents when renamed or removed.
+	f, err = mfs.Open("/a/b/file")
+	c.Assert(err, IsNil)
+	c.Assert(mfs.Rename("/a", "/c"), IsNil)
+	_, err = mfs.Lstat("/a/b/file")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(mfs.Remove("/c/b/file"), IsNil)
+	content, err = ioutil.ReadAll(f)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "hello there")
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(writeFile(mfs, "/c/b/other", []byte("x"), 0600), IsNil)
+	c.Assert(mfs.Remove("/c/b"), NotNil)
+	c.Assert(mfs.Rename("/c", "/c/b/d"), NotNil)
+
+	infos, err := mfs.ReadDir("/c/b")
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Name(), Equals, "other")
+	c.Assert(infos[0].Mode(), Equals, os.FileMode(0600))
+	c.Assert(infos[0].Size(), Equals, int64(1))
+
+	c.Assert(mfs.RemoveAll("/c"), IsNil)
+	_, err = mfs.Lstat("/c/b/other")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	fi, err := mfs.Lstat("/")
+	c.Assert(err, IsNil)
+	c.Assert(fi.IsDir(), Equals, true)
+}
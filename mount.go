@@ -19,23 +19,29 @@ func forceUnmount(target string) (retErr error) {
 	return unix.Unmount(target, 0) // showing restraint
 }
 
-// makeMountOptions makes the lower,upper,work filesystem options.
-func (m *Mount) makeMountOptions() (string, error) {
+// makeMountOptions makes the lower,upper,work filesystem options, followed by
+// those in extra.
+func (m *Mount) makeMountOptions(extra []overlayOption) (string, error) {
 	if m.lower == "" {
 		return "", errors.Wrap(ErrMountCannotProceed, "No lower dir specified (only one layer?)")
 	}
 
-	return fmt.Sprintf("upperdir=%s,lowerdir=%s,workdir=%s", m.upper, m.lower, m.work), nil
-}
+	opts := fmt.Sprintf("upperdir=%s,lowerdir=%s,workdir=%s", m.upper, m.lower, m.work)
+	if m.ReadOnly() {
+		opts = fmt.Sprintf("lowerdir=%s", m.lower)
+	}
 
-// Open an overlay mount at (*Mount).Target; returns any errors.
-func (m *Mount) Open() error {
-	opts, err := m.makeMountOptions()
-	if err != nil {
-		return err
+	for _, opt := range extra {
+		opts += "," + opt.String()
 	}
 
-	if err := unix.Mount("overlay", m.target, "overlay", 0, opts); err != nil {
+	return opts, nil
+}
+
+// Open mounts the layers at (*Mount).Target with the mount's driver, overlay
+// unless the repository was given another one; returns any errors.
+func (m *Mount) Open() error {
+	if err := m.mountDriver().Mount(m); err != nil {
 		return err
 	}
 
@@ -43,9 +49,15 @@ func (m *Mount) Open() error {
 	return nil
 }
 
+// ReadOnly reports if the mount has no upper dir, as created by
+// NewReadOnlyMount.
+func (m *Mount) ReadOnly() bool {
+	return m.upper == ""
+}
+
 // Close a mount and remove the work directory. The target directory is left untouched.
 func (m *Mount) Close() error {
-	if err := unix.Unmount(m.target, 0); err != nil {
+	if err := m.mountDriver().Unmount(m); err != nil {
 		return err
 	}
 
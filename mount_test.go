@@ -1,6 +1,13 @@
 package overmount
 
 import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 
 	. "gopkg.in/check.v1"
@@ -11,3 +18,59 @@ func (m *mountSuite) TestMountUnmountProperties(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(errors.Cause(mount.Open()), Equals, ErrMountCannotProceed)
 }
+
+func (m *mountSuite) TestMountManyLayers(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{{name: "motd", content: "hello", typeflag: tar.TypeReg}}), nil, false)
+	c.Assert(err, IsNil)
+
+	// the paths of the lower dirs add up to more than a page.
+	for i := 0; i < 60; i++ {
+		layer, err = m.Repository.CreateLayer(digest.FromString(string(rune(i))).Hex(), layer, false)
+		c.Assert(err, IsNil)
+	}
+
+	mount, err := m.Repository.NewMount("/", "", "")
+	c.Assert(err, IsNil)
+	lower, err := m.Repository.NewImage(layer).lowerDirs(layer.Parent)
+	c.Assert(err, IsNil)
+	mount.lower = lower
+	opts, err := mount.makeMountOptions(nil)
+	c.Assert(err, IsNil)
+	c.Assert(mountOptionsFit(opts), Equals, false)
+
+	for _, readOnly := range []bool{false, true} {
+		image := m.Repository.NewImage(layer)
+		if readOnly {
+			c.Assert(image.MountReadOnly(), IsNil)
+		} else {
+			c.Assert(image.Mount(), IsNil)
+		}
+		c.Assert(image.mount.Mounted(), Equals, true)
+
+		content, err := ioutil.ReadFile(filepath.Join(layer.MountPath(), "motd"))
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, "hello")
+		c.Assert(image.Unmount(), IsNil)
+		c.Assert(os.Remove(layer.MountPath()), IsNil)
+	}
+
+	// failures of the mount itself are reported like those of mount(2).
+	mount, err = m.Repository.NewReadOnlyMount(filepath.Join(m.Repository.baseDir, "missing", "target"), lower)
+	c.Assert(err, IsNil)
+	err = mount.Open()
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+	c.Assert(err, ErrorMatches, ".* of 60 layers .*")
+	c.Assert(mount.Mounted(), Equals, false)
+
+	lower = strings.TrimSuffix(strings.Repeat("/nonexistent/lower/dir:", maxLowerDirs+1), ":")
+	mount, err = m.Repository.NewReadOnlyMount(filepath.Join(m.Repository.baseDir, "target"), lower)
+	c.Assert(err, IsNil)
+	err = mount.Open()
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+	c.Assert(err, ErrorMatches, ".*overlay stacks at most 500.*")
+}
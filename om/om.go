@@ -77,6 +77,23 @@ func main() {
 							Value: "docker",
 							Usage: "Set the type of image to export [docker|oci]",
 						},
+						cli.BoolFlag{
+							Name:  "reproducible",
+							Usage: "Pack layers reproducibly (sorted, numeric owners, mtimes clamped to $SOURCE_DATE_EPOCH)",
+						},
+						cli.StringFlag{
+							Name:  "compression",
+							Value: "uncompressed",
+							Usage: "Compress layers on export [uncompressed|gzip|zstd|xz]",
+						},
+						cli.StringSliceFlag{
+							Name:  "include",
+							Usage: "Only export the paths matching this pattern, in .dockerignore syntax (repeatable)",
+						},
+						cli.StringSliceFlag{
+							Name:  "exclude",
+							Usage: "Leave the paths matching this pattern, in .dockerignore syntax, out of the export (repeatable)",
+						},
 					},
 				},
 				{
@@ -88,6 +105,12 @@ func main() {
 					Name:   "mount",
 					Usage:  "perform an overlay mount on the image ID w/ children",
 					Action: mountImage,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "read-only",
+							Usage: "Mount all layers read-only, leaving the top layer untouched",
+						},
+					},
 				},
 				{
 					Name:   "unmount",
@@ -158,7 +181,13 @@ func mountImage(ctx *cli.Context) {
 		errExit(2, err)
 	}
 
-	if err := repo.NewImage(layer).Mount(); err != nil {
+	image := repo.NewImage(layer)
+	mount := image.Mount
+	if ctx.Bool("read-only") {
+		mount = image.MountReadOnly
+	}
+
+	if err := mount(); err != nil {
 		errExit(2, err)
 	}
 
@@ -190,14 +219,30 @@ func exportImage(ctx *cli.Context) {
 
 	var exporter overmount.Exporter
 
+	compression, err := overmount.ParseCompression(ctx.String("compression"))
+	if err != nil {
+		errExit(2, err)
+	}
+
+	packOptions := &overmount.PackOptions{
+		Reproducible: ctx.Bool("reproducible"),
+		Compression:  compression,
+		Include:      ctx.StringSlice("include"),
+		Exclude:      ctx.StringSlice("exclude"),
+	}
+
 	switch ctx.String("type") {
 	case "docker":
-		exporter, err = imgio.NewDocker(nil)
+		docker, err := imgio.NewDocker(nil)
 		if err != nil {
 			errExit(2, err)
 		}
+		docker.SetPackOptions(packOptions)
+		exporter = docker
 	case "oci":
-		exporter = imgio.NewOCI()
+		oci := imgio.NewOCI()
+		oci.SetPackOptions(packOptions)
+		exporter = oci
 	}
 
 	reader, err := exporter.Export(repo, layer, []string{})
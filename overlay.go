@@ -0,0 +1,225 @@
+package overmount
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// overlayParameters holds a file for each option of the overlay module, which
+// is how the kernel tells which of them it knows.
+var overlayParameters = "/sys/module/overlay/parameters"
+
+// OverlaySetting is the value of an overlay option. The zero value leaves
+// the option out of the mount, so the kernel default applies.
+type OverlaySetting string
+
+const (
+	// OverlayDefault leaves the option to the kernel default.
+	OverlayDefault OverlaySetting = ""
+	// OverlayOn turns the option on.
+	OverlayOn OverlaySetting = "on"
+	// OverlayOff turns the option off.
+	OverlayOff OverlaySetting = "off"
+	// OverlayAuto lets the kernel decide, for Xino only.
+	OverlayAuto OverlaySetting = "auto"
+	// OverlayFollow follows existing redirects without creating new ones,
+	// for RedirectDir only.
+	OverlayFollow OverlaySetting = "follow"
+	// OverlayNoFollow neither follows nor creates redirects, for RedirectDir
+	// only.
+	OverlayNoFollow OverlaySetting = "nofollow"
+)
+
+// OverlayOptions are the features of overlay mounts beyond their dirs. See
+// https://www.kernel.org/doc/Documentation/filesystems/overlayfs.txt for what
+// each of them does. Options the running kernel does not support make the
+// mount fail with ErrMountCannotProceed, as does OverlayFeatures.Check.
+type OverlayOptions struct {
+	// Index is the index option, which keeps hardlinks intact on copy up.
+	Index OverlaySetting
+	// RedirectDir is the redirect_dir option, which lets directories be
+	// renamed without copying them up entirely. The renamed dirs point to
+	// their contents in the lower layers, so layers with such dirs cannot be
+	// packed: Pack fails with ErrInvalidLayer.
+	RedirectDir OverlaySetting
+	// Metacopy is the metacopy option: changes to the metadata of a file,
+	// such as chmod, copy up only the metadata and not its contents. It needs
+	// RedirectDir to be on or left to the default. As with RedirectDir, the
+	// contents stay in the lower layers, so Pack fails with ErrInvalidLayer
+	// for layers with such files.
+	Metacopy OverlaySetting
+	// Volatile skips all syncs to the upper dir, which is faster, but leaves it
+	// in an unknown state after a crash. It needs an upper dir, so it cannot be
+	// used with read-only mounts.
+	Volatile bool
+	// UserXattr stores the overlay attributes in the user.overlay namespace
+	// instead of trusted.overlay, as needed in user namespaces.
+	UserXattr bool
+	// Xino is the xino option, which makes inode numbers unique across the
+	// layers of the mount.
+	Xino OverlaySetting
+	// NFSExport is the nfs_export option, which makes the mount exportable
+	// over NFS. It needs Index to be on, and Metacopy not to be.
+	NFSExport OverlaySetting
+}
+
+// overlayOption is an option of an overlay mount; options without a value
+// are flags.
+type overlayOption struct {
+	key   string
+	value string
+}
+
+func (o overlayOption) String() string {
+	if o.value == "" {
+		return o.key
+	}
+
+	return fmt.Sprintf("%s=%s", o.key, o.value)
+}
+
+// OverlayFeatures are the options of OverlayOptions the running kernel
+// supports.
+type OverlayFeatures struct {
+	Index       bool
+	RedirectDir bool
+	Metacopy    bool
+	Volatile    bool
+	UserXattr   bool
+	Xino        bool
+	NFSExport   bool
+}
+
+// SupportedOverlayFeatures reads the features of overlay the running kernel
+// supports from the parameters of the overlay module. volatile and userxattr
+// have no parameters; they are supported from Linux 5.10 and 5.11 on.
+func SupportedOverlayFeatures() (*OverlayFeatures, error) {
+	if _, err := os.Stat(overlayParameters); err != nil {
+		return nil, errors.Wrapf(ErrMountCannotProceed, "cannot read overlay features, is the overlay module loaded? %v", err)
+	}
+
+	has := func(name string) bool {
+		_, err := os.Stat(filepath.Join(overlayParameters, name))
+		return err == nil
+	}
+
+	major, minor, err := kernelVersion()
+	if err != nil {
+		return nil, errors.Wrapf(ErrMountCannotProceed, "cannot read kernel version: %v", err)
+	}
+
+	return &OverlayFeatures{
+		Index:       has("index"),
+		RedirectDir: has("redirect_dir"),
+		Metacopy:    has("metacopy"),
+		Volatile:    major > 5 || (major == 5 && minor >= 10),
+		UserXattr:   major > 5 || (major == 5 && minor >= 11),
+		Xino:        has("xino_auto"),
+		NFSExport:   has("nfs_export"),
+	}, nil
+}
+
+// kernelVersion returns the major and minor version of the running kernel.
+func kernelVersion() (int, int, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return 0, 0, err
+	}
+
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor); err != nil {
+		return 0, 0, err
+	}
+
+	return major, minor, nil
+}
+
+// Check returns an error for options in opts that are invalid, or that f does
+// not support. readOnly is for mounts without an upper dir.
+func (f *OverlayFeatures) Check(opts OverlayOptions, readOnly bool) error {
+	_, err := f.options(opts, readOnly)
+	return err
+}
+
+// options checks opts, as Check does, and returns them as mount options.
+func (f *OverlayFeatures) options(opts OverlayOptions, readOnly bool) ([]overlayOption, error) {
+	result := []overlayOption{}
+
+	add := func(key string, supported bool, value OverlaySetting, valid ...OverlaySetting) error {
+		if value == OverlayDefault {
+			return nil
+		}
+
+		if !supported {
+			return errors.Wrapf(ErrMountCannotProceed, "overlay option %s is not supported by the running kernel", key)
+		}
+
+		for _, v := range valid {
+			if value == v {
+				result = append(result, overlayOption{key, string(value)})
+				return nil
+			}
+		}
+
+		return errors.Wrapf(ErrMountCannotProceed, "invalid value %q for overlay option %s", value, key)
+	}
+
+	flag := func(key string, supported bool, set bool) error {
+		if !set {
+			return nil
+		}
+
+		if !supported {
+			return errors.Wrapf(ErrMountCannotProceed, "overlay option %s is not supported by the running kernel", key)
+		}
+
+		result = append(result, overlayOption{key: key})
+		return nil
+	}
+
+	for _, err := range []error{
+		add("index", f.Index, opts.Index, OverlayOn, OverlayOff),
+		add("redirect_dir", f.RedirectDir, opts.RedirectDir, OverlayOn, OverlayOff, OverlayFollow, OverlayNoFollow),
+		add("metacopy", f.Metacopy, opts.Metacopy, OverlayOn, OverlayOff),
+		flag("volatile", f.Volatile, opts.Volatile),
+		flag("userxattr", f.UserXattr, opts.UserXattr),
+		add("xino", f.Xino, opts.Xino, OverlayOn, OverlayOff, OverlayAuto),
+		add("nfs_export", f.NFSExport, opts.NFSExport, OverlayOn, OverlayOff),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case opts.Volatile && readOnly:
+		return nil, errors.Wrap(ErrMountCannotProceed, "overlay option volatile needs an upper dir, which read-only mounts do not have")
+	case opts.Metacopy == OverlayOn && opts.RedirectDir != OverlayDefault && opts.RedirectDir != OverlayOn:
+		return nil, errors.Wrap(ErrMountCannotProceed, "overlay option metacopy needs redirect_dir=on")
+	case opts.NFSExport == OverlayOn && opts.Index != OverlayOn:
+		return nil, errors.Wrap(ErrMountCannotProceed, "overlay option nfs_export needs index=on")
+	case opts.NFSExport == OverlayOn && opts.Metacopy == OverlayOn:
+		return nil, errors.Wrap(ErrMountCannotProceed, "overlay options nfs_export and metacopy cannot be used together")
+	}
+
+	return result, nil
+}
+
+// overlayOptions returns opts as mount options, after checking them against
+// the features of the running kernel, which are only read if there are any.
+func overlayOptions(opts OverlayOptions, readOnly bool) ([]overlayOption, error) {
+	if opts == (OverlayOptions{}) {
+		return nil, nil
+	}
+
+	features, err := SupportedOverlayFeatures()
+	if err != nil {
+		return nil, err
+	}
+
+	return features.options(opts, readOnly)
+}
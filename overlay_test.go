@@ -0,0 +1,236 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestOverlayFeatures(c *C) {
+	dir, err := ioutil.TempDir("", "")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"index", "redirect_dir", "xino_auto"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte("N\n"), 0644), IsNil)
+	}
+
+	defer func(orig string) { overlayParameters = orig }(overlayParameters)
+	overlayParameters = dir
+
+	features, err := SupportedOverlayFeatures()
+	c.Assert(err, IsNil)
+	c.Assert(features.Index, Equals, true)
+	c.Assert(features.RedirectDir, Equals, true)
+	c.Assert(features.Xino, Equals, true)
+	c.Assert(features.Metacopy, Equals, false)
+	c.Assert(features.NFSExport, Equals, false)
+
+	opts, err := features.options(OverlayOptions{Index: OverlayOff, Xino: OverlayAuto}, false)
+	c.Assert(err, IsNil)
+	c.Assert(opts, DeepEquals, []overlayOption{{"index", "off"}, {"xino", "auto"}})
+
+	mount := &Mount{lower: "/a:/b", upper: "/u", work: "/w"}
+	options, err := mount.makeMountOptions(opts)
+	c.Assert(err, IsNil)
+	c.Assert(options, Equals, "upperdir=/u,lowerdir=/a:/b,workdir=/w,index=off,xino=auto")
+
+	mount.upper = ""
+	options, err = mount.makeMountOptions([]overlayOption{{key: "userxattr"}})
+	c.Assert(err, IsNil)
+	c.Assert(options, Equals, "lowerdir=/a:/b,userxattr")
+
+	for _, opts := range []OverlayOptions{
+		{Metacopy: OverlayOn},
+		{NFSExport: OverlayOff},
+		{Index: OverlayAuto},
+		{RedirectDir: "sideways"},
+	} {
+		c.Assert(errors.Cause(features.Check(opts, false)), Equals, ErrMountCannotProceed, Commentf("%+v", opts))
+	}
+
+	features = &OverlayFeatures{Index: true, RedirectDir: true, Metacopy: true, Volatile: true, UserXattr: true, Xino: true, NFSExport: true}
+	c.Assert(features.Check(OverlayOptions{Metacopy: OverlayOn, Volatile: true}, false), IsNil)
+	c.Assert(features.Check(OverlayOptions{NFSExport: OverlayOn, Index: OverlayOn}, true), IsNil)
+
+	for _, opts := range []OverlayOptions{
+		{Volatile: true},
+		{Metacopy: OverlayOn, RedirectDir: OverlayFollow},
+		{NFSExport: OverlayOn},
+		{NFSExport: OverlayOn, Index: OverlayOn, Metacopy: OverlayOn},
+	} {
+		c.Assert(errors.Cause(features.Check(opts, true)), Equals, ErrMountCannotProceed, Commentf("%+v", opts))
+	}
+
+	overlayParameters = filepath.Join(dir, "missing")
+	_, err = SupportedOverlayFeatures()
+	c.Assert(errors.Cause(err), Equals, ErrMountCannotProceed)
+
+	// without options, the features are not needed.
+	extra, err := overlayOptions(OverlayOptions{}, false)
+	c.Assert(err, IsNil)
+	c.Assert(extra, IsNil)
+}
+
+func (m *mountSuite) TestOverlayOptionsMount(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	features, err := SupportedOverlayFeatures()
+	c.Assert(err, IsNil)
+	if !features.Volatile || !features.Metacopy {
+		c.Skip("kernel does not support volatile and metacopy")
+		return
+	}
+
+	m.Repository.SetMountDriver(OverlayDriver{Options: OverlayOptions{Volatile: true, Metacopy: OverlayOn}})
+
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", content: "box", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+	layer, err := m.Repository.CreateLayer("layer", base, false)
+	c.Assert(err, IsNil)
+
+	image := m.Repository.NewImage(layer)
+	c.Assert(image.Mount(), IsNil)
+
+	mountinfo, err := ioutil.ReadFile("/proc/self/mountinfo")
+	c.Assert(err, IsNil)
+
+	var line string
+	for _, l := range strings.Split(string(mountinfo), "\n") {
+		if strings.Contains(l, " "+layer.MountPath()+" ") {
+			line = l
+		}
+	}
+	c.Assert(strings.Contains(line, "volatile"), Equals, true, Commentf("%s", line))
+	c.Assert(strings.Contains(line, "metacopy=on"), Equals, true, Commentf("%s", line))
+
+	// chmod copies up the metadata of the file only.
+	c.Assert(os.Chmod(filepath.Join(layer.MountPath(), "motd"), 0600), IsNil)
+	c.Assert(image.Unmount(), IsNil)
+
+	fi, err := os.Stat(filepath.Join(layer.Path(), "motd"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	_, err = lgetxattr(filepath.Join(layer.Path(), "motd"), "trusted.overlay.metacopy")
+	c.Assert(err, IsNil)
+
+	// the contents of motd are only in the base layer, so the layer cannot be
+	// packed on its own.
+	_, err = layer.Pack(ioutil.Discard)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidLayer)
+
+	c.Assert(os.Remove(filepath.Join(layer.Path(), "motd")), IsNil)
+	_, err = layer.Pack(ioutil.Discard)
+	c.Assert(err, IsNil)
+
+	// neither can it once a dir of the base layer was renamed.
+	c.Assert(os.Remove(layer.MountPath()), IsNil)
+	c.Assert(image.Mount(), IsNil)
+	c.Assert(os.Rename(filepath.Join(layer.MountPath(), "etc"), filepath.Join(layer.MountPath(), "config")), IsNil)
+	c.Assert(image.Unmount(), IsNil)
+
+	redirect, err := lgetxattr(filepath.Join(layer.Path(), "config"), "trusted.overlay.redirect")
+	c.Assert(err, IsNil)
+	c.Assert(redirect, NotNil)
+	_, err = layer.Pack(ioutil.Discard)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidLayer)
+
+	c.Assert(os.Remove(layer.MountPath()), IsNil)
+	c.Assert(errors.Cause(image.MountReadOnly()), Equals, ErrMountCannotProceed)
+}
+
+func (m *mountSuite) TestOverlayUserXattrPack(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("Cannot mount virtual layers")
+		return
+	}
+
+	features, err := SupportedOverlayFeatures()
+	c.Assert(err, IsNil)
+	if !features.UserXattr {
+		c.Skip("kernel does not support userxattr")
+		return
+	}
+
+	m.Repository.SetMountDriver(OverlayDriver{Options: OverlayOptions{UserXattr: true}})
+
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "motd", content: "hello", typeflag: tar.TypeReg},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hostname", content: "box", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+	layer, err := m.Repository.CreateLayer("layer", base, false)
+	c.Assert(err, IsNil)
+
+	// recreating a dir of the base layer makes it opaque.
+	image := m.Repository.NewImage(layer)
+	c.Assert(image.Mount(), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(layer.MountPath(), "etc")), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(layer.MountPath(), "etc"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(layer.MountPath(), "etc", "hosts"), []byte("localhost"), 0644), IsNil)
+	c.Assert(image.Unmount(), IsNil)
+
+	opaque, err := lgetxattr(filepath.Join(layer.Path(), "etc"), userOverlayPrefix+"opaque")
+	c.Assert(err, IsNil)
+	c.Assert(string(opaque), Equals, "y")
+	c.Assert(unix.Lsetxattr(filepath.Join(layer.Path(), "etc", "hosts"), userOverlayPrefix+"origin", []byte("x"), 0), IsNil)
+	c.Assert(unix.Lsetxattr(filepath.Join(layer.Path(), "etc", "hosts"), "user.comment", []byte("kept"), 0), IsNil)
+
+	for _, opts := range []*PackOptions{nil, {Reproducible: true}} {
+		buf := new(bytes.Buffer)
+		_, err = layer.PackWithOptions(buf, opts)
+		c.Assert(err, IsNil)
+
+		names := []string{}
+		tr := tar.NewReader(buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			names = append(names, strings.TrimSuffix(header.Name, "/"))
+
+			for key := range header.PAXRecords {
+				c.Assert(strings.HasPrefix(key, paxXattrPrefix+userOverlayPrefix), Equals, false, Commentf("%s: %s", header.Name, key))
+			}
+
+			if header.Name == "etc/hosts" {
+				c.Assert(header.PAXRecords[paxXattrPrefix+"user.comment"], Equals, "kept")
+			}
+		}
+
+		c.Assert(names, DeepEquals, []string{"etc", "etc/.wh..wh..opq", "etc/hosts"}, Commentf("%+v", opts))
+	}
+
+	// the dir stays opaque once the tar is unpacked.
+	buf := new(bytes.Buffer)
+	_, err = layer.Pack(buf)
+	c.Assert(err, IsNil)
+	unpacked, err := m.Repository.CreateLayerFromAsset(buf, base, false)
+	c.Assert(err, IsNil)
+
+	imageFS := m.Repository.NewImage(unpacked).FS()
+	_, err = fs.Stat(imageFS, "etc/hostname")
+	c.Assert(os.IsNotExist(err), Equals, true)
+	content, err := fs.ReadFile(imageFS, "etc/hosts")
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "localhost")
+}
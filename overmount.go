@@ -15,6 +15,7 @@ import (
 	"io"
 	"sync"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -45,6 +46,22 @@ var (
 
 	// ErrMountExists is called when a mount already exists in the repository.
 	ErrMountExists = errors.New("mount already exists")
+
+	// ErrManifestMismatch is returned when the contents of a layer no longer
+	// match its manifest.
+	ErrManifestMismatch = errors.New("layer does not match its manifest")
+
+	// ErrUnpackLimit is the cause of a *LimitError, returned when a tar
+	// violates the UnpackOptions it is unpacked with.
+	ErrUnpackLimit = errors.New("unpack limit exceeded")
+
+	// ErrDigestMismatch is the cause of a *DigestMismatchError, returned when
+	// an unpacked tar does not have the expected digest.
+	ErrDigestMismatch = errors.New("digest mismatch")
+
+	// ErrDigestAlgorithm is returned when a digest algorithm is not supported,
+	// or would be mixed with another one.
+	ErrDigestAlgorithm = errors.New("invalid digest algorithm")
 )
 
 const (
@@ -68,14 +85,25 @@ const (
 //        mount/
 //          another-layer-id/
 //          top-layer/
+//        files/
+//          file-digest
+//
+// The files directory only exists if deduplication is in use; see SetDedupe.
 //
 // Repositories can hold any number of mounts and layers. They do not
 // necessarily need to be related.
 type Repository struct {
-	baseDir string
-	layers  map[string]*Layer
-	mounts  []*Mount
-	virtual bool
+	baseDir      string
+	layers       map[string]*Layer
+	mounts       []*Mount
+	virtual      bool
+	memory       bool
+	fs           fileSystem
+	dedupe       DedupeMode
+	idMapping    *IDMapping
+	selinuxLabel string
+	algorithm    digest.Algorithm
+	mountDriver  MountDriver
 
 	editMutex *sync.Mutex
 }
@@ -90,6 +118,7 @@ type Mount struct {
 	repository *Repository
 	work       string
 	mounted    bool
+	driver     MountDriver
 }
 
 // Layer is the representation of a filesystem layer. Layers are organized in a
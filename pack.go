@@ -0,0 +1,326 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+// SourceDateEpochEnv is the environment variable consulted for the clamping
+// timestamp when PackOptions.SourceDateEpoch is not set. See
+// https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// PackOptions controls how an asset is packed. A nil *PackOptions is the same
+// as the zero value.
+type PackOptions struct {
+	// Reproducible packs expanded assets so that identical contents always
+	// produce a byte-identical tar: entries are walked in sorted order, headers
+	// are always written in the PAX format, owners are numeric only, and
+	// modification times are truncated to the second and clamped to
+	// SourceDateEpoch. Virtual assets are always reproducible, as their tar is
+	// copied verbatim. This takes precedence over rebuilding the tar the
+	// asset was unpacked from. As where a filesystem leaves holes is not part
+	// of the contents, sparse files are written out in full.
+	Reproducible bool
+
+	// SourceDateEpoch is the latest modification time written in reproducible
+	// mode. If zero, $SOURCE_DATE_EPOCH is used, and failing that the unix
+	// epoch itself.
+	SourceDateEpoch time.Time
+
+	// Compression compresses the packed tar. The digest of the asset is still
+	// computed over the uncompressed tar; see Asset.CompressedDigest for the
+	// digest of what was written.
+	Compression Compression
+
+	// Include limits the tar to the paths matching these patterns, in
+	// .dockerignore syntax; patterns starting with "!" leave paths out again.
+	// Directories are included by the patterns matching them, not by the
+	// paths below them. If empty, everything is included.
+	Include []string
+
+	// Exclude leaves the paths matching these patterns, in .dockerignore
+	// syntax, out of the tar; patterns starting with "!" are exceptions. It is
+	// applied after Include.
+	//
+	// With Include or Exclude, the tar is always packed anew, so it no longer
+	// has the digest it was unpacked with.
+	Exclude []string
+}
+
+func (opts *PackOptions) sourceDateEpoch() (time.Time, error) {
+	if !opts.SourceDateEpoch.IsZero() {
+		return opts.SourceDateEpoch, nil
+	}
+
+	if env := os.Getenv(SourceDateEpochEnv); env != "" {
+		secs, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(ErrInvalidAsset, "invalid %s: %v", SourceDateEpochEnv, err)
+		}
+		return time.Unix(secs, 0), nil
+	}
+
+	return time.Unix(0, 0), nil
+}
+
+// ClampTime returns t as reproducible mode writes it: truncated to the second
+// and no later than SourceDateEpoch, so exporters can apply the same clamping
+// to the times in image configs. Outside of reproducible mode, t is returned
+// as it is.
+func (opts *PackOptions) ClampTime(t time.Time) (time.Time, error) {
+	if opts == nil || !opts.Reproducible || t.IsZero() {
+		return t, nil
+	}
+
+	epoch, err := opts.sourceDateEpoch()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t = t.Truncate(time.Second)
+	if t.After(epoch) {
+		return epoch.UTC(), nil
+	}
+
+	return t, nil
+}
+
+// packReproducible writes the asset's tree to writer as described in
+// PackOptions.Reproducible.
+func (a *Asset) packReproducible(writer io.Writer, opts *PackOptions) error {
+	root := a.path
+
+	epoch, err := opts.sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	filter, err := newPackFilter(opts)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(writer)
+	seen := map[[2]uint64]string{}
+
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		name := filepath.ToSlash(rel)
+
+		if excluded, err := filter.skip(name, fi); excluded || err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = name
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+
+		header.Format = tar.FormatPAX
+		header.Uname = ""
+		header.Gname = ""
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.ModTime = fi.ModTime().Truncate(time.Second)
+		if header.ModTime.After(epoch) {
+			header.ModTime = epoch
+		}
+		header.ModTime = header.ModTime.UTC()
+
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			header.Uid, header.Gid, err = a.containerOwner(p, int(stat.Uid), int(stat.Gid))
+			if err != nil {
+				return err
+			}
+
+			if !fi.IsDir() && stat.Nlink > 1 {
+				inode := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+				if target, ok := seen[inode]; ok {
+					header.Typeflag = tar.TypeLink
+					header.Linkname = target
+					header.Size = 0
+				} else {
+					seen[inode] = name
+				}
+			}
+		}
+
+		if err := a.setXattrs(header, p); err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if err := writeOpaque(tw, header, p); err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg || header.Size == 0 {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// tarStream tars up the expanded asset, with the owners and extended
+// attributes as they should be written to the tar, and the paths selected by
+// filter, which may be nil.
+func (a *Asset) tarStream(filter *packFilter) (io.ReadCloser, error) {
+	opts := &archive.TarOptions{}
+
+	// without exceptions, archive.Tar can skip excluded directories as a
+	// whole.
+	if filter != nil && !filter.pm.Exclusions() {
+		opts.ExcludePatterns = filter.patterns
+	}
+
+	reader, err := archive.TarWithOptions(a.path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := a.rewriteHeaders(reader, pw, filter)
+		reader.Close()
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// rewriteHeaders rewrites the owners of the tar in reader with
+// containerOwner, and its extended attributes with setXattrs, as archive.Tar
+// only carries security.capability. Files with holes are rewritten as sparse
+// entries, as archive.Tar writes them out in full. Entries not selected by
+// filter, which may be nil, are left out.
+func (a *Asset) rewriteHeaders(reader io.Reader, writer io.Writer, filter *packFilter) error {
+	tr := tar.NewReader(reader)
+	tw := tar.NewWriter(writer)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		excluded, target, err := filter.filter(header)
+		if err != nil {
+			return err
+		}
+
+		if excluded {
+			continue
+		}
+
+		p := filepath.Join(a.path, header.Name)
+
+		stat, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+
+		// the hardlink is packed with the contents of its excluded target.
+		if target != "" {
+			header.Size = stat.Size()
+		}
+
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			uid, gid, err := a.containerOwner(p, int(sys.Uid), int(sys.Gid))
+			if err != nil {
+				return err
+			}
+
+			// the names were looked up for the host IDs.
+			if uid != header.Uid || gid != header.Gid {
+				header.Uid, header.Gid = uid, gid
+				header.Uname, header.Gname = "", ""
+			}
+		}
+
+		if err := a.setXattrs(header, p); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			ok, err := writeSparseEntry(writer, tw, header, p)
+			if err != nil {
+				return err
+			}
+
+			if ok {
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if err := writeOpaque(tw, header, p); err != nil {
+			return err
+		}
+
+		if target != "" {
+			err = copyFrom(tw, p)
+		} else {
+			_, err = io.Copy(tw, tr)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,105 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestPackReproducible(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers are always packed verbatim")
+		return
+	}
+
+	layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/b", content: "b", typeflag: tar.TypeReg},
+		{name: "etc/a", content: "a", typeflag: tar.TypeReg},
+		{name: "etc/a-link", linkname: "etc/a", typeflag: tar.TypeLink},
+		{name: "etc/sym", linkname: "a", typeflag: tar.TypeSymlink},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	epoch := time.Unix(1000000000, 0)
+	opts := &PackOptions{Reproducible: true, SourceDateEpoch: epoch}
+
+	pack := func(layer *Layer) []byte {
+		buf := new(bytes.Buffer)
+		_, err := layer.PackWithOptions(buf, opts)
+		c.Assert(err, IsNil)
+		return buf.Bytes()
+	}
+
+	now := time.Now()
+	c.Assert(os.Chtimes(filepath.Join(layer.Path(), "etc", "b"), now, now), IsNil)
+	first := pack(layer)
+
+	future := now.Add(time.Hour)
+	c.Assert(os.Chtimes(filepath.Join(layer.Path(), "etc", "b"), future, future), IsNil)
+	c.Assert(bytes.Equal(pack(layer), first), Equals, true)
+
+	copied, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(first), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(pack(copied), first), Equals, true)
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(first))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		c.Assert(header.Uname, Equals, "")
+		c.Assert(header.Gname, Equals, "")
+		c.Assert(header.ModTime.After(epoch), Equals, false)
+		if header.Name == "etc/a-link" {
+			c.Assert(header.Typeflag, Equals, byte(tar.TypeLink))
+		}
+		names = append(names, header.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"etc/", "etc/a", "etc/a-link", "etc/b", "etc/sym"})
+
+	os.Setenv(SourceDateEpochEnv, "garbage")
+	defer os.Unsetenv(SourceDateEpochEnv)
+	_, err = layer.PackWithOptions(new(bytes.Buffer), &PackOptions{Reproducible: true})
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+}
+
+func (m *mountSuite) TestPackClampTime(c *C) {
+	epoch := time.Unix(1000000000, 0)
+	now := time.Now().UTC()
+
+	for _, opts := range []*PackOptions{nil, {}, {SourceDateEpoch: epoch}} {
+		clamped, err := opts.ClampTime(now)
+		c.Assert(err, IsNil)
+		c.Assert(clamped.Equal(now), Equals, true)
+	}
+
+	opts := &PackOptions{Reproducible: true, SourceDateEpoch: epoch}
+	clamped, err := opts.ClampTime(now)
+	c.Assert(err, IsNil)
+	c.Assert(clamped.Equal(epoch), Equals, true)
+
+	past := time.Unix(500000000, 500)
+	clamped, err = opts.ClampTime(past)
+	c.Assert(err, IsNil)
+	c.Assert(clamped.Equal(time.Unix(500000000, 0)), Equals, true)
+
+	clamped, err = opts.ClampTime(time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(clamped.IsZero(), Equals, true)
+
+	os.Setenv(SourceDateEpochEnv, "1000")
+	defer os.Unsetenv(SourceDateEpochEnv)
+	clamped, err = (&PackOptions{Reproducible: true}).ClampTime(now)
+	c.Assert(err, IsNil)
+	c.Assert(clamped.Equal(time.Unix(1000, 0)), Equals, true)
+}
@@ -0,0 +1,158 @@
+package overmount
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Rebase moves the layers above oldBase (up to and including top) onto
+// newBase. The layers themselves are not repacked: a layer's ID is the digest
+// of its own contents, which do not change, so only the parent files are
+// rewritten. Image configurations are a different story; their ID and Parent
+// fields are derived from the chain below them, so they are recalculated for
+// every rebased layer that has them set.
+//
+// If newBase is nil, the layers become a base image of their own. If a layer
+// cannot be rebased, the layers rebased before it are moved back onto
+// oldBase, so the chain is never left split between both bases.
+func (r *Repository) Rebase(top, oldBase, newBase *Layer) error {
+	if oldBase == nil {
+		return errors.Wrap(ErrImageCannotBeComposed, "old base is nil")
+	}
+
+	layers, err := layerRange(top, oldBase)
+	if err != nil {
+		return err
+	}
+
+	for iter := newBase; iter != nil; iter = iter.Parent {
+		for _, layer := range layers {
+			if iter.ID() == layer.ID() {
+				return errors.Wrapf(ErrImageCannotBeComposed, "new base %q contains rebased layer %q", newBase.ID(), layer.ID())
+			}
+		}
+	}
+
+	backups := []*rebaseBackup{}
+	fail := func(err error) error {
+		for i := len(backups) - 1; i >= 0; i-- {
+			backups[i].restore()
+		}
+		return err
+	}
+
+	parent := newBase
+	for _, layer := range layers {
+		backup, err := backupLayer(layer)
+		if err != nil {
+			return fail(err)
+		}
+		backups = append(backups, backup)
+
+		layer.Parent = parent
+
+		err = layer.edit(func() error {
+			if parent == nil {
+				err := layer.repository.fs.Remove(layer.parentPath())
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			return layer.overwriteParent()
+		})
+		if err != nil {
+			return fail(err)
+		}
+
+		if err := layer.rebaseConfig(); err != nil {
+			return fail(err)
+		}
+
+		parent = layer
+	}
+
+	return nil
+}
+
+// rebaseBackup holds what Rebase changes of a layer: its parent, and the
+// contents of its parent and config files, which are nil if they did not
+// exist.
+type rebaseBackup struct {
+	layer  *Layer
+	parent *Layer
+	files  map[string][]byte
+}
+
+func backupLayer(layer *Layer) (*rebaseBackup, error) {
+	backup := &rebaseBackup{
+		layer:  layer,
+		parent: layer.Parent,
+		files:  map[string][]byte{},
+	}
+
+	for _, p := range []string{layer.parentPath(), layer.configPath()} {
+		content, err := readFile(layer.repository.fs, p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		backup.files[p] = content
+	}
+
+	return backup, nil
+}
+
+// restore puts the layer back the way it was backed up. It is used on errors
+// only, so it does what it can and reports nothing.
+func (b *rebaseBackup) restore() {
+	b.layer.Parent = b.parent
+
+	b.layer.edit(func() error {
+		for p, content := range b.files {
+			if content == nil {
+				b.layer.repository.fs.Remove(p)
+			} else {
+				writeFile(b.layer.repository.fs, p, content, 0600)
+			}
+		}
+		return nil
+	})
+}
+
+// rebaseConfig recalculates the ID and Parent of the layer's image
+// configuration from its (new) parent. Layers without a configuration are
+// left alone.
+func (l *Layer) rebaseConfig() error {
+	config, err := l.Config()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var parentID string
+
+	if l.Parent != nil {
+		parentID = l.Parent.ID()
+
+		parentConfig, err := l.Parent.Config()
+		if err == nil && parentConfig.ID != "" {
+			parentID = parentConfig.ID
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if config.Parent != "" || l.Parent != nil {
+		config.Parent = parentID
+	}
+
+	if config.ID != "" {
+		config.ID = l.repository.algorithm.FromBytes([]byte(parentID + " " + l.ID())).Hex()
+	}
+
+	return l.SaveConfig(config)
+}
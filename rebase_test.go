@@ -0,0 +1,104 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestRebase(c *C) {
+	oldBase, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "os-release", content: "1.0", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	newBase, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "os-release", content: "1.1", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	app, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "app", content: "app", typeflag: tar.TypeReg},
+	}), oldBase, false)
+	c.Assert(err, IsNil)
+	c.Assert(app.SaveConfig(&ImageConfig{ID: "stale", Parent: oldBase.ID(), Cmd: []string{"app"}}), IsNil)
+
+	top, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "config", content: "config", typeflag: tar.TypeReg},
+	}), app, false)
+	c.Assert(err, IsNil)
+
+	c.Assert(errors.Cause(m.Repository.Rebase(top, newBase, oldBase)), Equals, ErrImageCannotBeComposed)
+	c.Assert(errors.Cause(m.Repository.Rebase(oldBase, oldBase, newBase)), Equals, ErrImageCannotBeComposed)
+	c.Assert(errors.Cause(m.Repository.Rebase(app, oldBase, top)), Equals, ErrImageCannotBeComposed)
+
+	appID, topID := app.ID(), top.ID()
+
+	c.Assert(m.Repository.Rebase(top, oldBase, newBase), IsNil)
+	c.Assert(top.ID(), Equals, topID)
+	c.Assert(app.ID(), Equals, appID)
+	c.Assert(app.Parent, Equals, newBase)
+
+	config, err := app.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Parent, Equals, newBase.ID())
+	c.Assert(config.ID, Not(Equals), "stale")
+	c.Assert(config.Cmd, DeepEquals, []string{"app"})
+
+	m.Repository, err = NewRepository(m.Repository.baseDir, os.Getenv("VIRTUAL") != "")
+	c.Assert(err, IsNil)
+	restored, err := m.Repository.NewLayer(topID, nil)
+	c.Assert(err, IsNil)
+	c.Assert(restored.RestoreParent(), IsNil)
+	c.Assert(restored.Parent.ID(), Equals, appID)
+	c.Assert(restored.Parent.Parent.ID(), Equals, newBase.ID())
+	c.Assert(restored.Parent.Parent.Parent, IsNil)
+
+	c.Assert(m.Repository.Rebase(restored, restored.Parent.Parent, nil), IsNil)
+	_, err = os.Stat(restored.Parent.parentPath())
+	c.Assert(os.IsNotExist(err), Equals, true)
+	config, err = restored.Parent.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Parent, Equals, "")
+}
+
+func (m *mountSuite) TestRebaseFailure(c *C) {
+	oldBase, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "os-release", content: "1.0", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	newBase, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "os-release", content: "1.1", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	app, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "app", content: "app", typeflag: tar.TypeReg},
+	}), oldBase, false)
+	c.Assert(err, IsNil)
+	c.Assert(app.SaveConfig(&ImageConfig{ID: "stale", Parent: oldBase.ID()}), IsNil)
+
+	top, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "config", content: "config", typeflag: tar.TypeReg},
+	}), app, false)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(top.configPath(), []byte("{"), 0600), IsNil)
+
+	// the config of top cannot be rebased, so app is moved back.
+	c.Assert(m.Repository.Rebase(top, oldBase, newBase), NotNil)
+	c.Assert(app.Parent, Equals, oldBase)
+	c.Assert(top.Parent, Equals, app)
+
+	parent, err := ioutil.ReadFile(app.parentPath())
+	c.Assert(err, IsNil)
+	c.Assert(string(parent), Equals, oldBase.ID())
+
+	config, err := app.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.ID, Equals, "stale")
+	c.Assert(config.Parent, Equals, oldBase.ID())
+}
@@ -9,21 +9,31 @@ import (
 	"strings"
 	"sync"
 
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
 const lockFile = "repository.lock"
 
 // NewRepository constructs a *Repository and creates the dir in which the
-// repository lives. A repository is used to hold images and mounts.
+// repository lives. A repository is used to hold images and mounts. Layers are
+// digested with SHA-256 unless SetDigestAlgorithm was used on the repository.
 func NewRepository(baseDir string, virtual bool) (*Repository, error) {
-	return &Repository{
+	r := &Repository{
 		baseDir:   baseDir,
 		layers:    map[string]*Layer{},
 		mounts:    []*Mount{},
 		editMutex: new(sync.Mutex),
 		virtual:   virtual,
-	}, os.MkdirAll(baseDir, 0700)
+		fs:        osFS{},
+		algorithm: digest.SHA256,
+	}
+
+	if err := os.MkdirAll(baseDir, 0700); err != nil {
+		return r, err
+	}
+
+	return r, r.loadAlgorithm()
 }
 
 // IsVirtual reports if the repository is virtual. Virtual repositories hold
@@ -32,8 +42,13 @@ func (r *Repository) IsVirtual() bool {
 	return r.virtual
 }
 
-// TempDir returns a temporary path within the repository
+// TempDir returns a temporary path within the repository. Memory
+// repositories return one in the system's temp dir.
 func (r *Repository) TempDir() (string, error) {
+	if r.memory {
+		return ioutil.TempDir("", "overmount-")
+	}
+
 	basePath := filepath.Join(r.baseDir, tmpdirBase)
 	if err := os.MkdirAll(basePath, 0700); err != nil {
 		return "", err
@@ -41,8 +56,13 @@ func (r *Repository) TempDir() (string, error) {
 	return ioutil.TempDir(basePath, "")
 }
 
-// TempFile returns a temporary file within the repository
+// TempFile returns a temporary file within the repository. Memory
+// repositories return one in the system's temp dir.
 func (r *Repository) TempFile() (*os.File, error) {
+	if r.memory {
+		return ioutil.TempFile("", "overmount-")
+	}
+
 	basePath := filepath.Join(r.baseDir, tmpdirBase)
 	if err := os.MkdirAll(basePath, 0700); err != nil {
 		return nil, err
@@ -50,6 +70,16 @@ func (r *Repository) TempFile() (*os.File, error) {
 	return ioutil.TempFile(basePath, "")
 }
 
+// tempFile returns a temporary file where the repository keeps its files,
+// which is memory for memory repositories.
+func (r *Repository) tempFile() (file, error) {
+	basePath := filepath.Join(r.baseDir, tmpdirBase)
+	if err := r.fs.MkdirAll(basePath, 0700); err != nil {
+		return nil, err
+	}
+	return r.fs.TempFile(basePath, "")
+}
+
 // NewMount creates a new mount for use. Target, lower, and upper correspond to
 // specific fields in the mount stanza; read
 // https://www.kernel.org/doc/Documentation/filesystems/overlayfs.txt for more
@@ -65,6 +95,24 @@ func (r *Repository) NewMount(target, lower, upper string) (*Mount, error) {
 		upper:  upper,
 		lower:  lower,
 		work:   workDir,
+		driver: r.mountDriver,
+	}
+
+	if err := r.AddMount(mount); err != nil {
+		return nil, err
+	}
+
+	return mount, nil
+}
+
+// NewReadOnlyMount creates a new read-only mount for use. Without an upper
+// dir, nothing in lower can change, and no work dir is needed; a single lower
+// dir is bind mounted instead, as overlay needs at least two.
+func (r *Repository) NewReadOnlyMount(target, lower string) (*Mount, error) {
+	mount := &Mount{
+		target: target,
+		lower:  lower,
+		driver: r.mountDriver,
 	}
 
 	if err := r.AddMount(mount); err != nil {
@@ -88,7 +136,7 @@ func (r *Repository) mkdirCheckRel(path string) error {
 }
 
 func (r *Repository) edit(editFunc func() error) error {
-	return edit(path.Join(r.baseDir, lockFile), r.editMutex, editFunc)
+	return edit(r.fs, path.Join(r.baseDir, lockFile), r.editMutex, editFunc)
 }
 
 // AddLayer adds a layer to the repository.
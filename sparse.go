@@ -0,0 +1,867 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sparseBlockSize is the granularity at which Unpack looks for runs of zeroes
+// in sparse files, matching the block size of common filesystems.
+const sparseBlockSize = 4096
+
+const (
+	paxGNUSparsePrefix = "GNU.sparse."
+	capabilityXattr    = "security.capability"
+)
+
+// sparseEntry is an extent of a sparse file which holds data.
+type sparseEntry struct {
+	Offset int64
+	Length int64
+}
+
+// sparseFile is the contents of a sparse file held back from the unpacker.
+// They are written, with holes, to temp, and moved into the unpacked file
+// once the tar was unpacked.
+type sparseFile struct {
+	temp string
+	size int64
+}
+
+// isSparseHeader reports if header is a sparse file, in either the old GNU or
+// the PAX format.
+func isSparseHeader(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterSparse passes the tar in reader on through the returned reader, with
+// its sparse files replaced by empty placeholders; the unpacker would write
+// out their holes in full. The returned function must be called with the
+// result of unpacking the returned reader. It restores the contents of the
+// sparse files, keeping their holes, and returns their sparse maps by entry
+// name.
+func (a *Asset) filterSparse(reader io.Reader) (io.Reader, func(error) (map[string]sparseMap, error)) {
+	pr, pw := io.Pipe()
+	files := map[string]sparseFile{}
+	maps := map[string]sparseMap{}
+	done := make(chan error, 1)
+
+	go func() {
+		err := a.holdSparse(reader, pw, files, maps)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	return pr, func(unpackErr error) (map[string]sparseMap, error) {
+		if unpackErr != nil {
+			pr.CloseWithError(unpackErr)
+		} else {
+			// the unpacker may stop short of the end-of-archive padding.
+			io.Copy(ioutil.Discard, pr)
+		}
+
+		err := <-done
+
+		defer func() {
+			for _, file := range files {
+				os.Remove(file.temp)
+			}
+		}()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if unpackErr != nil {
+			return nil, unpackErr
+		}
+
+		for name, file := range files {
+			if err := a.fillSparse(name, file); err != nil {
+				return nil, err
+			}
+		}
+
+		return maps, nil
+	}
+}
+
+// holdSparse copies the tar in reader to writer, holding back the contents of
+// sparse files in files, by their cleaned names, and recording their sparse
+// maps in maps, by their names in the tar.
+func (a *Asset) holdSparse(reader io.Reader, writer io.Writer, files map[string]sparseFile, maps map[string]sparseMap) error {
+	cr := &captureReader{reader: reader}
+	tr := tar.NewReader(cr)
+	tw := tar.NewWriter(writer)
+
+	for {
+		offset := cr.n
+		cr.capture = new(bytes.Buffer)
+		header, err := tr.Next()
+		raw := cr.capture.Bytes()
+		cr.capture = nil
+
+		if err == io.EOF {
+			return tw.Close()
+		} else if err != nil {
+			return errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+
+		// a later entry replaces the sparse file.
+		name := cleanEntryName(header.Name)
+		if file, ok := files[name]; ok {
+			os.Remove(file.temp)
+			delete(files, name)
+		}
+		delete(maps, header.Name)
+
+		if isSparseHeader(header) {
+			sparse, err := parseSparseMap(header, raw, offset)
+			if err != nil {
+				return err
+			}
+			maps[header.Name] = sparse
+
+			temp, err := writeSparse(filepath.Dir(a.path), tr, header.Size)
+			if err != nil {
+				return err
+			}
+
+			files[name] = sparseFile{temp: temp, size: header.Size}
+			header = sparsePlaceholder(header)
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// sparseSuffix is appended to an expanded asset's path to find the sparse
+// maps of the tar recorded in its tar-split metadata. tar-split replays
+// sparse files in full, and drops the maps of the PAX 1.0 format, which are
+// kept in the data section.
+const sparseSuffix = ".sparse.json"
+
+// sparseMap is where the data of a sparse file was in a tar: the extents
+// that were stored, and the part of the data section before them, which
+// holds the map in the PAX 1.0 format.
+type sparseMap struct {
+	Prefix  []byte        `json:"prefix,omitempty"`
+	Extents []sparseEntry `json:"extents"`
+}
+
+func (a *Asset) sparsePath() string {
+	return a.path + sparseSuffix
+}
+
+func (a *Asset) saveSparseMaps(maps map[string]sparseMap) error {
+	f, err := os.Create(a.sparsePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(maps)
+}
+
+// loadSparseMaps returns the sparse maps saved with the tar-split metadata,
+// or nil if the tar had no sparse files.
+func (a *Asset) loadSparseMaps() (map[string]sparseMap, error) {
+	f, err := os.Open(a.sparsePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	maps := map[string]sparseMap{}
+	if err := json.NewDecoder(f).Decode(&maps); err != nil {
+		return nil, errors.Wrapf(ErrInvalidAsset, "invalid sparse maps: %v", err)
+	}
+
+	return maps, nil
+}
+
+// captureReader passes reader through, counting the bytes read, and copying
+// them to capture, if set.
+type captureReader struct {
+	reader  io.Reader
+	capture *bytes.Buffer
+	n       int64
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	if c.capture != nil {
+		c.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+// parseSparseMap returns the sparse map of header, which archive/tar read
+// from raw, starting at offset in the tar. archive/tar reads sparse maps in
+// all formats, but does not return them.
+func parseSparseMap(header *tar.Header, raw []byte, offset int64) (sparseMap, error) {
+	invalid := errors.Wrapf(ErrInvalidAsset, "cannot read sparse map of %q", header.Name)
+
+	// raw starts with the padding of the previous entry, and may hold
+	// extended headers before the header of the entry.
+	if padding(offset) > int64(len(raw)) {
+		return sparseMap{}, invalid
+	}
+	raw = raw[padding(offset):]
+
+	for {
+		if len(raw) < tarBlockSize {
+			return sparseMap{}, invalid
+		}
+
+		block := raw[:tarBlockSize]
+		raw = raw[tarBlockSize:]
+
+		switch block[156] {
+		case tar.TypeXHeader, tar.TypeXGlobalHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseTarNumber(block[124:136])
+			if err != nil || size < 0 || size+padding(size) > int64(len(raw)) {
+				return sparseMap{}, invalid
+			}
+			raw = raw[size+padding(size):]
+			continue
+		case tar.TypeGNUSparse:
+			extents, err := parseOldGNUSparseMap(block, raw)
+			if err != nil {
+				return sparseMap{}, invalid
+			}
+			return sparseMap{Extents: extents}, nil
+		}
+
+		if header.PAXRecords[paxGNUSparsePrefix+"major"] == "1" && header.PAXRecords[paxGNUSparsePrefix+"minor"] == "0" {
+			extents, err := parseSparseNumbers(strings.Split(string(raw), "\n"), true)
+			if err != nil {
+				return sparseMap{}, invalid
+			}
+			return sparseMap{Prefix: append([]byte(nil), raw...), Extents: extents}, nil
+		}
+
+		extents, err := parseSparseNumbers(strings.Split(header.PAXRecords[paxGNUSparsePrefix+"map"], ","), false)
+		if err != nil {
+			return sparseMap{}, invalid
+		}
+		return sparseMap{Extents: extents}, nil
+	}
+}
+
+// parseOldGNUSparseMap reads the sparse map of the old GNU format from its
+// header block and the extension blocks in raw that follow it.
+func parseOldGNUSparseMap(block, raw []byte) ([]sparseEntry, error) {
+	extents := []sparseEntry{}
+	entries, extended := block[386:482], block[482]
+
+	for {
+		for i := 0; i+24 <= len(entries) && entries[i] != 0; i += 24 {
+			offset, err := parseTarNumber(entries[i : i+12])
+			if err != nil {
+				return nil, err
+			}
+
+			length, err := parseTarNumber(entries[i+12 : i+24])
+			if err != nil {
+				return nil, err
+			}
+
+			extents = append(extents, sparseEntry{Offset: offset, Length: length})
+		}
+
+		if extended == 0 {
+			return extents, nil
+		}
+
+		if len(raw) < tarBlockSize {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		entries, extended, raw = raw[:504], raw[504], raw[tarBlockSize:]
+	}
+}
+
+// parseSparseNumbers reads a sparse map of offset and length pairs from
+// fields. counted maps start with the number of pairs.
+func parseSparseNumbers(fields []string, counted bool) ([]sparseEntry, error) {
+	if counted {
+		count, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || count < 0 || count > int64(len(fields)-1)/2 {
+			return nil, errors.Errorf("invalid number of extents %q", fields[0])
+		}
+		fields = fields[1 : 1+2*count]
+	} else if len(fields) == 1 && fields[0] == "" {
+		fields = nil
+	}
+
+	if len(fields)%2 != 0 {
+		return nil, errors.New("odd number of fields")
+	}
+
+	extents := []sparseEntry{}
+	for i := 0; i < len(fields); i += 2 {
+		offset, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		length, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		extents = append(extents, sparseEntry{Offset: offset, Length: length})
+	}
+
+	return extents, nil
+}
+
+// parseTarNumber reads a numeric field of a tar header, in octal or in the
+// base-256 encoding of GNU tar.
+func parseTarNumber(field []byte) (int64, error) {
+	if len(field) > 0 && field[0]&0x80 != 0 {
+		var n int64
+		for i, b := range field {
+			if i == 0 {
+				b &= 0x7f
+			}
+
+			if n > math.MaxInt64>>8 {
+				return 0, errors.New("number out of range")
+			}
+			n = n<<8 | int64(b)
+		}
+		return n, nil
+	}
+
+	s := strings.Trim(string(field), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(s, 8, 64)
+}
+
+// extentWriter writes the parts of the contents written to it that are in
+// extents, which are sorted by offset, to writer.
+type extentWriter struct {
+	writer  io.Writer
+	extents []sparseEntry
+	offset  int64
+}
+
+func (w *extentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		for len(w.extents) > 0 && w.extents[0].Offset+w.extents[0].Length <= w.offset {
+			w.extents = w.extents[1:]
+		}
+
+		if len(w.extents) == 0 {
+			w.offset += int64(len(p))
+			break
+		}
+
+		extent := w.extents[0]
+		if w.offset < extent.Offset {
+			skip := extent.Offset - w.offset
+			if skip > int64(len(p)) {
+				skip = int64(len(p))
+			}
+			p = p[skip:]
+			w.offset += skip
+			continue
+		}
+
+		size := extent.Offset + extent.Length - w.offset
+		if size > int64(len(p)) {
+			size = int64(len(p))
+		}
+
+		if _, err := w.writer.Write(p[:size]); err != nil {
+			return 0, err
+		}
+
+		p = p[size:]
+		w.offset += size
+	}
+
+	return n, nil
+}
+
+// sparsePlaceholder returns an empty regular file with the metadata of the
+// sparse file header.
+func sparsePlaceholder(header *tar.Header) *tar.Header {
+	placeholder := *header
+	placeholder.Typeflag = tar.TypeReg
+	placeholder.Size = 0
+	placeholder.Format = tar.FormatUnknown
+	placeholder.PAXRecords = map[string]string{}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxGNUSparsePrefix) {
+			placeholder.PAXRecords[key] = value
+		}
+	}
+
+	return &placeholder
+}
+
+// writeSparse writes size bytes from reader to a new temporary file in dir,
+// leaving holes where whole blocks are zero, and returns its name.
+func writeSparse(dir string, reader io.Reader, size int64) (string, error) {
+	f, err := ioutil.TempFile(dir, ".sparse-")
+	if err != nil {
+		return "", err
+	}
+
+	if err := copySparse(f, reader, size); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func copySparse(f *os.File, reader io.Reader, size int64) error {
+	buf := make([]byte, 256*sparseBlockSize)
+	zero := make([]byte, sparseBlockSize)
+
+	for offset := int64(0); offset < size; {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			return errors.Wrapf(ErrInvalidAsset, "cannot read tar: %v", err)
+		}
+
+		for i := int64(0); i < n; i += sparseBlockSize {
+			end := i + sparseBlockSize
+			if end > n {
+				end = n
+			}
+
+			if bytes.Equal(buf[i:end], zero[:end-i]) {
+				continue
+			}
+
+			if _, err := f.WriteAt(buf[i:end], offset+i); err != nil {
+				return err
+			}
+		}
+
+		offset += n
+	}
+
+	return f.Truncate(size)
+}
+
+// fillSparse copies the data of the sparse file held back for name into the
+// placeholder unpacked for it, keeping the placeholder's metadata and any
+// hardlinks to it.
+func (a *Asset) fillSparse(name string, file sparseFile) error {
+	root, err := filepath.EvalSymlinks(a.path)
+	if err != nil {
+		return err
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(name))
+
+	// the placeholder may have been removed by a whiteout, or moved below a
+	// symlink by later entries.
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) || (err == nil && resolved != p) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || !ok {
+		return nil
+	}
+
+	src, err := os.Open(file.temp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// writing drops file capabilities.
+	capability, err := lgetxattr(p, capabilityXattr)
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Chmod(p, stat.Mode&07777|0200); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := copyExtents(dst, src, file.size); err != nil {
+		dst.Close()
+		return errors.Wrapf(ErrInvalidAsset, "cannot restore sparse file %q: %v", name, err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if capability != nil {
+		if err := unix.Lsetxattr(p, capabilityXattr, capability, 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+			return err
+		}
+	}
+
+	// chmod after writing, which clears the setuid and setgid bits.
+	if err := unix.Chmod(p, stat.Mode&07777); err != nil {
+		return err
+	}
+
+	return os.Chtimes(p, time.Unix(stat.Atim.Unix()), fi.ModTime())
+}
+
+// copyExtents copies the data of src, which is size bytes long, to dst,
+// skipping its holes, and truncates dst to size.
+func copyExtents(dst, src *os.File, size int64) error {
+	extents, err := dataExtents(src, size)
+	if err != nil {
+		return err
+	}
+
+	if extents == nil {
+		extents = []sparseEntry{{Offset: 0, Length: size}}
+	}
+
+	for _, extent := range extents {
+		if _, err := dst.Seek(extent.Offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(dst, io.NewSectionReader(src, extent.Offset, extent.Length), extent.Length); err != nil {
+			return err
+		}
+	}
+
+	return dst.Truncate(size)
+}
+
+// dataExtents returns the extents of the first size bytes of f that hold
+// data, as found with SEEK_DATA and SEEK_HOLE. It returns nil if f has no
+// holes, or if the filesystem cannot tell.
+func dataExtents(f *os.File, size int64) ([]sparseEntry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// a file with a block for every byte has no holes.
+	if stat, ok := fi.Sys().(*syscall.Stat_t); !ok || stat.Blocks*512 >= size {
+		return nil, nil
+	}
+
+	extents := []sparseEntry{}
+
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+		switch err {
+		case nil:
+		case unix.ENXIO:
+			// only a hole is left.
+			return extents, nil
+		case unix.EINVAL, unix.EOPNOTSUPP:
+			return nil, nil
+		default:
+			return nil, err
+		}
+
+		if start >= size {
+			break
+		}
+
+		end, err := unix.Seek(int(f.Fd()), start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		if end > size {
+			end = size
+		}
+
+		extents = append(extents, sparseEntry{Offset: start, Length: end - start})
+		offset = end
+	}
+
+	if len(extents) == 1 && extents[0].Offset == 0 && extents[0].Length == size {
+		return nil, nil
+	}
+
+	return extents, nil
+}
+
+// writeSparseEntry writes the regular file p, described by header, to writer
+// in the PAX 1.0 sparse format if it has holes. archive/tar can read that
+// format, but not write it, so the entry is written around tw, which must be
+// done with the previous entry. It returns false if p has no holes, and
+// nothing was written.
+func writeSparseEntry(writer io.Writer, tw *tar.Writer, header *tar.Header, p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	extents, err := dataExtents(f, header.Size)
+	if err != nil || extents == nil {
+		return false, err
+	}
+
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+
+	blocks, err := sparseHeaders(header, extents)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := writer.Write(blocks); err != nil {
+		return false, err
+	}
+
+	var written int64
+	for _, extent := range extents {
+		if _, err := io.CopyN(writer, io.NewSectionReader(f, extent.Offset, extent.Length), extent.Length); err != nil {
+			return false, errors.Wrapf(ErrInvalidAsset, "cannot pack sparse file %q: %v", header.Name, err)
+		}
+		written += extent.Length
+	}
+
+	_, err = writer.Write(make([]byte, padding(written)))
+	return true, err
+}
+
+// sparseHeaders returns the beginning of a PAX 1.0 sparse entry for header:
+// an extended header with the real name and size of the file, a ustar header
+// for the data, and the map of extents, which starts the data.
+func sparseHeaders(header *tar.Header, extents []sparseEntry) ([]byte, error) {
+	// GNU tar ends the map with an empty extent at the end of the file.
+	extents = append(extents, sparseEntry{Offset: header.Size})
+
+	sparseMap := new(bytes.Buffer)
+	fmt.Fprintf(sparseMap, "%d\n", len(extents))
+	for _, extent := range extents {
+		fmt.Fprintf(sparseMap, "%d\n%d\n", extent.Offset, extent.Length)
+	}
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+
+	size := int64(sparseMap.Len())
+	for _, extent := range extents {
+		size += extent.Length
+	}
+
+	records := map[string]string{}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+	for key, value := range header.Xattrs {
+		records[paxXattrPrefix+key] = value
+	}
+
+	delete(records, "path")
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = header.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(header.Size, 10)
+	records["size"] = strconv.FormatInt(size, 10)
+	records["uid"] = strconv.Itoa(header.Uid)
+	records["gid"] = strconv.Itoa(header.Gid)
+	records["mtime"] = formatPAXTime(header.ModTime)
+	if header.Uname != "" {
+		records["uname"] = header.Uname
+	}
+	if header.Gname != "" {
+		records["gname"] = header.Gname
+	}
+
+	keys := []string{}
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pax := new(bytes.Buffer)
+	for _, key := range keys {
+		record, err := paxRecord(key, records[key])
+		if err != nil {
+			return nil, err
+		}
+		pax.WriteString(record)
+	}
+
+	dir, file := path.Split(strings.TrimSuffix(header.Name, "/"))
+
+	blocks := new(bytes.Buffer)
+	blocks.Write(ustarHeader(&tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     path.Join(dir, "PaxHeaders.0", file),
+		Size:     int64(pax.Len()),
+		ModTime:  header.ModTime,
+	}))
+	blocks.Write(pax.Bytes())
+	blocks.Write(make([]byte, padding(int64(pax.Len()))))
+	blocks.Write(ustarHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, "GNUSparseFile.0", file),
+		Mode:     header.Mode,
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Size:     size,
+		ModTime:  header.ModTime,
+	}))
+	blocks.Write(sparseMap.Bytes())
+
+	return blocks.Bytes(), nil
+}
+
+// ustarHeader encodes header as a ustar header block. Values that do not fit
+// are left empty or cut short; they are expected to be in an extended header.
+func ustarHeader(header *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+
+	field := func(start, length int, value string) {
+		if len(value) > length {
+			value = value[:length]
+		}
+		copy(block[start:start+length], value)
+	}
+
+	octal := func(start, length int, value int64) {
+		s := fmt.Sprintf("%0*o", length-1, value)
+		if value < 0 || len(s) > length-1 {
+			s = strings.Repeat("0", length-1)
+		}
+		field(start, length, s)
+	}
+
+	field(0, 100, header.Name)
+	octal(100, 8, header.Mode&07777)
+	octal(108, 8, int64(header.Uid))
+	octal(116, 8, int64(header.Gid))
+	octal(124, 12, header.Size)
+	octal(136, 12, header.ModTime.Unix())
+	block[156] = header.Typeflag
+	field(257, 6, "ustar\x00")
+	field(263, 2, "00")
+	field(265, 32, header.Uname)
+	field(297, 32, header.Gname)
+
+	// the checksum is computed with its own field set to spaces.
+	field(148, 8, strings.Repeat(" ", 8))
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	field(148, 8, fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// paxRecord formats a PAX record, which is prefixed with its own length.
+func paxRecord(key, value string) (string, error) {
+	if strings.ContainsAny(key, "=\x00") {
+		return "", errors.Wrapf(ErrInvalidAsset, "invalid PAX record %q", key)
+	}
+
+	const padding = 3 // ' ', '=' and '\n'
+	size := len(key) + len(value) + padding
+	size += len(strconv.Itoa(size))
+
+	record := strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	if len(record) != size {
+		// the length grew by a digit.
+		size = len(record)
+		record = strconv.Itoa(size) + " " + key + "=" + value + "\n"
+	}
+
+	return record, nil
+}
+
+func formatPAXTime(t time.Time) string {
+	secs, nsecs := t.Unix(), t.Nanosecond()
+	if nsecs == 0 {
+		return strconv.FormatInt(secs, 10)
+	}
+
+	// negative times with fractions count back from the next second.
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs = -(secs + 1)
+		nsecs = -(nsecs - 1e9)
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%s%d.%09d", sign, secs, nsecs), "0")
+}
+
+// padding returns the number of bytes needed to align size to a tar block.
+func padding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
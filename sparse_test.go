@@ -0,0 +1,254 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+const sparseTestSize = 8 << 20
+
+// makeSparseTar returns a tar holding disk.img, a sparse file of
+// sparseTestSize bytes with data only at 1MiB, and a hardlink to it.
+func makeSparseTar(c *C) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755}), IsNil)
+	c.Assert(tw.Flush(), IsNil)
+
+	header := &tar.Header{
+		Name:     "var/disk.img",
+		Typeflag: tar.TypeReg,
+		Mode:     0640,
+		Size:     sparseTestSize,
+		ModTime:  time.Unix(1500000000, 0),
+	}
+
+	blocks, err := sparseHeaders(header, []sparseEntry{{Offset: 1 << 20, Length: sparseBlockSize}})
+	c.Assert(err, IsNil)
+	buf.Write(blocks)
+	buf.Write(bytes.Repeat([]byte("x"), sparseBlockSize))
+
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "var/disk.link", Typeflag: tar.TypeLink, Linkname: "var/disk.img"}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	return buf
+}
+
+func sparseContent() string {
+	content := make([]byte, sparseTestSize)
+	copy(content[1<<20:], bytes.Repeat([]byte("x"), sparseBlockSize))
+	return string(content)
+}
+
+func (m *mountSuite) TestSparse(c *C) {
+	tarball := makeSparseTar(c)
+
+	// the fixture is a valid sparse tar.
+	tr := tar.NewReader(bytes.NewReader(tarball.Bytes()))
+	_, err := tr.Next()
+	c.Assert(err, IsNil)
+	header, err := tr.Next()
+	c.Assert(err, IsNil)
+	c.Assert(header.Name, Equals, "var/disk.img")
+	c.Assert(header.Size, Equals, int64(sparseTestSize))
+	content, err := ioutil.ReadAll(tr)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, sparseContent())
+
+	layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(tarball.Bytes()), nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(layer.ID(), Equals, digest.FromBytes(tarball.Bytes()).Hex())
+	c.Assert(readEntry(c, layer, "var/disk.img"), Equals, sparseContent())
+	c.Assert(readEntry(c, layer, "var/disk.link"), Equals, sparseContent())
+
+	if m.Repository.IsVirtual() {
+		return
+	}
+
+	p := filepath.Join(layer.Path(), "var/disk.img")
+	fi, err := os.Stat(p)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(sparseTestSize))
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	c.Assert(fi.ModTime().Equal(header.ModTime), Equals, true)
+	c.Assert(fi.Sys().(*syscall.Stat_t).Blocks*512 < 1<<20, Equals, true)
+
+	link, err := os.Stat(filepath.Join(layer.Path(), "var/disk.link"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(fi, link), Equals, true)
+
+	// the tar-split metadata rebuilds the sparse entry as it was.
+	packed := new(bytes.Buffer)
+	dg, err := layer.Pack(packed)
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, layer.ID())
+	c.Assert(bytes.Equal(packed.Bytes(), tarball.Bytes()), Equals, true)
+
+	// without it, sparse files are packed anew.
+	c.Assert(layer.asset.removeTarSplit(), IsNil)
+
+	packed.Reset()
+	_, err = layer.Pack(packed)
+	c.Assert(err, IsNil)
+	c.Assert(packed.Len() < 1<<20, Equals, true)
+
+	tr = tar.NewReader(bytes.NewReader(packed.Bytes()))
+	found := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		if header.Name != "var/disk.img" {
+			continue
+		}
+
+		found = true
+		c.Assert(header.PAXRecords["GNU.sparse.major"], Equals, "1")
+		c.Assert(header.Size, Equals, int64(sparseTestSize))
+		c.Assert(header.Mode&07777, Equals, int64(0640))
+		c.Assert(header.ModTime.Equal(fi.ModTime()), Equals, true)
+
+		content, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		c.Assert(string(content), Equals, sparseContent())
+	}
+	c.Assert(found, Equals, true)
+
+	// what was packed unpacks sparse again.
+	repacked, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(packed.Bytes()), nil, false)
+	c.Assert(err, IsNil)
+	fi, err = os.Stat(filepath.Join(repacked.Path(), "var/disk.img"))
+	c.Assert(err, IsNil)
+	c.Assert(fi.Size(), Equals, int64(sparseTestSize))
+	c.Assert(fi.Sys().(*syscall.Stat_t).Blocks*512 < 1<<20, Equals, true)
+	c.Assert(readEntry(c, repacked, "var/disk.img"), Equals, sparseContent())
+
+	// reproducible packs write the file out in full.
+	reproducible := new(bytes.Buffer)
+	_, err = layer.PackWithOptions(reproducible, &PackOptions{Reproducible: true})
+	c.Assert(err, IsNil)
+	c.Assert(reproducible.Len() > sparseTestSize, Equals, true)
+}
+
+func (m *mountSuite) TestSparseFormats(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar as is")
+		return
+	}
+
+	data := bytes.Repeat([]byte("x"), sparseBlockSize)
+	header := &tar.Header{
+		Name:     "var/disk.img",
+		Typeflag: tar.TypeReg,
+		Mode:     0640,
+		Size:     sparseTestSize,
+		ModTime:  time.Unix(1500000000, 0),
+	}
+
+	// the old GNU format keeps the map in the header.
+	gnu := ustarHeader(&tar.Header{
+		Name:     header.Name,
+		Typeflag: tar.TypeGNUSparse,
+		Mode:     header.Mode,
+		Size:     int64(len(data)),
+		ModTime:  header.ModTime,
+	})
+	copy(gnu[257:265], "ustar  \x00")
+	copy(gnu[386:398], fmt.Sprintf("%011o", 1<<20))
+	copy(gnu[398:410], fmt.Sprintf("%011o", len(data)))
+	copy(gnu[483:495], fmt.Sprintf("%011o", sparseTestSize))
+	copy(gnu[148:156], "        ")
+	var sum int64
+	for _, b := range gnu {
+		sum += int64(b)
+	}
+	copy(gnu[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	// PAX 0.1 keeps it in the extended header.
+	records := ""
+	for _, record := range [][2]string{
+		{"GNU.sparse.major", "0"},
+		{"GNU.sparse.minor", "1"},
+		{"GNU.sparse.name", header.Name},
+		{"GNU.sparse.realsize", strconv.Itoa(sparseTestSize)},
+		{"GNU.sparse.numblocks", "1"},
+		{"GNU.sparse.map", fmt.Sprintf("%d,%d", 1<<20, len(data))},
+	} {
+		formatted, err := paxRecord(record[0], record[1])
+		c.Assert(err, IsNil)
+		records += formatted
+	}
+
+	pax := new(bytes.Buffer)
+	pax.Write(ustarHeader(&tar.Header{Name: "var/PaxHeaders.0/disk.img", Typeflag: tar.TypeXHeader, Size: int64(len(records))}))
+	pax.WriteString(records)
+	pax.Write(make([]byte, padding(int64(len(records)))))
+	pax.Write(ustarHeader(&tar.Header{
+		Name:     "var/GNUSparseFile.0/disk.img",
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode,
+		Size:     int64(len(data)),
+		ModTime:  header.ModTime,
+	}))
+
+	// PAX 1.0 keeps it in the data section.
+	pax1, err := sparseHeaders(header, []sparseEntry{{Offset: 1 << 20, Length: int64(len(data))}})
+	c.Assert(err, IsNil)
+
+	for format, blocks := range map[string][]byte{"gnu": gnu, "pax 0.1": pax.Bytes(), "pax 1.0": pax1} {
+		tarball := new(bytes.Buffer)
+		tw := tar.NewWriter(tarball)
+		c.Assert(tw.WriteHeader(&tar.Header{Name: "var/", Typeflag: tar.TypeDir, Mode: 0755}), IsNil)
+		c.Assert(tw.Flush(), IsNil)
+
+		tarball.Write(blocks)
+		tarball.Write(data)
+
+		c.Assert(tw.WriteHeader(&tar.Header{Name: "var/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}), IsNil)
+		_, err := tw.Write([]byte("hello"))
+		c.Assert(err, IsNil)
+		c.Assert(tw.Close(), IsNil)
+
+		layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(tarball.Bytes()), nil, true)
+		c.Assert(err, IsNil, Commentf("%v", format))
+		c.Assert(readEntry(c, layer, "var/disk.img"), Equals, sparseContent(), Commentf("%v", format))
+
+		ok, err := layer.asset.tarSplitMatches()
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true, Commentf("%v", format))
+
+		packed := new(bytes.Buffer)
+		dg, err := layer.Pack(packed)
+		c.Assert(err, IsNil, Commentf("%v", format))
+		c.Assert(dg.Hex(), Equals, layer.ID(), Commentf("%v", format))
+		c.Assert(bytes.Equal(packed.Bytes(), tarball.Bytes()), Equals, true, Commentf("%v", format))
+
+		// the contents are still checked.
+		p := filepath.Join(layer.Path(), "var/disk.img")
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+		c.Assert(err, IsNil)
+		_, err = f.WriteAt([]byte("y"), 1<<20)
+		c.Assert(err, IsNil)
+		c.Assert(f.Close(), IsNil)
+		c.Assert(os.Chtimes(p, header.ModTime, header.ModTime), IsNil)
+
+		_, err = layer.Pack(ioutil.Discard)
+		c.Assert(errors.Cause(err), Equals, ErrInvalidAsset, Commentf("%v", format))
+	}
+}
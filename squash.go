@@ -0,0 +1,412 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+)
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// squashEntry is a single surviving tar entry. Regular file content lives in
+// the spool file at offset. Hardlinks point to the entry of their target, so
+// they keep its content even if a later layer replaces the target.
+type squashEntry struct {
+	header *tar.Header
+	offset int64
+	link   *squashEntry
+}
+
+// squashState tracks the merged view of the layers being squashed. All keys
+// are cleaned, absolute paths. children indexes every tracked path, and the
+// dirs leading to it, by its parent dir, so the paths below a dir can be
+// found without scanning them all.
+type squashState struct {
+	entries   map[string]*squashEntry
+	whiteouts map[string]struct{}
+	opaque    map[string]struct{}
+	children  map[string]map[string]struct{}
+	spool     file
+	spoolSize int64
+}
+
+// Squash merges every layer between base (exclusive) and top (inclusive) into
+// a single content-addressed layer whose parent is base. Whiteouts and
+// overridden files are resolved; deletions that may still affect base are
+// kept as whiteouts. The configuration of top, if any, is copied to the new
+// layer, with the config steps taken on the squashed layers following it. If
+// base is nil, the whole chain is squashed.
+//
+// Squash works entirely from the layer tars, so it needs neither mounts nor
+// root and works in virtual repositories.
+func (r *Repository) Squash(top *Layer, base *Layer) (*Layer, error) {
+	layers, err := layerRange(top, base)
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := r.tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		spool.Close()
+		r.fs.Remove(spool.Name())
+	}()
+
+	state := &squashState{
+		entries:   map[string]*squashEntry{},
+		whiteouts: map[string]struct{}{},
+		opaque:    map[string]struct{}{},
+		children:  map[string]map[string]struct{}{},
+		spool:     spool,
+	}
+
+	for _, layer := range layers {
+		if err := state.applyLayer(r, layer); err != nil {
+			return nil, err
+		}
+	}
+
+	tf, err := r.tempFile()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tf.Close()
+		r.fs.Remove(tf.Name())
+	}()
+
+	if err := state.writeTar(tf); err != nil {
+		return nil, err
+	}
+
+	if _, err := tf.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	layer, err := r.CreateLayerFromAsset(tf, base, true)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := top.Config()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return layer, nil
+		}
+		return nil, err
+	}
+
+	squashed := map[string]bool{}
+	for _, l := range layers {
+		squashed[l.ID()] = true
+	}
+	config.moveSteps(squashed, layer.ID())
+
+	return layer, layer.SaveConfig(config)
+}
+
+// layerRange returns the layers above base up to and including top, ordered
+// from the bottom up.
+func layerRange(top *Layer, base *Layer) ([]*Layer, error) {
+	if top == nil {
+		return nil, errors.Wrap(ErrInvalidLayer, "top layer is nil")
+	}
+
+	layers := []*Layer{}
+	iter := top
+	for ; iter != nil; iter = iter.Parent {
+		if base != nil && iter.ID() == base.ID() {
+			break
+		}
+		layers = append(layers, iter)
+	}
+
+	if base != nil && iter == nil {
+		return nil, errors.Wrapf(ErrImageCannotBeComposed, "layer %q is not a parent of %q", base.ID(), top.ID())
+	}
+
+	if len(layers) == 0 {
+		return nil, errors.Wrap(ErrImageCannotBeComposed, "no layers between top and base")
+	}
+
+	for i, j := 0, len(layers)-1; i < j; i, j = i+1, j-1 {
+		layers[i], layers[j] = layers[j], layers[i]
+	}
+
+	return layers, nil
+}
+
+// packLayer packs a layer to a temporary file and returns it, rewound. The
+// caller is responsible for closing and removing it.
+func packLayer(r *Repository, layer *Layer) (file, error) {
+	tf, err := r.tempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := layer.Pack(tf); err != nil {
+		tf.Close()
+		r.fs.Remove(tf.Name())
+		return nil, err
+	}
+
+	if _, err := tf.Seek(0, 0); err != nil {
+		tf.Close()
+		r.fs.Remove(tf.Name())
+		return nil, err
+	}
+
+	return tf, nil
+}
+
+func cleanTarPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (s *squashState) applyLayer(r *Repository, layer *Layer) error {
+	tf, err := packLayer(r, layer)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tf.Close()
+		r.fs.Remove(tf.Name())
+	}()
+
+	// whiteouts in a layer only apply to the layers below it, so they are
+	// processed before anything the layer adds.
+	removals := []string{}
+	opaques := []string{}
+	additions := []*squashEntry{}
+
+	tr := tar.NewReader(tf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		p := cleanTarPath(header.Name)
+		if p == "/" {
+			continue
+		}
+
+		dir, base := path.Split(p)
+		dir = path.Clean(dir)
+
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			opaques = append(opaques, dir)
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			// other aufs metadata is not meaningful outside of aufs.
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			removals = append(removals, path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)))
+			continue
+		case header.Typeflag == tar.TypeChar && header.Devmajor == 0 && header.Devminor == 0:
+			// overlay-style whiteout, left behind by an upper dir.
+			removals = append(removals, p)
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir && header.Xattrs[overlayOpaqueXattr] == "y" {
+			opaques = append(opaques, p)
+			delete(header.Xattrs, overlayOpaqueXattr)
+		}
+
+		entry := &squashEntry{header: header}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			entry.offset = s.spoolSize
+			n, err := io.Copy(s.spool, tr)
+			if err != nil {
+				return err
+			}
+			s.spoolSize += n
+		}
+
+		header.Name = p
+		additions = append(additions, entry)
+	}
+
+	for _, p := range removals {
+		s.remove(p)
+	}
+
+	for _, p := range opaques {
+		s.makeOpaque(p)
+	}
+
+	for _, entry := range additions {
+		s.add(entry)
+	}
+
+	return nil
+}
+
+// remove deletes p and everything below it, and records a whiteout in case
+// it also exists in the base.
+func (s *squashState) remove(p string) {
+	s.clearBelow(p)
+	delete(s.entries, p)
+	delete(s.opaque, p)
+	s.whiteouts[p] = struct{}{}
+	s.track(p)
+}
+
+// makeOpaque deletes everything below dir, and records that lower contents
+// must be hidden.
+func (s *squashState) makeOpaque(dir string) {
+	s.clearBelow(dir)
+	s.opaque[dir] = struct{}{}
+	s.track(dir)
+}
+
+// track adds p and its parent dirs to the children index.
+func (s *squashState) track(p string) {
+	for p != "/" {
+		dir := path.Dir(p)
+		if _, ok := s.children[dir][p]; ok {
+			return
+		}
+
+		if s.children[dir] == nil {
+			s.children[dir] = map[string]struct{}{}
+		}
+		s.children[dir][p] = struct{}{}
+		p = dir
+	}
+}
+
+// clearBelow forgets everything below dir, but not dir itself.
+func (s *squashState) clearBelow(dir string) {
+	for p := range s.children[dir] {
+		s.clearBelow(p)
+		delete(s.entries, p)
+		delete(s.whiteouts, p)
+		delete(s.opaque, p)
+	}
+
+	delete(s.children, dir)
+}
+
+func (s *squashState) add(entry *squashEntry) {
+	p := entry.header.Name
+
+	if entry.header.Typeflag != tar.TypeDir {
+		// a file replacing a directory removes the directory's contents.
+		s.clearBelow(p)
+		delete(s.whiteouts, p)
+		delete(s.opaque, p)
+	}
+
+	if entry.header.Typeflag == tar.TypeLink {
+		entry.link = s.linkTarget(entry.header.Linkname)
+	}
+
+	// a whited-out directory that comes back must not expose the base's
+	// contents again.
+	for dir := p; dir != "/"; dir = path.Dir(dir) {
+		if _, ok := s.whiteouts[dir]; ok {
+			delete(s.whiteouts, dir)
+			s.opaque[dir] = struct{}{}
+		}
+	}
+
+	s.entries[p] = entry
+	s.track(p)
+}
+
+// linkTarget returns the entry with the content a hardlink to name points to,
+// or nil if it is not tracked.
+func (s *squashState) linkTarget(name string) *squashEntry {
+	target, ok := s.entries[cleanTarPath(name)]
+	if !ok {
+		return nil
+	}
+
+	if target.link != nil {
+		return target.link
+	}
+
+	return target
+}
+
+func (s *squashState) writeTar(w io.Writer) error {
+	names := []string{}
+	for p := range s.entries {
+		names = append(names, p)
+	}
+	for p := range s.whiteouts {
+		dir, base := path.Split(p)
+		names = append(names, path.Join(dir, archive.WhiteoutPrefix+base))
+	}
+	for p := range s.opaque {
+		names = append(names, path.Join(p, archive.WhiteoutOpaqueDir))
+	}
+
+	sort.Strings(names)
+
+	tw := tar.NewWriter(w)
+
+	// hardlinks whose target was replaced or removed get its content in the
+	// first of them, which the others then link to.
+	moved := map[*squashEntry]string{}
+
+	for _, p := range names {
+		entry, ok := s.entries[p]
+		if !ok {
+			// whiteout or opaque marker
+			err := tw.WriteHeader(&tar.Header{
+				Name:     strings.TrimPrefix(p, "/"),
+				Mode:     0600,
+				Typeflag: tar.TypeReg,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := *entry.header
+		header.Name = strings.TrimPrefix(p, "/")
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+
+		if entry.link != nil && s.linkTarget(header.Linkname) != entry.link {
+			if first, ok := moved[entry.link]; ok {
+				header.Linkname = first
+			} else {
+				moved[entry.link] = header.Name
+				header.Typeflag = entry.link.header.Typeflag
+				header.Size = entry.link.header.Size
+				header.Linkname = ""
+				entry = entry.link
+			}
+		}
+
+		if err := tw.WriteHeader(&header); err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if _, err := io.Copy(tw, io.NewSectionReader(s.spool, entry.offset, header.Size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,146 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestSquash(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", content: "base a", typeflag: tar.TypeReg},
+		{name: "etc/b", content: "base b", typeflag: tar.TypeReg},
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/cache", content: "cache", typeflag: tar.TypeReg},
+		{name: "bin/", typeflag: tar.TypeDir},
+		{name: "bin/sh", content: "sh", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	one, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", content: "one a", typeflag: tar.TypeReg},
+		{name: "etc/c", content: "one c", typeflag: tar.TypeReg},
+		{name: "opt/", typeflag: tar.TypeDir},
+		{name: "opt/tool", content: "tool", typeflag: tar.TypeReg},
+	}), base, false)
+	c.Assert(err, IsNil)
+
+	two, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/.wh.b", typeflag: tar.TypeReg},
+		{name: "etc/.wh.c", typeflag: tar.TypeReg},
+		{name: ".wh.var", typeflag: tar.TypeReg},
+		{name: "opt/", typeflag: tar.TypeDir},
+		{name: "opt/tool", content: "tool two", typeflag: tar.TypeReg},
+	}), one, false)
+	c.Assert(err, IsNil)
+
+	three, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "var/", typeflag: tar.TypeDir},
+		{name: "var/new", content: "new", typeflag: tar.TypeReg},
+	}), two, false)
+	c.Assert(err, IsNil)
+	c.Assert(three.SaveConfig(&ImageConfig{Cmd: []string{"three"}}), IsNil)
+
+	_, err = m.Repository.Squash(three, three)
+	c.Assert(errors.Cause(err), Equals, ErrImageCannotBeComposed)
+
+	unrelated, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "unrelated", content: "unrelated", typeflag: tar.TypeReg},
+	}), nil, false)
+	c.Assert(err, IsNil)
+	_, err = m.Repository.Squash(three, unrelated)
+	c.Assert(errors.Cause(err), Equals, ErrImageCannotBeComposed)
+
+	squashed, err := m.Repository.Squash(three, base)
+	c.Assert(err, IsNil)
+	c.Assert(squashed.Parent, Equals, base)
+
+	config, err := squashed.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.Cmd, DeepEquals, []string{"three"})
+
+	files := readLayer(c, squashed)
+	c.Assert(files["etc/a"], Equals, "one a")
+	c.Assert(files["opt/tool"], Equals, "tool two")
+	c.Assert(files["var/new"], Equals, "new")
+	c.Assert(files["var/.wh..wh..opq"], Equals, "")
+	c.Assert(files["etc/.wh.b"], Equals, "")
+	_, ok := files["etc/c"]
+	c.Assert(ok, Equals, false)
+	_, ok = files["etc/b"]
+	c.Assert(ok, Equals, false)
+	_, ok = files[".wh.var"]
+	c.Assert(ok, Equals, false)
+	_, ok = files["bin/sh"]
+	c.Assert(ok, Equals, false)
+
+	whole, err := m.Repository.Squash(three, nil)
+	c.Assert(err, IsNil)
+	c.Assert(whole.Parent, IsNil)
+	files = readLayer(c, whole)
+	c.Assert(files["etc/a"], Equals, "one a")
+	c.Assert(files["var/new"], Equals, "new")
+	c.Assert(files["bin/sh"], Equals, "sh")
+	_, ok = files["var/cache"]
+	c.Assert(ok, Equals, false)
+}
+
+func (m *mountSuite) TestSquashHardlinks(c *C) {
+	base, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", content: "a", typeflag: tar.TypeReg},
+		{name: "etc/a-link", linkname: "etc/a", typeflag: tar.TypeLink},
+		{name: "etc/a-link2", linkname: "etc/a", typeflag: tar.TypeLink},
+		{name: "etc/b", content: "b", typeflag: tar.TypeReg},
+		{name: "etc/b-link", linkname: "etc/b", typeflag: tar.TypeLink},
+		{name: "etc/c", content: "c", typeflag: tar.TypeReg},
+		{name: "etc/c-link", linkname: "etc/c", typeflag: tar.TypeLink},
+	}), nil, false)
+	c.Assert(err, IsNil)
+
+	top, err := m.Repository.CreateLayerFromAsset(makeTar(c, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", content: "new a", typeflag: tar.TypeReg},
+		{name: "etc/.wh.b", typeflag: tar.TypeReg},
+	}), base, false)
+	c.Assert(err, IsNil)
+
+	squashed, err := m.Repository.Squash(top, nil)
+	c.Assert(err, IsNil)
+
+	headers := map[string]*tar.Header{}
+	buf := new(bytes.Buffer)
+	_, err = squashed.Pack(buf)
+	c.Assert(err, IsNil)
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		headers[header.Name] = header
+	}
+
+	// links to replaced or removed files keep the content they had.
+	c.Assert(headers["etc/a-link"].Typeflag, Equals, byte(tar.TypeReg))
+	c.Assert(headers["etc/a-link2"].Typeflag, Equals, byte(tar.TypeLink))
+	c.Assert(headers["etc/a-link2"].Linkname, Equals, "etc/a-link")
+	c.Assert(headers["etc/b-link"].Typeflag, Equals, byte(tar.TypeReg))
+	c.Assert(headers["etc/c-link"].Typeflag, Equals, byte(tar.TypeLink))
+	c.Assert(headers["etc/c-link"].Linkname, Equals, "etc/c")
+	_, ok := headers["etc/b"]
+	c.Assert(ok, Equals, false)
+
+	files := readLayer(c, squashed)
+	c.Assert(files["etc/a"], Equals, "new a")
+	c.Assert(files["etc/a-link"], Equals, "a")
+	c.Assert(files["etc/b-link"], Equals, "b")
+	c.Assert(files["etc/c"], Equals, "c")
+}
@@ -1,6 +1,7 @@
 package overmount
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -22,21 +23,21 @@ func (r *Repository) tagFileFor(name string) string {
 // AddTag tags a layer with the name
 func (r *Repository) AddTag(name string, layer *Layer) error {
 	return r.edit(func() error {
-		f, err := r.TempFile()
+		f, err := r.tempFile()
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		if _, err := f.WriteString(layer.ID()); err != nil {
+		if _, err := io.WriteString(f, layer.ID()); err != nil {
 			return err
 		}
 		f.Close()
 
-		if err := os.MkdirAll(path.Join(r.baseDir, tagsDB), 0700); err != nil {
+		if err := r.fs.MkdirAll(path.Join(r.baseDir, tagsDB), 0700); err != nil {
 			return err
 		}
 
-		if err := os.Rename(f.Name(), r.tagFileFor(name)); err != nil {
+		if err := r.fs.Rename(f.Name(), r.tagFileFor(name)); err != nil {
 			return err
 		}
 
@@ -47,7 +48,7 @@ func (r *Repository) AddTag(name string, layer *Layer) error {
 // RemoveTag removes a tag by name.
 func (r *Repository) RemoveTag(name string) error {
 	return r.edit(func() error {
-		err := os.Remove(r.tagFileFor(name))
+		err := r.fs.Remove(r.tagFileFor(name))
 		if os.IsNotExist(err) {
 			return errors.Wrap(ErrTagDoesNotExist, "cannot remove")
 		}
@@ -58,7 +59,7 @@ func (r *Repository) RemoveTag(name string) error {
 // GetTag retrieves the layer by the tag name. Returns an error if the tag or
 // layer cannot be found. NOTE: the layer is *not* restored.
 func (r *Repository) GetTag(name string) (*Layer, error) {
-	f, err := os.Open(r.tagFileFor(name))
+	f, err := r.fs.Open(r.tagFileFor(name))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, errors.Wrap(ErrTagDoesNotExist, "file not found")
@@ -0,0 +1,499 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+	"golang.org/x/sys/unix"
+)
+
+// tarSplitSuffix is appended to an expanded asset's path to find its
+// tar-split metadata. For layers, this places it next to the rootfs.
+const tarSplitSuffix = ".tar-split.json.gz"
+
+func (a *Asset) tarSplitPath() string {
+	return a.path + tarSplitSuffix
+}
+
+// recordTarSplit wraps reader so that the tar-split metadata of the stream is
+// recorded while it is unpacked. The returned function must be called once
+// unpacking is done; it drains what the unpacker did not read (such as the
+// end-of-archive padding) and finishes the metadata file.
+func (a *Asset) recordTarSplit(reader io.Reader) (io.Reader, func() error, error) {
+	f, err := os.Create(a.tarSplitPath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gz := gzip.NewWriter(f)
+
+	its, err := asm.NewInputTarStream(reader, storage.NewJSONPacker(gz), nil)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+
+	finish := func() (retErr error) {
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = err
+			}
+
+			if retErr != nil {
+				os.Remove(f.Name())
+			}
+		}()
+
+		if _, err := io.Copy(ioutil.Discard, its); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	}
+
+	return its, finish, nil
+}
+
+// packTarSplit rebuilds the originally unpacked tar from the expanded files
+// and the recorded metadata. It returns false if there is no metadata, or if
+// the files no longer match it, as when they were changed other than through
+// a mount after Unpack; the tar has to be packed anew then.
+func (a *Asset) packTarSplit(writer io.Writer) (bool, error) {
+	if ok, err := a.tarSplitMatches(); err != nil || !ok {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	maps, err := a.loadSparseMaps()
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(a.tarSplitPath())
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+	defer gz.Close()
+
+	if err := a.writeTarSplit(writer, storage.NewJSONUnpacker(gz), maps); err != nil {
+		return true, errors.Wrapf(ErrInvalidAsset, "contents no longer match the unpacked tar: %v", err)
+	}
+
+	return true, nil
+}
+
+// writeTarSplit writes the tar recorded in tar-split metadata to writer, with
+// the contents of its files read from the expanded asset, as
+// asm.WriteOutputTarStream does. Files with maps are written as the sparse
+// files they were in the tar, with only the data in their extents.
+func (a *Asset) writeTarSplit(writer io.Writer, unpacker storage.Unpacker, maps map[string]sparseMap) error {
+	for {
+		entry, err := unpacker.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch entry.Type {
+		case storage.SegmentType:
+			if _, err := writer.Write(entry.Payload); err != nil {
+				return err
+			}
+		case storage.FileType:
+			if entry.Size == 0 {
+				continue
+			}
+
+			if err := a.writeTarSplitFile(writer, entry, maps); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *Asset) writeTarSplitFile(writer io.Writer, entry *storage.Entry, maps map[string]sparseMap) error {
+	name := entry.GetName()
+
+	f, err := os.Open(filepath.Join(a.path, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if sparse, ok := maps[name]; ok {
+		if _, err := writer.Write(sparse.Prefix); err != nil {
+			return err
+		}
+
+		writer = &extentWriter{writer: writer, extents: sparse.Extents}
+	}
+
+	// the checksum covers the whole file, holes included.
+	crc := crc64.New(storage.CRCTable)
+	if _, err := io.Copy(io.MultiWriter(writer, crc), f); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(crc.Sum(nil), entry.Payload) {
+		return errors.Errorf("file integrity checksum failed for %q", name)
+	}
+
+	return nil
+}
+
+// tarSplitMatches reports if the expanded files are still those the tar-split
+// metadata was recorded for: the same names and types, and for each of them
+// the same size, link target, mode, modification time, owner and extended
+// attributes that Unpack gave them. Contents are only checked while the tar
+// is rebuilt.
+func (a *Asset) tarSplitMatches() (bool, error) {
+	f, err := os.Open(a.tarSplitPath())
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+	defer gz.Close()
+
+	maps, err := a.loadSparseMaps()
+	if err != nil {
+		return false, err
+	}
+
+	// later entries replace earlier ones of the same name, as in Unpack.
+	entries := map[string]*tarSplitEntry{}
+	tr := tar.NewReader(&tarSplitSkeleton{unpacker: storage.NewJSONUnpacker(gz), maps: maps})
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, errors.Wrapf(ErrInvalidAsset, "cannot read tar-split metadata: %v", err)
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		entry := &tarSplitEntry{header: header}
+		if header.Typeflag == tar.TypeLink {
+			entry.inode = entries[path.Clean("/"+header.Linkname)].inodeOf()
+			entry.inode.own(header)
+		} else {
+			entry.inode = newTarSplitInode(header)
+		}
+
+		entries[path.Clean("/"+header.Name)] = entry
+	}
+
+	for name, entry := range entries {
+		ok, err := a.entryMatches(name, entry)
+		if err != nil || !ok {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+
+	// anything else must be a parent dir Unpack created for the entries.
+	parents := map[string]bool{"/": true}
+	for name := range entries {
+		for dir := path.Dir(name); !parents[dir]; dir = path.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+
+	errMismatch := errors.New("files do not match the tar-split metadata")
+	err = filepath.Walk(a.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(a.path, p)
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		if _, ok := entries[name]; ok || (parents[name] && fi.IsDir()) {
+			return nil
+		}
+
+		return errMismatch
+	})
+	if err == errMismatch {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// tarSplitModes are the bits of a mode that Unpack sets.
+const tarSplitModes = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// tarSplitEntry is the last entry of a name in the tar, and the inode Unpack
+// made of it, which hardlinks share.
+type tarSplitEntry struct {
+	header *tar.Header
+	inode  *tarSplitInode
+}
+
+func (e *tarSplitEntry) inodeOf() *tarSplitInode {
+	if e == nil {
+		return &tarSplitInode{}
+	}
+
+	return e.inode
+}
+
+// tarSplitInode is what Unpack leaves of the metadata of an entry. Hardlink
+// entries set the owner of the inode they link to, but neither its mode nor
+// its times, which archive.Unpack looks up relative to the working dir.
+type tarSplitInode struct {
+	mode     os.FileMode
+	mtime    time.Time
+	uid, gid int
+	xattrs   map[string]string
+}
+
+func newTarSplitInode(header *tar.Header) *tarSplitInode {
+	inode := &tarSplitInode{
+		mode:  header.FileInfo().Mode() & tarSplitModes,
+		mtime: header.ModTime,
+	}
+
+	// Unpack sets times before the epoch to the epoch, except for symlinks.
+	if header.Typeflag != tar.TypeSymlink && inode.mtime.Before(time.Unix(0, 0)) {
+		inode.mtime = time.Unix(0, 0)
+	}
+
+	inode.own(header)
+	return inode
+}
+
+// own applies the owner and the extended attributes of header, which Unpack
+// sets for hardlinks too.
+func (i *tarSplitInode) own(header *tar.Header) {
+	i.uid, i.gid = header.Uid, header.Gid
+
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			if i.xattrs == nil {
+				i.xattrs = map[string]string{}
+			}
+			i.xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = value
+		}
+	}
+}
+
+// entryMatches reports if the file name is what Unpack created for entry.
+func (a *Asset) entryMatches(name string, entry *tarSplitEntry) (bool, error) {
+	p := filepath.Join(a.path, name)
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return false, err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errors.Wrapf(ErrInvalidAsset, "cannot stat %q", p)
+	}
+
+	header := entry.header
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if !fi.Mode().IsRegular() || fi.Size() != header.Size {
+			return false, nil
+		}
+	case tar.TypeDir:
+		if !fi.IsDir() {
+			return false, nil
+		}
+
+		// the tar would need a .wh..wh..opq entry it does not have.
+		if opaque, err := overlayOpaque(p); opaque || err != nil {
+			return false, err
+		}
+	case tar.TypeSymlink:
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return false, nil
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil || target != header.Linkname {
+			return false, err
+		}
+	case tar.TypeLink:
+		target, err := os.Lstat(filepath.Join(a.path, path.Clean("/"+header.Linkname)))
+		if err != nil || !os.SameFile(fi, target) {
+			return false, nil
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if fi.Mode()&os.ModeDevice == 0 || int64(unix.Major(uint64(stat.Rdev))) != header.Devmajor || int64(unix.Minor(uint64(stat.Rdev))) != header.Devminor {
+			return false, nil
+		}
+	case tar.TypeFifo:
+		if fi.Mode()&os.ModeNamedPipe == 0 {
+			return false, nil
+		}
+	}
+
+	inode := entry.inode
+	if fi.Mode()&os.ModeSymlink == 0 && fi.Mode()&tarSplitModes != inode.mode {
+		return false, nil
+	}
+
+	if !fi.ModTime().Equal(inode.mtime) {
+		return false, nil
+	}
+
+	// owners are set when unpacking as root, and otherwise recorded in
+	// ownerXattr where the file can take it.
+	recorded, err := lgetxattr(p, ownerXattr)
+	if err != nil {
+		return false, err
+	}
+
+	if os.Geteuid() == 0 || recorded != nil {
+		uid, gid, err := a.containerOwner(p, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			return false, err
+		}
+
+		if uid != inode.uid || gid != inode.gid {
+			return false, nil
+		}
+	}
+
+	// attributes from the tar that the filesystem or the privileges did not
+	// let Unpack set are not missed, but anything Pack would write must have
+	// come from the tar.
+	attrs, err := llistxattr(p)
+	if err != nil {
+		return false, err
+	}
+
+	for _, attr := range attrs {
+		value, err := lgetxattr(p, attr)
+		if err != nil {
+			return false, err
+		}
+
+		if value == nil || !a.packXattr(attr, value) {
+			continue
+		}
+
+		if want, ok := inode.xattrs[attr]; !ok || want != string(value) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// tarSplitSkeleton reads the tar recorded in tar-split metadata, with zeros in
+// place of the contents of its files, which are not part of the metadata.
+// Sparse files get the zeros of their extents, after their maps.
+type tarSplitSkeleton struct {
+	unpacker storage.Unpacker
+	maps     map[string]sparseMap
+	segment  []byte
+	zeros    int64
+}
+
+func (s *tarSplitSkeleton) Read(p []byte) (int, error) {
+	for len(s.segment) == 0 && s.zeros == 0 {
+		entry, err := s.unpacker.Next()
+		if err != nil {
+			return 0, err
+		}
+
+		switch entry.Type {
+		case storage.SegmentType:
+			s.segment = entry.Payload
+		case storage.FileType:
+			s.zeros = entry.Size
+
+			if sparse, ok := s.maps[entry.GetName()]; ok && entry.Size > 0 {
+				s.segment = sparse.Prefix
+				s.zeros = 0
+				for _, extent := range sparse.Extents {
+					s.zeros += extent.Length
+				}
+			}
+		}
+	}
+
+	if len(s.segment) > 0 {
+		n := copy(p, s.segment)
+		s.segment = s.segment[n:]
+		return n, nil
+	}
+
+	if int64(len(p)) > s.zeros {
+		p = p[:s.zeros]
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+	s.zeros -= int64(len(p))
+
+	return len(p), nil
+}
+
+// removeTarSplit discards the tar-split metadata; it is used when the
+// expanded files are about to diverge from the unpacked tar.
+func (a *Asset) removeTarSplit() error {
+	for _, p := range []string{a.tarSplitPath(), a.sparsePath()} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,142 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func (m *mountSuite) TestTarSplitRoundTrip(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar verbatim")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, header := range []*tar.Header{
+		{Name: "zzz", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, Uname: "someone", ModTime: time.Unix(1234567890, 0)},
+		{Name: "aaa/", Typeflag: tar.TypeDir, Mode: 0755, Format: tar.FormatPAX, PAXRecords: map[string]string{"comment": "kept"}},
+		{Name: "aaa/file", Typeflag: tar.TypeReg, Mode: 0600, Size: 3, Format: tar.FormatGNU},
+	} {
+		c.Assert(tw.WriteHeader(header), IsNil)
+		if header.Size > 0 {
+			_, err := tw.Write([]byte("abc"))
+			c.Assert(err, IsNil)
+		}
+	}
+	c.Assert(tw.Close(), IsNil)
+	// trailing garbage past the end-of-archive marker must survive too.
+	buf.Write(make([]byte, 1024))
+	original := buf.Bytes()
+
+	layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(original), nil, false)
+	c.Assert(err, IsNil)
+
+	_, err = os.Stat(layer.Path() + tarSplitSuffix)
+	c.Assert(err, IsNil)
+
+	packed := new(bytes.Buffer)
+	dg, err := layer.Pack(packed)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(packed.Bytes(), original), Equals, true)
+	c.Assert(dg.Hex(), Equals, layer.ID())
+
+	dg, err = layer.LoadDigest()
+	c.Assert(err, IsNil)
+	c.Assert(dg.Hex(), Equals, layer.ID())
+
+	// changes after Unpack are packed anew.
+	c.Assert(os.MkdirAll(filepath.Join(layer.Path(), "bbb"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(layer.Path(), "bbb", "added"), []byte("new"), 0644), IsNil)
+	files := readLayer(c, layer)
+	c.Assert(files["bbb/added"], Equals, "new")
+	c.Assert(files["zzz"], Equals, "abc")
+	c.Assert(os.RemoveAll(filepath.Join(layer.Path(), "bbb")), IsNil)
+
+	// which is only told by the times of files if their size is the same.
+	c.Assert(ioutil.WriteFile(filepath.Join(layer.Path(), "zzz"), []byte("xyz"), 0644), IsNil)
+	c.Assert(readLayer(c, layer)["zzz"], Equals, "xyz")
+	c.Assert(os.Chtimes(filepath.Join(layer.Path(), "zzz"), time.Unix(1234567890, 0), time.Unix(1234567890, 0)), IsNil)
+	_, err = layer.Pack(ioutil.Discard)
+	c.Assert(errors.Cause(err), Equals, ErrInvalidAsset)
+
+	c.Assert(os.Remove(filepath.Join(layer.Path(), "aaa", "file")), IsNil)
+	_, ok := readLayer(c, layer)["aaa/file"]
+	c.Assert(ok, Equals, false)
+
+	// unpacking over existing content drops the metadata.
+	_, err = layer.Unpack(makeTar(c, []tarEntry{{name: "more", content: "more", typeflag: tar.TypeReg}}))
+	c.Assert(err, IsNil)
+	_, err = os.Stat(layer.Path() + tarSplitSuffix)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	files = readLayer(c, layer)
+	c.Assert(files["more"], Equals, "more")
+	c.Assert(files["zzz"], Equals, "xyz")
+}
+
+func (m *mountSuite) TestTarSplitMetadata(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar verbatim")
+		return
+	}
+
+	entries := []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/a", content: "a", typeflag: tar.TypeReg},
+		{name: "etc/a-link", linkname: "etc/a", typeflag: tar.TypeLink},
+		{name: "etc/sym", linkname: "a", typeflag: tar.TypeSymlink},
+	}
+
+	then := time.Unix(1234567890, 0)
+
+	for i, change := range []func(dir string) error{
+		func(dir string) error { return os.Chmod(filepath.Join(dir, "etc"), 0700) },
+		func(dir string) error { return os.Chtimes(filepath.Join(dir, "etc"), then, then) },
+		func(dir string) error { return os.Chmod(filepath.Join(dir, "etc/a"), 0644|os.ModeSetuid) },
+		func(dir string) error { return os.Lchown(filepath.Join(dir, "etc/a"), 1, 1) },
+		func(dir string) error { return os.Lchown(filepath.Join(dir, "etc/sym"), 1, 1) },
+		func(dir string) error {
+			ts := []unix.Timespec{unix.NsecToTimespec(then.UnixNano()), unix.NsecToTimespec(then.UnixNano())}
+			return unix.UtimesNanoAt(unix.AT_FDCWD, filepath.Join(dir, "etc/sym"), ts, unix.AT_SYMLINK_NOFOLLOW)
+		},
+		func(dir string) error {
+			// a copy is no longer the same file, even with the same times.
+			fi, err := os.Stat(filepath.Join(dir, "etc/a"))
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(filepath.Join(dir, "etc/a-link")); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "etc/a-link"), []byte("a"), 0644); err != nil {
+				return err
+			}
+			return os.Chtimes(filepath.Join(dir, "etc/a-link"), fi.ModTime(), fi.ModTime())
+		},
+	} {
+		layer, err := m.Repository.CreateLayerFromAsset(makeTar(c, entries), nil, true)
+		c.Assert(err, IsNil)
+
+		ok, err := layer.asset.tarSplitMatches()
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		c.Assert(change(layer.Path()), IsNil)
+
+		ok, err = layer.asset.tarSplitMatches()
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, false, Commentf("change %d", i))
+
+		dg, err := layer.LoadDigest()
+		c.Assert(err, IsNil)
+		c.Assert(dg.Hex(), Not(Equals), layer.ID())
+	}
+}
@@ -2,10 +2,14 @@ package overmount
 
 import (
 	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	. "gopkg.in/check.v1"
 )
@@ -57,3 +61,72 @@ func (m *mountSuite) makeImage(c *C, layerCount int) (*Image, *Layer) {
 	}
 	return m.Repository.NewImage(parent), parent
 }
+
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+}
+
+func makeTar(c *C, entries []tarEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+		}
+
+		switch entry.typeflag {
+		case tar.TypeDir:
+			header.Mode = 0755
+		case tar.TypeReg:
+			header.Size = int64(len(entry.content))
+		}
+
+		c.Assert(tw.WriteHeader(header), IsNil)
+		_, err := tw.Write([]byte(entry.content))
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(tw.Close(), IsNil)
+	return buf
+}
+
+// readLayer packs the layer and returns a map of path -> content; non-regular
+// files map to their type.
+func readLayer(c *C, layer *Layer) map[string]string {
+	buf := new(bytes.Buffer)
+	_, err := layer.Pack(buf)
+	c.Assert(err, IsNil)
+
+	files := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		name := strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/")
+		if header.Typeflag == tar.TypeReg {
+			content, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			files[name] = string(content)
+		} else {
+			files[name] = string(header.Typeflag)
+		}
+	}
+
+	return files
+}
+
+func readImageFile(image *Image, name string) (string, error) {
+	content, err := fs.ReadFile(image.FS(), name)
+	return string(content), err
+}
@@ -0,0 +1,426 @@
+package overmount
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// vfsBase is the dir in the work dir of a writable mount which holds the
+// merged layers as they were mounted.
+const vfsBase = "base"
+
+// VFSDriver mounts without a filesystem: it materializes the merged layers in
+// the target dir, applying their whiteouts, so it works wherever files can be
+// written, such as unprivileged containers and CI sandboxes. Mounting and
+// unmounting take time and space in proportion to the size of the image.
+//
+// Writable mounts copy the merged layers twice, once to the target and once
+// to a snapshot in the work dir. Unmount compares the target to the snapshot
+// and writes the differences to the upper dir, with whiteouts for removed
+// files, before it empties the target.
+//
+// The target of a read-only mount is not protected from writes, which are
+// lost on Unmount. With Hardlink, read-only mounts hardlink files instead of
+// copying them, which is fast, but then writing to a file changes the layer it
+// came from. Writable mounts always copy.
+type VFSDriver struct {
+	Hardlink bool
+}
+
+// Name returns "vfs".
+func (VFSDriver) Name() string {
+	return "vfs"
+}
+
+// MinLayers returns 1.
+func (VFSDriver) MinLayers() int {
+	return 1
+}
+
+// Mount materializes the layers of m in its target.
+func (d VFSDriver) Mount(m *Mount) error {
+	if err := d.mount(m); err != nil {
+		clearDir(m.target)
+		return err
+	}
+
+	return nil
+}
+
+func (d VFSDriver) mount(m *Mount) error {
+	layers := vfsLowerDirs(m)
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := materialize(layers[i], m.target, d.Hardlink && m.ReadOnly()); err != nil {
+			return errors.Wrapf(ErrMountCannotProceed, "cannot materialize %q: %v", layers[i], err)
+		}
+	}
+
+	if m.ReadOnly() {
+		return nil
+	}
+
+	if err := materialize(m.upper, m.target, false); err != nil {
+		return errors.Wrapf(ErrMountCannotProceed, "cannot materialize %q: %v", m.upper, err)
+	}
+
+	base := filepath.Join(m.work, vfsBase)
+	if err := os.Mkdir(base, 0700); err != nil {
+		return errors.Wrap(ErrMountCannotProceed, err.Error())
+	}
+
+	if err := materialize(m.target, base, false); err != nil {
+		return errors.Wrapf(ErrMountCannotProceed, "cannot snapshot %q: %v", m.target, err)
+	}
+
+	return nil
+}
+
+// Unmount writes the changes made at the target of a writable mount to its
+// upper dir, and empties the target.
+func (VFSDriver) Unmount(m *Mount) error {
+	if !m.ReadOnly() {
+		if err := commitChanges(m); err != nil {
+			return errors.Wrap(ErrUnmountFailed, err.Error())
+		}
+	}
+
+	return clearDir(m.target)
+}
+
+// vfsLowerDirs returns the lower dirs of m, topmost first.
+func vfsLowerDirs(m *Mount) []string {
+	if m.lower == "" {
+		return nil
+	}
+
+	return strings.Split(m.lower, ":")
+}
+
+// materialize applies the layer in dir onto target: the whiteouts first, then
+// everything else. Files are copied, or hardlinked with link.
+func materialize(dir, target string, link bool) error {
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(target, rel)
+		name := filepath.Base(p)
+
+		switch {
+		case fi.IsDir() && isOpaqueDir(p):
+			if dfi, err := os.Lstat(dest); err == nil && dfi.IsDir() {
+				return clearDir(dest)
+			}
+		case name == archive.WhiteoutOpaqueDir:
+		case strings.HasPrefix(name, archive.WhiteoutPrefix):
+			return removeWhitedOut(filepath.Join(filepath.Dir(dest), strings.TrimPrefix(name, archive.WhiteoutPrefix)))
+		case isWhiteoutInfo(fi):
+			return removeWhitedOut(dest)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dirs := []string{}
+	inodes := map[uint64]string{}
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(target, rel)
+		name := filepath.Base(p)
+
+		if strings.HasPrefix(name, archive.WhiteoutPrefix) || isWhiteoutInfo(fi) {
+			return nil
+		}
+
+		if fi.IsDir() {
+			dirs = append(dirs, rel)
+			if rel == "." {
+				return nil
+			}
+
+			if dfi, err := os.Lstat(dest); err == nil && dfi.IsDir() {
+				return nil
+			}
+
+			if err := os.RemoveAll(dest); err != nil {
+				return err
+			}
+
+			return os.Mkdir(dest, 0700)
+		}
+
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+
+		return copyEntryTo(p, dest, fi, link, inodes)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory attributes are applied last, as creating their entries
+	// changed their times.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := copyVFSAttrs(filepath.Join(dir, dirs[i]), filepath.Join(target, dirs[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyEntryTo creates dest as a copy of the non-directory p, described by fi,
+// or as a hardlink to it with link. Files hardlinked to each other are
+// hardlinked to each other again, through inodes.
+func copyEntryTo(p, dest string, fi os.FileInfo, link bool, inodes map[uint64]string) error {
+	if link {
+		return os.Link(p, dest)
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Wrapf(ErrInvalidLayer, "cannot stat %q", p)
+	}
+
+	if fi.Mode().IsRegular() && stat.Nlink > 1 {
+		if first, ok := inodes[stat.Ino]; ok {
+			return os.Link(first, dest)
+		}
+		inodes[stat.Ino] = dest
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		if err := cloneFile(p, dest); err != nil {
+			return err
+		}
+	default:
+		if err := unix.Mknod(dest, stat.Mode, int(stat.Rdev)); err != nil {
+			return errors.Wrapf(ErrInvalidLayer, "cannot create %q: %v", dest, err)
+		}
+	}
+
+	return copyVFSAttrs(p, dest)
+}
+
+// copyVFSAttrs copies the attributes of source to target, except for the
+// opaque xattr, which would hide lower layers once target is in an upper dir.
+func copyVFSAttrs(source, target string) error {
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Wrapf(ErrInvalidLayer, "cannot stat %q", source)
+	}
+
+	if err := cloneAttrs(source, target, fi, stat); err != nil {
+		return err
+	}
+
+	if err := unix.Lremovexattr(target, overlayOpaqueXattr); err != nil && err != unix.ENODATA && err != unix.ENOTSUP && err != unix.EPERM {
+		return err
+	}
+
+	return nil
+}
+
+// isOpaqueDir reports if the dir p hides the contents of lower layers, by
+// either an AUFS or an overlay marker.
+func isOpaqueDir(p string) bool {
+	if _, err := os.Lstat(filepath.Join(p, archive.WhiteoutOpaqueDir)); err == nil {
+		return true
+	}
+
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(p, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// removeWhitedOut removes p, which a whiteout hides. Whiteouts of files which
+// do not exist in the lower layers are ignored.
+func removeWhitedOut(p string) error {
+	if err := os.RemoveAll(p); err != nil && !isNotDir(err) {
+		return err
+	}
+
+	return nil
+}
+
+// commitChanges writes the differences between the target of m and its
+// snapshot to the upper dir.
+func commitChanges(m *Mount) error {
+	changes, err := archive.ChangesDirs(m.target, filepath.Join(m.work, vfsBase))
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	for _, change := range changes {
+		rel := strings.TrimPrefix(change.Path, "/")
+
+		if change.Kind == archive.ChangeDelete {
+			err = deleteFromUpper(m, rel)
+		} else {
+			err = copyToUpper(m, rel)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// creating entries in the dirs of the upper dir changed their times, so
+	// their attributes are copied again, deepest first.
+	done := map[string]bool{}
+	for i := len(changes) - 1; i >= 0; i-- {
+		for rel := strings.TrimPrefix(changes[i].Path, "/"); rel != "." && !done[rel]; rel = filepath.Dir(rel) {
+			done[rel] = true
+
+			fi, err := os.Lstat(filepath.Join(m.target, rel))
+			if err != nil || !fi.IsDir() {
+				continue
+			}
+
+			if err := copyVFSAttrs(filepath.Join(m.target, rel), filepath.Join(m.upper, rel)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyToUpper copies rel from the target to the upper dir of m, with its
+// parent dirs.
+func copyToUpper(m *Mount, rel string) error {
+	if err := makeUpperParents(m, rel); err != nil {
+		return err
+	}
+
+	source := filepath.Join(m.target, rel)
+	dest := filepath.Join(m.upper, rel)
+
+	// the file is back, so it must no longer be hidden.
+	if err := os.RemoveAll(filepath.Join(filepath.Dir(dest), archive.WhiteoutPrefix+filepath.Base(dest))); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		if dfi, err := os.Lstat(dest); err != nil || !dfi.IsDir() {
+			if err := os.RemoveAll(dest); err != nil {
+				return err
+			}
+			if err := os.Mkdir(dest, 0700); err != nil {
+				return err
+			}
+		}
+
+		return copyVFSAttrs(source, dest)
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+
+	return copyEntryTo(source, dest, fi, false, map[uint64]string{})
+}
+
+// makeUpperParents creates the parent dirs of rel in the upper dir of m, with
+// the attributes of those in the target.
+func makeUpperParents(m *Mount, rel string) error {
+	dir := filepath.Dir(rel)
+	if dir == "." {
+		return nil
+	}
+
+	if fi, err := os.Lstat(filepath.Join(m.upper, dir)); err == nil && fi.IsDir() {
+		return nil
+	}
+
+	if err := makeUpperParents(m, dir); err != nil {
+		return err
+	}
+
+	return copyToUpper(m, dir)
+}
+
+// deleteFromUpper removes rel from the upper dir of m, and hides it with a
+// whiteout if a lower layer has it.
+func deleteFromUpper(m *Mount, rel string) error {
+	dest := filepath.Join(m.upper, rel)
+	if err := os.RemoveAll(dest); err != nil && !isNotDir(err) {
+		return err
+	}
+
+	for _, lower := range vfsLowerDirs(m) {
+		if _, err := os.Lstat(filepath.Join(lower, rel)); err != nil {
+			continue
+		}
+
+		if err := makeUpperParents(m, rel); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filepath.Join(filepath.Dir(dest), archive.WhiteoutPrefix+filepath.Base(dest)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+
+		return f.Close()
+	}
+
+	return nil
+}
+
+// isNotDir reports if err is ENOTDIR, as when a whiteout hides a file below
+// what a later layer turned into a file.
+func isNotDir(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+
+	return err == unix.ENOTDIR
+}
@@ -0,0 +1,315 @@
+package overmount
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	paxXattrPrefix     = "SCHILY.xattr."
+	overlayXattrPrefix = "trusted.overlay."
+	userOverlayPrefix  = "user.overlay."
+	selinuxXattr       = "security.selinux"
+)
+
+// SetSELinuxLabel sets the SELinux label applied to everything unpacked into
+// the expanded layers of the repository from now on, replacing any label in
+// the tar. As the label is specific to the host, it is not packed again. An
+// empty label, the default, keeps the labels from the tar. It has no effect on
+// virtual repositories.
+func (r *Repository) SetSELinuxLabel(label string) {
+	r.edit(func() error {
+		r.selinuxLabel = label
+		for _, layer := range r.layers {
+			layer.asset.SetSELinuxLabel(label)
+		}
+		return nil
+	})
+}
+
+// SetSELinuxLabel sets the SELinux label of the asset. See
+// Repository.SetSELinuxLabel.
+func (a *Asset) SetSELinuxLabel(label string) {
+	a.selinuxLabel = label
+}
+
+// unpackTar unpacks the tar in reader to the asset's path, keeping the holes
+// of sparse files, and relabels the result, if requested. It returns the
+// sparse maps of the sparse files, which tar-split does not keep.
+func (a *Asset) unpackTar(reader io.Reader) (map[string]sparseMap, error) {
+	watched, labeled := watchLabels(reader)
+	filtered, finish := a.filterSparse(watched)
+
+	maps, err := finish(a.unpackOwners(filtered))
+	found, labelErr := labeled()
+	if err != nil {
+		return nil, err
+	}
+
+	if labelErr != nil {
+		return nil, labelErr
+	}
+
+	if found {
+		if err := ioutil.WriteFile(a.selinuxPath(), nil, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.selinuxLabel == "" {
+		return maps, nil
+	}
+
+	return maps, filepath.Walk(a.path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := unix.Lsetxattr(p, selinuxXattr, []byte(a.selinuxLabel), 0); err != nil {
+			return errors.Wrapf(ErrInvalidAsset, "cannot relabel %q: %v", p, err)
+		}
+
+		return nil
+	})
+}
+
+// selinuxSuffix is appended to an expanded asset's path to mark that a tar
+// unpacked into it carried SELinux labels. Labels are only packed then: files
+// unpacked from tars without them get the default label of the host, which
+// does not belong in an image.
+const selinuxSuffix = ".selinux"
+
+func (a *Asset) selinuxPath() string {
+	return a.path + selinuxSuffix
+}
+
+// packXattr reports if the extended attribute attr with value belongs in a
+// tar. Overlay's private attributes, in the trusted.overlay namespace or, for
+// mounts with userxattr, the user.overlay one, and overmount's own are left
+// out, as are SELinux labels, unless the unpacked tar carried them, and the
+// label applied by SetSELinuxLabel.
+func (a *Asset) packXattr(attr string, value []byte) bool {
+	switch {
+	case strings.HasPrefix(attr, overlayXattrPrefix), strings.HasPrefix(attr, userOverlayPrefix), attr == ownerXattr:
+		return false
+	case attr == selinuxXattr:
+		if a.selinuxLabel != "" && strings.TrimRight(string(value), "\x00") == a.selinuxLabel {
+			return false
+		}
+
+		_, err := os.Lstat(a.selinuxPath())
+		return err == nil
+	}
+
+	return true
+}
+
+// watchLabels reads the headers of the tar passing through reader in the
+// background, as recordOwners does. The returned function must be called once
+// the stream has been read; it reports if any entry had an SELinux label.
+func watchLabels(reader io.Reader) (io.Reader, func() (bool, error)) {
+	pr, pw := io.Pipe()
+	found := false
+	errChan := make(chan error, 1)
+
+	go func() {
+		tr := tar.NewReader(pr)
+
+		var err error
+		for {
+			var header *tar.Header
+			header, err = tr.Next()
+			if err != nil {
+				break
+			}
+
+			if _, ok := header.PAXRecords[paxXattrPrefix+selinuxXattr]; ok {
+				found = true
+			}
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+
+		// keep draining so the writing side never blocks.
+		io.Copy(ioutil.Discard, pr)
+		errChan <- err
+	}()
+
+	finish := func() (bool, error) {
+		pw.Close()
+		err := <-errChan
+		return found, err
+	}
+
+	return io.TeeReader(reader, pw), finish
+}
+
+// setXattrs replaces the extended attributes in header with those of the file
+// p, which includes file capabilities, POSIX ACLs (system.posix_acl_access and
+// system.posix_acl_default) and SELinux labels.
+func (a *Asset) setXattrs(header *tar.Header, p string) error {
+	header.Xattrs = nil
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, paxXattrPrefix) {
+			delete(header.PAXRecords, key)
+		}
+	}
+
+	attrs, err := llistxattr(p)
+	if err != nil {
+		return err
+	}
+
+	for _, attr := range attrs {
+		if err := checkOverlayXattr(p, attr); err != nil {
+			return err
+		}
+
+		value, err := lgetxattr(p, attr)
+		if err != nil {
+			return err
+		}
+
+		if value == nil || !a.packXattr(attr, value) {
+			continue
+		}
+
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+
+		header.PAXRecords[paxXattrPrefix+attr] = string(value)
+		header.Format = tar.FormatPAX
+	}
+
+	return nil
+}
+
+// overlayOpaque reports if overlay made the dir p opaque, hiding the contents
+// of the lower layers, in either namespace of its attributes.
+func overlayOpaque(p string) (bool, error) {
+	for _, prefix := range []string{overlayXattrPrefix, userOverlayPrefix} {
+		value, err := lgetxattr(p, prefix+"opaque")
+		if err != nil {
+			return false, err
+		}
+
+		if string(value) == "y" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// writeOpaque writes the .wh..wh..opq entry that stands for the opaque
+// attribute of the dir p, whose header was just written, as overlay's
+// attributes are not packed. Dirs that already have the entry, as unpacked
+// from a tar, are left alone.
+func writeOpaque(tw *tar.Writer, header *tar.Header, p string) error {
+	if header.Typeflag != tar.TypeDir {
+		return nil
+	}
+
+	opaque, err := overlayOpaque(p)
+	if err != nil || !opaque {
+		return err
+	}
+
+	if _, err := os.Lstat(filepath.Join(p, archive.WhiteoutOpaqueDir)); err == nil {
+		return nil
+	}
+
+	return tw.WriteHeader(&tar.Header{
+		Name:     path.Join(header.Name, archive.WhiteoutOpaqueDir),
+		Typeflag: tar.TypeReg,
+		Mode:     header.Mode & int64(os.ModePerm),
+		Uid:      header.Uid,
+		Gid:      header.Gid,
+		ModTime:  header.ModTime,
+		Format:   header.Format,
+	})
+}
+
+// checkOverlayXattr returns an error if attr is one of the attributes which
+// metacopy and redirect_dir mounts leave in upper dirs: the contents of such
+// files and dirs are in the lower layers, so a tar of the upper dir would lose
+// them.
+func checkOverlayXattr(p, attr string) error {
+	for _, prefix := range []string{overlayXattrPrefix, userOverlayPrefix} {
+		if attr == prefix+"metacopy" || attr == prefix+"redirect" {
+			return errors.Wrapf(ErrInvalidLayer, "cannot pack %q: it has the overlay attribute %s, which needs the lower layers", p, attr)
+		}
+	}
+
+	return nil
+}
+
+// lgetxattr returns the value of the extended attribute attr of path, or nil
+// if it is not set or not supported.
+func lgetxattr(path, attr string) ([]byte, error) {
+	buf := make([]byte, 128)
+
+	for {
+		n, err := unix.Lgetxattr(path, attr, buf)
+		switch err {
+		case nil:
+			return buf[:n], nil
+		case unix.ERANGE:
+			size, err := unix.Lgetxattr(path, attr, nil)
+			if err != nil {
+				return nil, err
+			}
+			buf = make([]byte, size)
+		case unix.ENODATA, unix.ENOTSUP, unix.EPERM:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// llistxattr returns the names of the extended attributes of path.
+func llistxattr(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []string{}
+	start := 0
+	for i, b := range buf[:n] {
+		if b == 0 {
+			if i > start {
+				attrs = append(attrs, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+
+	return attrs, nil
+}
@@ -0,0 +1,191 @@
+package overmount
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func packedXattrs(c *C, layer *Layer, opts *PackOptions) map[string]map[string]string {
+	buf := new(bytes.Buffer)
+	_, err := layer.PackWithOptions(buf, opts)
+	c.Assert(err, IsNil)
+
+	xattrs := map[string]map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+
+		for key, value := range header.PAXRecords {
+			if len(key) > len(paxXattrPrefix) && key[:len(paxXattrPrefix)] == paxXattrPrefix {
+				if xattrs[header.Name] == nil {
+					xattrs[header.Name] = map[string]string{}
+				}
+				xattrs[header.Name][key[len(paxXattrPrefix):]] = value
+			}
+		}
+	}
+
+	return xattrs
+}
+
+func (m *mountSuite) TestXattrs(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar as is")
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		c.Skip("capabilities and trusted xattrs can only be set as root")
+		return
+	}
+
+	// cap_net_raw+ep
+	capability := new(bytes.Buffer)
+	for _, word := range []uint32{0x02000001, 1 << 13, 0, 0, 0} {
+		binary.Write(capability, binary.LittleEndian, word)
+	}
+
+	// user::rw-, user:1000:r--, group::r--, mask::r--, other::r--, which
+	// matches the mode of the file.
+	acl := new(bytes.Buffer)
+	binary.Write(acl, binary.LittleEndian, uint32(2))
+	for _, entry := range []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, 0xffffffff},
+		{0x02, 4, 1000},
+		{0x04, 4, 0xffffffff},
+		{0x10, 4, 0xffffffff},
+		{0x20, 4, 0xffffffff},
+	} {
+		binary.Write(acl, binary.LittleEndian, entry)
+	}
+
+	want := map[string]string{
+		"security.capability":     capability.String(),
+		"user.comment":            "ping",
+		"system.posix_acl_access": acl.String(),
+		"security.selinux":        "system_u:object_r:bin_t:s0",
+	}
+
+	xattrs := map[string]string{"trusted.overlay.opaque": "y"}
+	for key, value := range want {
+		xattrs[key] = value
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{
+		Name:       "bin/ping",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		Size:       4,
+		Format:     tar.FormatPAX,
+		PAXRecords: prefixXattrs(xattrs),
+	}), IsNil)
+	_, err := tw.Write([]byte("ping"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(buf.Bytes()), nil, false)
+	c.Assert(err, IsNil)
+
+	for key, value := range xattrs {
+		got, err := lgetxattr(filepath.Join(layer.Path(), "bin/ping"), key)
+		c.Assert(err, IsNil)
+		c.Assert(string(got), Equals, value, Commentf("%v", key))
+	}
+
+	// without the tar-split metadata, the xattrs are read from disk.
+	c.Assert(layer.asset.removeTarSplit(), IsNil)
+	c.Assert(packedXattrs(c, layer, nil)["bin/ping"], DeepEquals, want)
+	c.Assert(packedXattrs(c, layer, &PackOptions{Reproducible: true})["bin/ping"], DeepEquals, want)
+
+	label := "system_u:object_r:container_file_t:s0"
+	m.Repository.SetSELinuxLabel(label)
+
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}), IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	relabeled, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(buf.Bytes()), layer, false)
+	c.Assert(err, IsNil)
+
+	for _, p := range []string{"", "etc"} {
+		got, err := lgetxattr(filepath.Join(relabeled.Path(), p), selinuxXattr)
+		c.Assert(err, IsNil)
+		c.Assert(string(got), Equals, label)
+	}
+
+	c.Assert(relabeled.asset.removeTarSplit(), IsNil)
+	c.Assert(packedXattrs(c, relabeled, nil), DeepEquals, map[string]map[string]string{})
+}
+
+func prefixXattrs(xattrs map[string]string) map[string]string {
+	records := map[string]string{}
+	for key, value := range xattrs {
+		records[paxXattrPrefix+key] = value
+	}
+	return records
+}
+
+func (m *mountSuite) TestXattrsUnlabeled(c *C) {
+	if m.Repository.IsVirtual() {
+		c.Skip("virtual layers keep their tar as is")
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		c.Skip("SELinux labels can only be set as root")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}), IsNil)
+	_, err := tw.Write([]byte("ping"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	layer, err := m.Repository.CreateLayerFromAsset(bytes.NewReader(buf.Bytes()), nil, false)
+	c.Assert(err, IsNil)
+
+	// the label a host policy gives new files is not part of the layer.
+	p := filepath.Join(layer.Path(), "bin/ping")
+	c.Assert(unix.Lsetxattr(p, selinuxXattr, []byte("system_u:object_r:unlabeled_t:s0"), 0), IsNil)
+
+	ok, err := layer.asset.tarSplitMatches()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(packedXattrs(c, layer, nil), DeepEquals, map[string]map[string]string{})
+
+	// an attribute set after unpacking is, and takes a fresh pack.
+	c.Assert(unix.Lsetxattr(p, "user.comment", []byte("ping"), 0), IsNil)
+
+	ok, err = layer.asset.tarSplitMatches()
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	c.Assert(packedXattrs(c, layer, nil), DeepEquals, map[string]map[string]string{
+		"bin/ping": {"user.comment": "ping"},
+	})
+
+	c.Assert(layer.asset.removeTarSplit(), IsNil)
+	c.Assert(packedXattrs(c, layer, &PackOptions{Reproducible: true}), DeepEquals, map[string]map[string]string{
+		"bin/ping": {"user.comment": "ping"},
+	})
+}